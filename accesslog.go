@@ -0,0 +1,269 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+)
+
+// Access log formats.
+const (
+	AccessLogCombined = "combined"
+	AccessLogJSON     = "json"
+)
+
+// RequestLogEntry describes a proxied HTTP request.
+type RequestLogEntry struct {
+	Time       time.Time     `json:"time"`
+	Identifier id.ID         `json:"-"`
+	Tunnel     string        `json:"tunnel,omitempty"`
+	Host       string        `json:"host"`
+	Method     string        `json:"method"`
+	Path       string        `json:"path"`
+	Proto      string        `json:"proto"`
+	Status     int           `json:"status"`
+	Bytes      int64         `json:"bytes"`
+	Duration   time.Duration `json:"-"`
+	RemoteIP   string        `json:"remote_ip"`
+	UserAgent  string        `json:"user_agent,omitempty"`
+	Referer    string        `json:"referer,omitempty"`
+}
+
+// ConnectionLogEntry describes a proxied TCP or SNI connection.
+type ConnectionLogEntry struct {
+	Time       time.Time     `json:"time"`
+	Identifier id.ID         `json:"-"`
+	Tunnel     string        `json:"tunnel,omitempty"`
+	Protocol   string        `json:"protocol"`
+	Addr       string        `json:"addr"`
+	RemoteIP   string        `json:"remote_ip"`
+	BytesIn    int64         `json:"bytes_in"`
+	BytesOut   int64         `json:"bytes_out"`
+	Duration   time.Duration `json:"-"`
+}
+
+// AccessLogger records proxied requests and connections.
+type AccessLogger interface {
+	LogRequest(e *RequestLogEntry)
+	LogConnection(e *ConnectionLogEntry)
+}
+
+// AccessLog writes access log entries to a writer, one entry per line.
+//
+// In combined format HTTP requests are logged in Combined Log Format followed
+// by client id, host and duration in milliseconds:
+//
+//	1.2.3.4 - - [02/Jan/2017:03:04:05 +0000] "GET / HTTP/1.1" 200 512 "-" "curl/7.50" ID host 12
+//
+// and connections as:
+//
+//	1.2.3.4 - - [02/Jan/2017:03:04:05 +0000] "CONNECT tcp 0.0.0.0:22" - 1024/2048 "-" "-" ID - 3000
+//
+// where 1024 and 2048 are bytes received from and sent to the user.
+type AccessLog struct {
+	w      io.Writer
+	format string
+	mu     sync.Mutex
+}
+
+// NewAccessLog creates access log writing entries in a given format.
+func NewAccessLog(w io.Writer, format string) (*AccessLog, error) {
+	switch format {
+	case AccessLogCombined, AccessLogJSON:
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+	return &AccessLog{w: w, format: format}, nil
+}
+
+// LogRequest implements AccessLogger.
+func (l *AccessLog) LogRequest(e *RequestLogEntry) {
+	var b []byte
+	if l.format == AccessLogJSON {
+		b, _ = json.Marshal(struct {
+			*RequestLogEntry
+			ID         string `json:"id"`
+			DurationMS int64  `json:"duration_ms"`
+		}{e, e.Identifier.String(), durationMS(e.Duration)})
+	} else {
+		b = []byte(fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %d %s %s %s %s %d",
+			e.RemoteIP,
+			e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			e.Method, e.Path, e.Proto,
+			e.Status, e.Bytes,
+			quoteOrDash(e.Referer), quoteOrDash(e.UserAgent),
+			e.Identifier, e.Host, durationMS(e.Duration),
+		))
+	}
+	l.write(b)
+}
+
+// LogConnection implements AccessLogger.
+func (l *AccessLog) LogConnection(e *ConnectionLogEntry) {
+	var b []byte
+	if l.format == AccessLogJSON {
+		b, _ = json.Marshal(struct {
+			*ConnectionLogEntry
+			ID         string `json:"id"`
+			DurationMS int64  `json:"duration_ms"`
+		}{e, e.Identifier.String(), durationMS(e.Duration)})
+	} else {
+		b = []byte(fmt.Sprintf("%s - - [%s] \"CONNECT %s %s\" - %d/%d \"-\" \"-\" %s - %d",
+			e.RemoteIP,
+			e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			e.Protocol, e.Addr,
+			e.BytesIn, e.BytesOut,
+			e.Identifier, durationMS(e.Duration),
+		))
+	}
+	l.write(b)
+}
+
+func (l *AccessLog) write(b []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(append(b, '\n'))
+}
+
+func durationMS(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+func quoteOrDash(s string) string {
+	if s == "" {
+		return "\"-\""
+	}
+	return strconv.Quote(s)
+}
+
+// accessLogWriter records response status and size.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessLogWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessLogWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *accessLogWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("hijack not supported")
+	}
+	return h.Hijack()
+}
+
+func (s *Server) logRequest(r *http.Request, w *accessLogWriter, start time.Time) {
+	identifier, _, _ := s.Subscriber(r.Host)
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	s.config.AccessLog.LogRequest(&RequestLogEntry{
+		Time:       start,
+		Identifier: identifier,
+		Tunnel:     s.hostTunnel(r.Host).name,
+		Host:       r.Host,
+		Method:     r.Method,
+		Path:       r.URL.RequestURI(),
+		Proto:      r.Proto,
+		Status:     status,
+		Bytes:      w.bytes,
+		Duration:   time.Since(start),
+		RemoteIP:   remoteIPString(r.RemoteAddr),
+		UserAgent:  r.UserAgent(),
+		Referer:    r.Referer(),
+	})
+}
+
+func remoteIPString(addr string) string {
+	if ip := remoteIP(addr); ip != nil {
+		return ip.String()
+	}
+	return strings.TrimSpace(addr)
+}
+
+// loggedConn counts bytes transferred and logs connection on close.
+type loggedConn struct {
+	net.Conn
+	entry    ConnectionLogEntry
+	bytesIn  int64
+	bytesOut int64
+	logger   AccessLogger
+	once     sync.Once
+}
+
+func (c *loggedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.bytesIn, int64(n))
+	return n, err
+}
+
+func (c *loggedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.bytesOut, int64(n))
+	return n, err
+}
+
+func (c *loggedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		e := c.entry
+		e.BytesIn = atomic.LoadInt64(&c.bytesIn)
+		e.BytesOut = atomic.LoadInt64(&c.bytesOut)
+		e.Duration = time.Since(e.Time)
+		c.logger.LogConnection(&e)
+	})
+	return err
+}
+
+func (s *Server) logConn(conn net.Conn, identifier id.ID, t *tunnelInfo, msg *ConnectionLogEntry) net.Conn {
+	if s.config.AccessLog == nil {
+		return conn
+	}
+	c := &loggedConn{
+		Conn:   conn,
+		entry:  *msg,
+		logger: s.config.AccessLog,
+	}
+	c.entry.Time = time.Now()
+	c.entry.Identifier = identifier
+	c.entry.Tunnel = t.name
+	c.entry.RemoteIP = remoteIPString(conn.RemoteAddr().String())
+	return c
+}
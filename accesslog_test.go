@@ -0,0 +1,115 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/log"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+func TestAccessLog(t *testing.T) {
+	t.Parallel()
+
+	identifier := id.New([]byte("client"))
+	e := &RequestLogEntry{
+		Time:       time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC),
+		Identifier: identifier,
+		Tunnel:     "web",
+		Host:       "app.example.com",
+		Method:     http.MethodGet,
+		Path:       "/index.html?a=b",
+		Proto:      "HTTP/1.1",
+		Status:     http.StatusOK,
+		Bytes:      512,
+		Duration:   12 * time.Millisecond,
+		RemoteIP:   "192.0.2.1",
+		UserAgent:  "curl/7.50",
+	}
+
+	var buf bytes.Buffer
+	l, err := NewAccessLog(&buf, AccessLogCombined)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.LogRequest(e)
+	l.LogConnection(&ConnectionLogEntry{
+		Time:       e.Time,
+		Identifier: identifier,
+		Protocol:   proto.TCP,
+		Addr:       "0.0.0.0:22",
+		RemoteIP:   "192.0.2.1",
+		BytesIn:    1024,
+		BytesOut:   2048,
+		Duration:   3 * time.Second,
+	})
+
+	expected := `192.0.2.1 - - [02/Jan/2017:03:04:05 +0000] "GET /index.html?a=b HTTP/1.1" 200 512 "-" "curl/7.50" ` + identifier.String() + " app.example.com 12\n" +
+		`192.0.2.1 - - [02/Jan/2017:03:04:05 +0000] "CONNECT tcp 0.0.0.0:22" - 1024/2048 "-" "-" ` + identifier.String() + " - 3000\n"
+	if buf.String() != expected {
+		t.Errorf("expected\n%s got\n%s", expected, buf.String())
+	}
+
+	buf.Reset()
+	l, err = NewAccessLog(&buf, AccessLogJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.LogRequest(e)
+	var v map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v["id"] != identifier.String() || v["duration_ms"] != 12.0 || v["status"] != 200.0 || v["path"] != "/index.html?a=b" {
+		t.Errorf("unexpected entry %s", buf.String())
+	}
+
+	if _, err := NewAccessLog(&buf, "common"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+type accessLogRecorder struct {
+	requests []*RequestLogEntry
+}
+
+func (r *accessLogRecorder) LogRequest(e *RequestLogEntry) {
+	r.requests = append(r.requests, e)
+}
+
+func (r *accessLogRecorder) LogConnection(e *ConnectionLogEntry) {}
+
+func TestServer_AccessLog(t *testing.T) {
+	t.Parallel()
+
+	rec := &accessLogRecorder{}
+	s := &Server{
+		registry: newRegistry(nil),
+		config:   &ServerConfig{AccessLog: rec},
+		logger:   log.NewNopLogger(),
+		metrics:  newMetrics(),
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "http://unknown.example.com/path", nil)
+	r.Header.Set("User-Agent", "test")
+	s.ServeHTTP(httptest.NewRecorder(), r)
+
+	if len(rec.requests) != 1 {
+		t.Fatal("expected request logged")
+	}
+	e := rec.requests[0]
+	if e.Status != http.StatusNotFound || e.Host != "unknown.example.com" || e.Path != "/path" ||
+		e.UserAgent != "test" || e.RemoteIP != "192.0.2.1" || !strings.HasPrefix(e.Proto, "HTTP/") || e.Bytes == 0 {
+		t.Errorf("unexpected entry %+v", e)
+	}
+}
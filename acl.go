@@ -0,0 +1,117 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ipACL holds CIDR allow and deny lists, deny list takes precedence.
+type ipACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// newIPACL parses CIDR lists, plain IP addresses are accepted as single host
+// networks. It returns nil if both lists are empty.
+func newIPACL(allow, deny []string) (*ipACL, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+
+	a := &ipACL{}
+	var err error
+	if a.allow, err = parseCIDRs(allow); err != nil {
+		return nil, fmt.Errorf("allow: %s", err)
+	}
+	if a.deny, err = parseCIDRs(deny); err != nil {
+		return nil, fmt.Errorf("deny: %s", err)
+	}
+
+	return a, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", c)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				c += "/32"
+			} else {
+				c += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// decide returns false if ip is denied, true if ip is allowed and ok false if
+// ip is in none of the lists.
+func (a *ipACL) decide(ip net.IP) (allowed, ok bool) {
+	if a == nil || ip == nil {
+		return false, false
+	}
+	if containsIP(a.deny, ip) {
+		return false, true
+	}
+	if containsIP(a.allow, ip) {
+		return true, true
+	}
+	return false, false
+}
+
+// allowed returns true if ip is not denied and the allow list is empty or
+// contains ip.
+func (a *ipACL) allowed(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	if allowed, ok := a.decide(ip); ok {
+		return allowed
+	}
+	return len(a.allow) == 0
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns IP of network address in host:port form.
+func remoteIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	return net.ParseIP(host)
+}
+
+// allowIP checks ip against the server wide lists, addresses in none of the
+// server lists are checked against the tunnel lists.
+func (s *Server) allowIP(ip net.IP, acl *ipACL) bool {
+	if allowed, ok := s.acl.decide(ip); ok {
+		return allowed
+	}
+	return acl.allowed(ip)
+}
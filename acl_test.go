@@ -0,0 +1,118 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+func TestIPACL(t *testing.T) {
+	t.Parallel()
+
+	if _, err := newIPACL([]string{"10.0.0.0/33"}, nil); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := newIPACL(nil, []string{"host"}); err == nil {
+		t.Fatal("expected error")
+	}
+
+	office, err := newIPACL([]string{"192.0.2.0/24", "2001:db8::1"}, []string{"192.0.2.13"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	open, err := newIPACL(nil, []string{"198.51.100.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := newIPACL([]string{"203.0.113.1"}, []string{"192.0.2.66"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		server   *ipACL
+		tunnel   *ipACL
+		addr     string
+		expected bool
+	}{
+		{nil, nil, "192.0.2.1:80", true},
+		{nil, office, "192.0.2.1:80", true},
+		{nil, office, "[2001:db8::1]:80", true},
+		{nil, office, "192.0.2.13:80", false},
+		{nil, office, "198.51.100.1:80", false},
+		{nil, office, "invalid", false},
+		{nil, open, "192.0.2.1:80", true},
+		{nil, open, "198.51.100.1:80", false},
+		{server, office, "203.0.113.1:80", true},
+		{server, office, "192.0.2.66:80", false},
+		{server, open, "192.0.2.66:80", false},
+		{server, office, "192.0.2.1:80", true},
+	}
+
+	for i, tt := range tests {
+		s := &Server{acl: tt.server}
+		if s.allowIP(remoteIP(tt.addr), tt.tunnel) != tt.expected {
+			t.Errorf("[%d] expected %v for %s", i, tt.expected, tt.addr)
+		}
+	}
+}
+
+func TestServer_ACL(t *testing.T) {
+	t.Parallel()
+
+	cert, err := tls.LoadX509KeyPair("./testdata/selfsigned.crt", "./testdata/selfsigned.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(&ServerConfig{
+		Addr:      "127.0.0.1:0",
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.listener.Close()
+
+	identifier := id.New([]byte("client"))
+	s.Subscribe(identifier)
+	if err := s.addTunnels(map[string]*proto.Tunnel{
+		"web": {Protocol: proto.HTTP, Host: "admin.example.com", AllowCIDRs: []string{"192.0.2.0/24"}},
+		"tcp": {Protocol: proto.TCP, Addr: "127.0.0.1:0", DenyCIDRs: []string{"127.0.0.0/8"}},
+	}, identifier); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Unsubscribe(identifier)
+
+	r := httptest.NewRequest(http.MethodGet, "http://admin.example.com/", nil)
+	r.RemoteAddr = "198.51.100.1:1234"
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatal("expected forbidden got", w.Code)
+	}
+	if v := s.Metrics().Get(MetricRequestsDenied).String(); v != "1" {
+		t.Fatal("unexpected metric value", v)
+	}
+
+	// connection may be reset before dial returns
+	if conn, err := net.Dial("tcp", s.registry.items[identifier].Listeners[0].Addr().String()); err == nil {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Fatal("expected connection closed")
+		}
+		conn.Close()
+	}
+	if v := s.Metrics().Get(MetricConnectionsDenied).String(); v != "1" {
+		t.Fatal("unexpected metric value", v)
+	}
+}
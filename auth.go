@@ -4,12 +4,38 @@
 
 package tunnel
 
-import "strings"
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
 
-// Auth holds user and password.
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// Auth holds authentication methods of an HTTP tunnel, a request is
+// authorised if it passes any of them.
 type Auth struct {
+	// User and Password are plain text basic auth credentials.
 	User     string
 	Password string
+	// Users maps user names to bcrypt or argon2id password hashes checked
+	// with basic auth.
+	Users map[string]string
+	// BearerTokens are tokens accepted in "Authorization: Bearer" header.
+	BearerTokens []string
+	// APIKeyHeader is name of the header carrying API key.
+	APIKeyHeader string
+	// APIKeys are accepted values of APIKeyHeader.
+	APIKeys []string
+	// OIDC if not nil allows users logged in with OpenID Connect.
+	OIDC *proto.OIDCAuth
 }
 
 // NewAuth creates new auth from string representation "user:password".
@@ -28,3 +54,206 @@ func NewAuth(auth string) *Auth {
 
 	return a
 }
+
+// NewHTTPAuth creates auth from string representation "user:password" and
+// AuthConfig, it returns nil if no authentication method is specified.
+func NewHTTPAuth(auth string, c *proto.AuthConfig) *Auth {
+	a := NewAuth(auth)
+	if c == nil {
+		return a
+	}
+	if a == nil {
+		a = &Auth{}
+	}
+
+	a.Users = c.Users
+	a.BearerTokens = c.BearerTokens
+	a.APIKeyHeader = c.APIKeyHeader
+	a.APIKeys = c.APIKeys
+	a.OIDC = c.OIDC
+
+	return a
+}
+
+func (a *Auth) basic() bool {
+	return a.User != "" || a.Password != ""
+}
+
+func (a *Auth) validate() error {
+	if a.basic() && a.User == "" {
+		return errors.New("missing auth user")
+	}
+	if !a.basic() && len(a.Users) == 0 && len(a.BearerTokens) == 0 && len(a.APIKeys) == 0 && a.OIDC == nil {
+		return errors.New("missing auth user")
+	}
+	for user, hash := range a.Users {
+		if err := ValidatePasswordHash(hash); err != nil {
+			return fmt.Errorf("user %q: %s", user, err)
+		}
+	}
+	if len(a.APIKeys) != 0 && a.APIKeyHeader == "" {
+		return errors.New("missing API key header")
+	}
+	if o := a.OIDC; o != nil && len(o.Subjects) == 0 && len(o.Emails) == 0 && len(o.Domains) == 0 {
+		return errors.New("oidc: subjects, emails or domains required")
+	}
+	return nil
+}
+
+// authenticate returns true if request passes basic, bearer token or API key
+// authentication. All comparisons are constant time.
+func (a *Auth) authenticate(r *http.Request) bool {
+	if user, password, ok := r.BasicAuth(); ok {
+		if a.basic() && equal(a.User, user)&equal(a.Password, password) == 1 {
+			return true
+		}
+		if hash, ok := a.Users[user]; ok && checkPassword(hash, password) {
+			return true
+		}
+	}
+
+	if token := bearerToken(r); token != "" && anyEqual(a.BearerTokens, token) {
+		return true
+	}
+
+	if a.APIKeyHeader != "" {
+		if key := r.Header.Get(a.APIKeyHeader); key != "" && anyEqual(a.APIKeys, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stripCredentials removes credentials from request header before passing it
+// to the client.
+func (a *Auth) stripCredentials(h http.Header) {
+	h.Del("Authorization")
+	if a.APIKeyHeader != "" {
+		h.Del(a.APIKeyHeader)
+	}
+}
+
+// challenge returns value of WWW-Authenticate header.
+func (a *Auth) challenge() string {
+	if !a.basic() && len(a.Users) == 0 && len(a.BearerTokens) != 0 {
+		return "Bearer realm=\"User Visible Realm\""
+	}
+	return "Basic realm=\"User Visible Realm\""
+}
+
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+	if len(h) < len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return ""
+	}
+	return h[len(prefix):]
+}
+
+// equal compares hashes of a and b in constant time, so that length of a is
+// not revealed.
+func equal(a, b string) int {
+	ha := sha256.Sum256([]byte(a))
+	hb := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:])
+}
+
+// anyEqual returns true if s is in a, it compares s with all values.
+func anyEqual(a []string, s string) bool {
+	v := 0
+	for _, t := range a {
+		v |= equal(t, s)
+	}
+	return v == 1
+}
+
+// Limits of argon2id parameters, hashes are supplied by clients so that cost
+// of checking a password must be bounded.
+const (
+	maxArgon2Memory  = 256 * 1024 // KiB
+	maxArgon2Time    = 16
+	minArgon2SaltLen = 8
+	maxArgon2SaltLen = 64
+	minArgon2KeyLen  = 16
+	maxArgon2KeyLen  = 64
+)
+
+// ValidatePasswordHash returns error if hash is not a bcrypt or argon2id hash
+// or if argon2id parameters are out of bounds.
+func ValidatePasswordHash(hash string) error {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		_, err := parseArgon2id(hash)
+		return err
+	case strings.HasPrefix(hash, "$2"):
+		return nil
+	default:
+		return errors.New("unsupported password hash")
+	}
+}
+
+// checkPassword verifies password against bcrypt or argon2id hash.
+func checkPassword(hash, password string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return checkArgon2id(hash, password)
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+type argon2idHash struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// parseArgon2id parses hash in PHC string format
+// "$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>".
+func parseArgon2id(hash string) (*argon2idHash, error) {
+	p := strings.Split(hash, "$")
+	if len(p) != 6 || p[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return nil, errors.New("malformed argon2id hash")
+	}
+
+	h := &argon2idHash{}
+	if _, err := fmt.Sscanf(p[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, fmt.Errorf("argon2id parameters: %s", err)
+	}
+	if h.time < 1 || h.time > maxArgon2Time {
+		return nil, fmt.Errorf("argon2id t must be between 1 and %d", maxArgon2Time)
+	}
+	if h.threads < 1 {
+		return nil, errors.New("argon2id p must be at least 1")
+	}
+	if h.memory > maxArgon2Memory {
+		return nil, fmt.Errorf("argon2id m must be at most %d", maxArgon2Memory)
+	}
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(p[4]); err != nil {
+		return nil, fmt.Errorf("argon2id salt: %s", err)
+	}
+	if len(h.salt) < minArgon2SaltLen || len(h.salt) > maxArgon2SaltLen {
+		return nil, fmt.Errorf("argon2id salt length must be between %d and %d", minArgon2SaltLen, maxArgon2SaltLen)
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(p[5]); err != nil {
+		return nil, fmt.Errorf("argon2id key: %s", err)
+	}
+	if len(h.key) < minArgon2KeyLen || len(h.key) > maxArgon2KeyLen {
+		return nil, fmt.Errorf("argon2id key length must be between %d and %d", minArgon2KeyLen, maxArgon2KeyLen)
+	}
+
+	return h, nil
+}
+
+// checkArgon2id verifies password against argon2id hash.
+func checkArgon2id(hash, password string) bool {
+	h, err := parseArgon2id(hash)
+	if err != nil {
+		return false
+	}
+	k := argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	return subtle.ConstantTimeCompare(k, h.key) == 1
+}
@@ -5,8 +5,18 @@
 package tunnel
 
 import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
 )
 
 func TestNewAuth(t *testing.T) {
@@ -26,3 +36,121 @@ func TestNewAuth(t *testing.T) {
 		}
 	}
 }
+
+func TestAuth_Authenticate(t *testing.T) {
+	t.Parallel()
+
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("bcrypt"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("saltsaltsaltsalt")
+	argon2Hash := fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("argon2"), salt, 1, 1024, 1, 32)),
+	)
+
+	a := NewHTTPAuth("user:password", &proto.AuthConfig{
+		Users: map[string]string{
+			"bob":   string(bcryptHash),
+			"alice": argon2Hash,
+		},
+		BearerTokens: []string{"token1", "token2"},
+		APIKeyHeader: "X-API-Key",
+		APIKeys:      []string{"key"},
+	})
+	if err := a.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	basic := func(user, password string) func(r *http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(user, password) }
+	}
+	header := func(k, v string) func(r *http.Request) {
+		return func(r *http.Request) { r.Header.Set(k, v) }
+	}
+
+	tests := []struct {
+		set      func(r *http.Request)
+		expected bool
+	}{
+		{func(r *http.Request) {}, false},
+		{basic("user", "password"), true},
+		{basic("user", "passwor"), false},
+		{basic("bob", "bcrypt"), true},
+		{basic("bob", "argon2"), false},
+		{basic("alice", "argon2"), true},
+		{basic("alice", "bcrypt"), false},
+		{basic("eve", ""), false},
+		{header("Authorization", "Bearer token2"), true},
+		{header("Authorization", "bearer token1"), true},
+		{header("Authorization", "Bearer token"), false},
+		{header("X-API-Key", "key"), true},
+		{header("X-API-Key", "token1"), false},
+	}
+
+	for i, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		tt.set(r)
+		if a.authenticate(r) != tt.expected {
+			t.Errorf("[%d] expected %v", i, tt.expected)
+		}
+	}
+
+	h := http.Header{}
+	h.Set("Authorization", "Bearer token1")
+	h.Set("X-API-Key", "key")
+	a.stripCredentials(h)
+	if len(h) != 0 {
+		t.Error("credentials not stripped", h)
+	}
+}
+
+func TestAuth_Validate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		auth  *Auth
+		error string
+	}{
+		{NewAuth(":password"), "missing auth user"},
+		{NewHTTPAuth("", &proto.AuthConfig{}), "missing auth user"},
+		{NewHTTPAuth("", &proto.AuthConfig{Users: map[string]string{"bob": "plain"}}), "unsupported password hash"},
+		{NewHTTPAuth("", &proto.AuthConfig{Users: map[string]string{"bob": argon2Params("m=1024,t=0,p=1")}}), "argon2id t must be"},
+		{NewHTTPAuth("", &proto.AuthConfig{Users: map[string]string{"bob": argon2Params("m=1024,t=1,p=0")}}), "argon2id p must be"},
+		{NewHTTPAuth("", &proto.AuthConfig{Users: map[string]string{"bob": argon2Params("m=4294967295,t=1,p=1")}}), "argon2id m must be"},
+		{NewHTTPAuth("", &proto.AuthConfig{Users: map[string]string{"bob": argon2Params("m=1024,t=1,p=1")}}), ""},
+		{NewHTTPAuth("", &proto.AuthConfig{APIKeys: []string{"key"}}), "missing API key header"},
+		{NewHTTPAuth("", &proto.AuthConfig{OIDC: &proto.OIDCAuth{}}), "subjects, emails or domains required"},
+		{NewHTTPAuth("", &proto.AuthConfig{BearerTokens: []string{"token"}}), ""},
+	}
+
+	for i, tt := range tests {
+		err := tt.auth.validate()
+		if tt.error == "" {
+			if err != nil {
+				t.Errorf("[%d] unexpected error %s", i, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.error) {
+			t.Errorf("[%d] expected error contains %q, got %v", i, tt.error, err)
+		}
+	}
+}
+
+func TestCheckPassword_Argon2idBounds(t *testing.T) {
+	t.Parallel()
+
+	for _, params := range []string{"m=1024,t=0,p=1", "m=1024,t=1,p=0", "m=4294967295,t=1,p=1", "m=1024,t=1000,p=1"} {
+		if checkPassword(argon2Params(params), "password") {
+			t.Errorf("%s: expected rejected", params)
+		}
+	}
+}
+
+func argon2Params(params string) string {
+	salt := base64.RawStdEncoding.EncodeToString([]byte("saltsaltsaltsalt"))
+	key := base64.RawStdEncoding.EncodeToString([]byte("keykeykeykeykeykeykeykeykeykeyke"))
+	return fmt.Sprintf("$argon2id$v=%d$%s$%s$%s", argon2.Version, params, salt, key)
+}
@@ -0,0 +1,186 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// AuthorizationRequest describes a client asking server to open tunnels.
+type AuthorizationRequest struct {
+	// Certificate is the client certificate, it may be nil if client
+	// authenticated by other means.
+	Certificate *x509.Certificate
+	// Identifier is the client identifier.
+	Identifier id.ID
+	// RemoteAddr is the network address of the client.
+	RemoteAddr string
+	// Tunnels are tunnels requested by the client.
+	Tunnels map[string]*proto.Tunnel
+}
+
+// Decision is an Authorizer verdict for a single tunnel.
+type Decision struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Authorizer decides which of the requested tunnels a client may open.
+// Denied tunnels are not opened and the reasons are sent to the client, the
+// client is rejected only if all its tunnels are denied.
+type Authorizer interface {
+	// Authorize returns decisions keyed by tunnel name, tunnels missing in
+	// the result are denied. Error rejects the client.
+	Authorize(req *AuthorizationRequest) (map[string]Decision, error)
+}
+
+// AuthorizerFunc is an adapter allowing use of ordinary functions as
+// Authorizer.
+type AuthorizerFunc func(req *AuthorizationRequest) (map[string]Decision, error)
+
+// Authorize calls f(req).
+func (f AuthorizerFunc) Authorize(req *AuthorizationRequest) (map[string]Decision, error) {
+	return f(req)
+}
+
+// authorize runs authorizer and returns tunnels it allowed and reasons for
+// denied tunnels sorted by tunnel name.
+func authorize(a Authorizer, req *AuthorizationRequest) (map[string]*proto.Tunnel, []string, error) {
+	d, err := a.Authorize(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("authorization failed: %s", err)
+	}
+
+	var (
+		allowed = make(map[string]*proto.Tunnel, len(req.Tunnels))
+		denied  []string
+	)
+	for name, t := range req.Tunnels {
+		v, ok := d[name]
+		if ok && v.Allow {
+			allowed[name] = t
+			continue
+		}
+		reason := v.Reason
+		if reason == "" {
+			reason = "denied"
+		}
+		denied = append(denied, fmt.Sprintf("%s: %s", name, reason))
+	}
+	sort.Strings(denied)
+
+	return allowed, denied, nil
+}
+
+// WebhookAuthorizer delegates authorization decisions to an HTTP endpoint. It
+// POSTs JSON encoded WebhookRequest to URL and expects WebhookResponse in
+// return, any status other than 200 OK rejects the client.
+type WebhookAuthorizer struct {
+	// URL is the webhook endpoint.
+	URL string
+	// Client is the HTTP client used to call the webhook, if nil
+	// http.DefaultClient is used.
+	Client *http.Client
+	// Timeout specifies webhook call timeout, if zero DefaultTimeout is
+	// used.
+	Timeout time.Duration
+}
+
+// WebhookRequest is the body of WebhookAuthorizer request.
+type WebhookRequest struct {
+	ID          string                   `json:"id"`
+	RemoteAddr  string                   `json:"remote_addr"`
+	Certificate *WebhookCertificate      `json:"certificate,omitempty"`
+	Tunnels     map[string]*proto.Tunnel `json:"tunnels"`
+}
+
+// WebhookCertificate holds client certificate details sent to the webhook.
+type WebhookCertificate struct {
+	Subject    string    `json:"subject"`
+	CommonName string    `json:"common_name"`
+	OU         []string  `json:"ou,omitempty"`
+	Serial     string    `json:"serial"`
+	NotAfter   time.Time `json:"not_after"`
+}
+
+// WebhookResponse is the body of WebhookAuthorizer response.
+type WebhookResponse struct {
+	Tunnels map[string]Decision `json:"tunnels"`
+}
+
+// Authorize implements Authorizer.
+func (a *WebhookAuthorizer) Authorize(req *AuthorizationRequest) (map[string]Decision, error) {
+	wr := &WebhookRequest{
+		ID:         req.Identifier.String(),
+		RemoteAddr: req.RemoteAddr,
+		Tunnels:    make(map[string]*proto.Tunnel, len(req.Tunnels)),
+	}
+	for name, t := range req.Tunnels {
+		// do not leak credentials
+		c := *t
+		c.Auth = ""
+		c.HTTPAuth = nil
+		wr.Tunnels[name] = &c
+	}
+	if c := req.Certificate; c != nil {
+		wr.Certificate = &WebhookCertificate{
+			Subject:    c.Subject.String(),
+			CommonName: c.Subject.CommonName,
+			OU:         c.Subject.OrganizationalUnit,
+			Serial:     c.SerialNumber.String(),
+			NotAfter:   c.NotAfter,
+		}
+	}
+
+	b, err := json.Marshal(wr)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := a.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	r, err := http.NewRequest(http.MethodPost, a.URL, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(r.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("webhook status %s", resp.Status)
+	}
+
+	var v WebhookResponse
+	if err := json.NewDecoder(&io.LimitedReader{R: resp.Body, N: 126976}).Decode(&v); err != nil {
+		return nil, fmt.Errorf("webhook response: %s", err)
+	}
+
+	return v.Tunnels, nil
+}
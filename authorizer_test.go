@@ -0,0 +1,164 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+func TestPolicyAuthorizer_Authorize(t *testing.T) {
+	t.Parallel()
+
+	admin := id.New([]byte("admin"))
+	policy := `
+rules:
+  - ou: ci
+    protocols: [http]
+    hosts: ["*.ci.example.com"]
+  - id: ` + admin.String() + `
+    hosts: ["*"]
+    ports: ["22", "8000-8100"]
+`
+	rules, err := parsePolicy([]byte(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &PolicyAuthorizer{rules: rules}
+
+	ci := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName:         "runner",
+			OrganizationalUnit: []string{"ci"},
+		},
+	}
+
+	tests := []struct {
+		cert       *x509.Certificate
+		identifier id.ID
+		tunnel     *proto.Tunnel
+		allow      bool
+	}{
+		{ci, id.New([]byte("ci")), &proto.Tunnel{Protocol: proto.HTTP, Host: "a.ci.example.com"}, true},
+		{ci, id.New([]byte("ci")), &proto.Tunnel{Protocol: proto.HTTP, Host: "a.example.com"}, false},
+		{ci, id.New([]byte("ci")), &proto.Tunnel{Protocol: proto.SNI, Host: "a.ci.example.com"}, false},
+		{ci, id.New([]byte("ci")), &proto.Tunnel{Protocol: proto.TCP, Addr: "0.0.0.0:22"}, false},
+		{nil, admin, &proto.Tunnel{Protocol: proto.TCP, Addr: "0.0.0.0:22"}, true},
+		{nil, admin, &proto.Tunnel{Protocol: proto.TCP, Addr: "0.0.0.0:8050"}, true},
+		{nil, admin, &proto.Tunnel{Protocol: proto.TCP, Addr: "0.0.0.0:8101"}, false},
+		{nil, admin, &proto.Tunnel{Protocol: proto.HTTP, Host: "example.com"}, true},
+		{nil, id.New([]byte("other")), &proto.Tunnel{Protocol: proto.HTTP, Host: "a.ci.example.com"}, false},
+	}
+
+	for i, tt := range tests {
+		d, err := a.Authorize(&AuthorizationRequest{
+			Certificate: tt.cert,
+			Identifier:  tt.identifier,
+			Tunnels:     map[string]*proto.Tunnel{"t": tt.tunnel},
+		})
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if d["t"].Allow != tt.allow {
+			t.Errorf("[%d] expected allow %v got %+v", i, tt.allow, d["t"])
+		}
+	}
+}
+
+func TestParsePolicyError(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		policy string
+		error  string
+	}{
+		{"rules:\n  - id: foo\n", "id"},
+		{"rules:\n  - ports: [\"80-20\"]\n", "invalid port range"},
+		{"rules:\n  - ports: [\"http\"]\n", "invalid port"},
+		{"rules:\n  - hosts: [\"[\"]\n", "pattern"},
+		{"rules:\n  - unknown: x\n", "unknown"},
+	}
+
+	for i, tt := range tests {
+		_, err := parsePolicy([]byte(tt.policy))
+		if err == nil || !strings.Contains(err.Error(), tt.error) {
+			t.Errorf("[%d] expected error contains %q, got %v", i, tt.error, err)
+		}
+	}
+}
+
+func TestWebhookAuthorizer_Authorize(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req WebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		if req.Certificate == nil || req.Certificate.CommonName != "runner" {
+			t.Error("unexpected certificate", req.Certificate)
+		}
+
+		resp := WebhookResponse{Tunnels: make(map[string]Decision)}
+		for name, tunnel := range req.Tunnels {
+			if tunnel.Auth != "" {
+				t.Error("credentials leaked")
+			}
+			if tunnel.Host == "allowed.example.com" {
+				resp.Tunnels[name] = Decision{Allow: true}
+			} else {
+				resp.Tunnels[name] = Decision{Reason: "host not allowed"}
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer s.Close()
+
+	req := &AuthorizationRequest{
+		Certificate: &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "runner"},
+		},
+		Tunnels: map[string]*proto.Tunnel{
+			"a": {Protocol: proto.HTTP, Host: "allowed.example.com", Auth: "user:password"},
+		},
+	}
+
+	a := &WebhookAuthorizer{URL: s.URL}
+	allowed, denied, err := authorize(a, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allowed) != 1 || len(denied) != 0 {
+		t.Fatal("unexpected result", allowed, denied)
+	}
+
+	req.Tunnels["b"] = &proto.Tunnel{Protocol: proto.HTTP, Host: "denied.example.com"}
+	allowed, denied, err = authorize(a, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := allowed["a"]; !ok || len(allowed) != 1 {
+		t.Fatal("unexpected allowed", allowed)
+	}
+	if len(denied) != 1 || denied[0] != "b: host not allowed" {
+		t.Fatal("unexpected denied", denied)
+	}
+
+	a.URL = s.URL + "/%"
+	if _, _, err := authorize(a, req); err == nil {
+		t.Fatal("expected error")
+	}
+}
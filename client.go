@@ -5,6 +5,7 @@
 package tunnel
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -12,25 +13,43 @@ import (
 	"github.com/mmatczuk/go-http-tunnel/keepalive"
 	"net"
 	"net/http"
+	"net/url"
 	"sync"
 	"time"
 
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
 	"golang.org/x/net/http2"
 
 	"github.com/mmatczuk/go-http-tunnel/log"
 	"github.com/mmatczuk/go-http-tunnel/proto"
+	"github.com/mmatczuk/go-http-tunnel/trace"
 )
 
 // ClientConfig is configuration of the Client.
 type ClientConfig struct {
-	// ServerAddr specifies TCP address of the tunnel server.
+	// ServerAddr specifies TCP address of the tunnel server, UDP address
+	// if Transport is TransportQUIC or address of server HTTPS listener if
+	// Transport is TransportWebSocket.
 	ServerAddr string
+	// Transport specifies transport of control connection, TransportTCP,
+	// TransportQUIC or TransportWebSocket. If empty TransportTCP is used.
+	Transport string
+	// WebSocketPath specifies path of server HTTPS listener accepting
+	// control connections with TransportWebSocket. If empty
+	// DefaultWebSocketPath is used.
+	WebSocketPath string
 	// TLSClientConfig specifies the tls configuration to use with
 	// tls.Client.
 	TLSClientConfig *tls.Config
 	// DialTLS specifies an optional dial function that creates a tls
 	// connection to the server. If DialTLS is nil, tls.Dial is used.
 	DialTLS func(network, addr string, config *tls.Config) (net.Conn, error)
+	// ProxyURL specifies an optional function returning URL of proxy used
+	// to reach the server, see ProxyURL and ProxyFromEnvironment. If it
+	// is nil or returns nil URL the server is dialed directly. It's not
+	// used with DialTLS or TransportQUIC.
+	ProxyURL func(addr string) (*url.URL, error)
 	// Backoff specifies backoff policy on server connection retry. If nil
 	// when dial fails it will not be retried.
 	Backoff Backoff
@@ -43,6 +62,12 @@ type ClientConfig struct {
 	Logger log.Logger
 	// Used to configure the tcp keepalive for the client -> server tcp connection
 	KeepAlive *keepalive.KeepAlive
+	// Token is optional bearer token sent to the server in handshake, it
+	// allows authenticating without a client certificate.
+	Token string
+	// Tracer if not nil traces handling of control messages, trace context
+	// is passed to Proxy in control message.
+	Tracer *trace.Tracer
 }
 
 // Client is responsible for creating connection to the server, handling control
@@ -74,6 +99,11 @@ func NewClient(config *ClientConfig) (*Client, error) {
 	if config.Proxy == nil {
 		return nil, errors.New("missing Proxy")
 	}
+	switch config.Transport {
+	case "", TransportTCP, TransportQUIC, TransportWebSocket:
+	default:
+		return nil, fmt.Errorf("unsupported transport %q", config.Transport)
+	}
 
 	logger := config.Logger
 	if logger == nil {
@@ -92,7 +122,8 @@ func NewClient(config *ClientConfig) (*Client, error) {
 // Start connects client to the server, it returns error if there is a
 // connection error, or server cannot open requested tunnels. On connection
 // error a backoff policy is used to reestablish the connection. When connected
-// HTTP/2 server is started to handle ControlMessages.
+// HTTP/2 server, or HTTP/3 server over QUIC, is started to handle
+// ControlMessages.
 func (c *Client) Start() error {
 	c.logger.Log(
 		"level", 1,
@@ -105,9 +136,15 @@ func (c *Client) Start() error {
 			return err
 		}
 
-		c.httpServer.ServeConn(conn, &http2.ServeConnOpts{
-			Handler: http.HandlerFunc(c.serveHTTP),
-		})
+		if qc, ok := conn.(*quicConn); ok {
+			s := &http3.Server{Handler: http.HandlerFunc(c.serveHTTP)}
+			s.ServeQUICConn(qc.conn)
+			conn.Close()
+		} else {
+			c.httpServer.ServeConn(conn, &http2.ServeConnOpts{
+				Handler: http.HandlerFunc(c.serveHTTP),
+			})
+		}
 
 		c.logger.Log(
 			"level", 1,
@@ -157,6 +194,9 @@ func (c *Client) dial() (net.Conn, error) {
 		addr      = c.config.ServerAddr
 		tlsConfig = c.config.TLSClientConfig
 	)
+	if c.config.Transport == TransportQUIC {
+		network = "udp"
+	}
 
 	doDial := func() (conn net.Conn, err error) {
 		c.logger.Log(
@@ -166,21 +206,14 @@ func (c *Client) dial() (net.Conn, error) {
 			"addr", addr,
 		)
 
-		if c.config.DialTLS != nil {
+		if network == "udp" {
+			conn, err = c.dialQUIC(addr, tlsConfig)
+		} else if c.config.Transport == TransportWebSocket {
+			conn, err = c.dialWebSocket(addr, tlsConfig)
+		} else if c.config.DialTLS != nil {
 			conn, err = c.config.DialTLS(network, addr, tlsConfig)
 		} else {
-			d := &net.Dialer{
-				Timeout: DefaultTimeout,
-			}
-			conn, err = d.Dial(network, addr)
-
-			if err == nil {
-				c.logger.Log(
-					"level", 1,
-					"msg", fmt.Sprintf("Setting up keep alive using config: %v", c.config.KeepAlive.String()),
-				)
-				err = c.config.KeepAlive.Set(conn)
-			}
+			conn, err = c.dialTCP(network, addr)
 			if err == nil {
 				conn = tls.Client(conn, tlsConfig)
 			}
@@ -237,11 +270,81 @@ func (c *Client) dial() (net.Conn, error) {
 	}
 }
 
+// dialTCP connects addr directly or through proxy and sets keepalive.
+func (c *Client) dialTCP(network, addr string) (net.Conn, error) {
+	proxyURL, err := c.proxyURL(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	dialAddr := addr
+	if proxyURL != nil {
+		c.logger.Log(
+			"level", 1,
+			"action", "dial proxy",
+			"proxy", proxyURL.Redacted(),
+		)
+		dialAddr = proxyAddr(proxyURL)
+	}
+
+	d := &net.Dialer{
+		Timeout: DefaultTimeout,
+	}
+	conn, err := d.Dial(network, dialAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	c.logger.Log(
+		"level", 1,
+		"msg", fmt.Sprintf("Setting up keep alive using config: %v", c.config.KeepAlive.String()),
+	)
+	if err := c.config.KeepAlive.Set(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if proxyURL == nil {
+		return conn, nil
+	}
+	pconn, err := proxyConnect(conn, proxyURL, addr)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %s", proxyURL.Redacted(), err)
+	}
+	return pconn, nil
+}
+
+func (c *Client) proxyURL(addr string) (*url.URL, error) {
+	if c.config.ProxyURL == nil {
+		return nil, nil
+	}
+	u, err := c.config.ProxyURL(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy: %s", err)
+	}
+	return u, nil
+}
+
+func (c *Client) dialQUIC(addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+
+	conn, err := quic.DialAddr(ctx, addr, quicTLSConfig(tlsConfig), quicConfig())
+	if err != nil {
+		return nil, err
+	}
+	return &quicConn{conn}, nil
+}
+
 func (c *Client) serveHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodConnect {
-		if r.Header.Get(proto.HeaderError) != "" {
+		switch {
+		case r.Header.Get(proto.HeaderError) != "":
 			c.handleHandshakeError(w, r)
-		} else {
+		case r.Header.Get(proto.HeaderWarning) != "":
+			c.handleWarning(w, r)
+		default:
 			c.handleHandshake(w, r)
 		}
 		return
@@ -257,12 +360,43 @@ func (c *Client) serveHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	_, span := c.config.Tracer.Start(
+		trace.ContextWithRemote(r.Context(), parentSpan(msg.Traceparent)),
+		"Client.serveHTTP", trace.KindServer,
+		trace.Attribute{Key: "tunnel.forwarded_host", Value: msg.ForwardedHost},
+		trace.Attribute{Key: "tunnel.forwarded_proto", Value: msg.ForwardedProto},
+	)
+	defer span.End()
+	if span != nil {
+		msg.Traceparent = trace.Traceparent(span.Context())
+	}
+
 	c.logger.Log(
 		"level", 2,
 		"action", "handle",
 		"ctrlMsg", msg,
 	)
 
+	if msg.StreamEncoding != "" {
+		body, err := newStreamDecoder(msg.StreamEncoding, r.Body)
+		if err != nil {
+			c.logger.Log(
+				"level", 0,
+				"msg", "unsupported stream encoding",
+				"ctrlMsg", msg,
+				"err", err,
+			)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = body
+	}
+	if negotiateEncoding([]string{msg.AcceptStreamEncoding}) != "" {
+		cw := &compressWriter{ResponseWriter: w, encoding: msg.AcceptStreamEncoding}
+		defer cw.Close()
+		w = cw
+	}
+
 	switch msg.Action {
 	case proto.ActionProxy:
 		c.config.Proxy(w, r.Body, msg)
@@ -272,7 +406,7 @@ func (c *Client) serveHTTP(w http.ResponseWriter, r *http.Request) {
 			"msg", "unknown action",
 			"ctrlMsg", msg,
 		)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, "unknown action", http.StatusBadRequest)
 	}
 	c.logger.Log(
 		"level", 2,
@@ -282,7 +416,7 @@ func (c *Client) serveHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (c *Client) handleHandshakeError(w http.ResponseWriter, r *http.Request) {
-	err := fmt.Errorf(r.Header.Get(proto.HeaderError))
+	err := errors.New(r.Header.Get(proto.HeaderError))
 
 	c.logger.Log(
 		"level", 1,
@@ -296,6 +430,15 @@ func (c *Client) handleHandshakeError(w http.ResponseWriter, r *http.Request) {
 	c.connMu.Unlock()
 }
 
+func (c *Client) handleWarning(w http.ResponseWriter, r *http.Request) {
+	c.logger.Log(
+		"level", 0,
+		"msg", "server warning",
+		"addr", r.RemoteAddr,
+		"warning", r.Header.Get(proto.HeaderWarning),
+	)
+}
+
 func (c *Client) handleHandshake(w http.ResponseWriter, r *http.Request) {
 	c.logger.Log(
 		"level", 1,
@@ -303,6 +446,9 @@ func (c *Client) handleHandshake(w http.ResponseWriter, r *http.Request) {
 		"addr", r.RemoteAddr,
 	)
 
+	if c.config.Token != "" {
+		w.Header().Set(proto.HeaderToken, c.config.Token)
+	}
 	w.WriteHeader(http.StatusOK)
 
 	b, err := json.Marshal(c.config.Tunnels)
@@ -8,11 +8,15 @@ import (
 	"fmt"
 	"github.com/mmatczuk/go-http-tunnel/keepalive"
 	"io/ioutil"
+	"net/url"
+	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v2"
 
+	"github.com/mmatczuk/go-http-tunnel"
 	"github.com/mmatczuk/go-http-tunnel/proto"
 )
 
@@ -34,22 +38,75 @@ type BackoffConfig struct {
 
 // Tunnel defines a tunnel.
 type Tunnel struct {
-	Protocol   string `yaml:"proto,omitempty"`
-	Addr       string `yaml:"addr,omitempty"`
-	Auth       string `yaml:"auth,omitempty"`
-	Host       string `yaml:"host,omitempty"`
-	RemoteAddr string `yaml:"remote_addr,omitempty"`
+	Protocol   string            `yaml:"proto,omitempty"`
+	Addr       string            `yaml:"addr,omitempty"`
+	Auth       string            `yaml:"auth,omitempty"`
+	HTTPAuth   *proto.AuthConfig `yaml:"http_auth,omitempty"`
+	Host       string            `yaml:"host,omitempty"`
+	RemoteAddr string            `yaml:"remote_addr,omitempty"`
+	AllowCIDRs []string          `yaml:"allow_cidrs,omitempty"`
+	DenyCIDRs  []string          `yaml:"deny_cidrs,omitempty"`
+	// Headers are applied by server, LocalHeaders are applied by client
+	// before and after calling local service.
+	Headers      *proto.HeaderRules `yaml:"headers,omitempty"`
+	LocalHeaders *proto.HeaderRules `yaml:"local_headers,omitempty"`
+	Compression  []string           `yaml:"compression,omitempty"`
+	// Users maps user names to bcrypt or argon2id password hashes of
+	// socks5 and httpconnect tunnels, Destinations limit destinations of
+	// the tunnels.
+	Users        map[string]string   `yaml:"users,omitempty"`
+	Destinations *DestinationsConfig `yaml:"destinations,omitempty"`
+	Forward      *ForwardConfig      `yaml:"forward,omitempty"`
+}
+
+// ForwardConfig tunes forward proxy of httpconnect tunnels.
+type ForwardConfig struct {
+	DialTimeout time.Duration `yaml:"dial_timeout,omitempty"`
+	IdleTimeout time.Duration `yaml:"idle_timeout,omitempty"`
+	// Transport of plain HTTP requests.
+	MaxIdleConns          int           `yaml:"max_idle_conns,omitempty"`
+	MaxIdleConnsPerHost   int           `yaml:"max_idle_conns_per_host,omitempty"`
+	IdleConnTimeout       time.Duration `yaml:"idle_conn_timeout,omitempty"`
+	TLSHandshakeTimeout   time.Duration `yaml:"tls_handshake_timeout,omitempty"`
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout,omitempty"`
+	// Upstream is proxy destinations are connected through.
+	Upstream *UpstreamConfig `yaml:"upstream,omitempty"`
+}
+
+// UpstreamConfig is configuration of proxy httpconnect tunnel connects to
+// destinations through, see tunnel.Upstream for the rule syntax.
+type UpstreamConfig struct {
+	URL   string   `yaml:"url"`
+	Rules []string `yaml:"rules,omitempty"`
+}
+
+// DestinationsConfig specifies destinations proxies may connect to, see
+// tunnel.DestinationACL for the rule syntax.
+type DestinationsConfig struct {
+	Allow []string `yaml:"allow,omitempty"`
+	Deny  []string `yaml:"deny,omitempty"`
+}
+
+// ProxyConfig is configuration of proxy used to reach the server.
+type ProxyConfig struct {
+	URL     string `yaml:"url"`
+	NoProxy string `yaml:"no_proxy,omitempty"`
 }
 
 // ClientConfig is a tunnel client configuration.
 type ClientConfig struct {
 	ServerAddr      string             `yaml:"server_addr"`
+	Transport       string             `yaml:"transport,omitempty"`
+	WebSocketPath   string             `yaml:"websocket_path,omitempty"`
+	Proxy           *ProxyConfig       `yaml:"proxy,omitempty"`
 	TLSCrt          string             `yaml:"tls_crt"`
 	TLSKey          string             `yaml:"tls_key"`
 	RootCA          string             `yaml:"root_ca"`
 	Backoff         BackoffConfig      `yaml:"backoff"`
 	Tunnels         map[string]*Tunnel `yaml:"tunnels"`
 	KeepAliveConfig *keepalive.Config  `yaml:"keep_alive"`
+	Token           string             `yaml:"token,omitempty"`
+	TokenFile       string             `yaml:"token_file,omitempty"`
 }
 
 func loadClientConfigFromFile(file string) (*ClientConfig, error) {
@@ -77,9 +134,44 @@ func loadClientConfigFromFile(file string) (*ClientConfig, error) {
 	if c.ServerAddr == "" {
 		return nil, fmt.Errorf("server_addr: missing")
 	}
+
+	if c.Token != "" && c.TokenFile != "" {
+		return nil, fmt.Errorf("token_file: unexpected with token")
+	}
+	if c.TokenFile != "" {
+		b, err := ioutil.ReadFile(c.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("token_file: %s", err)
+		}
+		c.Token = strings.TrimSpace(string(b))
+	}
+	if c.Token == "" {
+		c.Token = os.Getenv("TUNNEL_TOKEN")
+	}
 	if c.ServerAddr, err = normalizeAddress(c.ServerAddr); err != nil {
 		return nil, fmt.Errorf("server_addr: %s", err)
 	}
+	switch c.Transport {
+	case "", tunnel.TransportTCP, tunnel.TransportQUIC, tunnel.TransportWebSocket:
+	default:
+		return nil, fmt.Errorf("transport: unsupported %q, choose 'tcp', 'quic' or 'websocket'", c.Transport)
+	}
+	if c.WebSocketPath != "" {
+		if c.Transport != tunnel.TransportWebSocket {
+			return nil, fmt.Errorf("websocket_path: unexpected with transport %q", c.Transport)
+		}
+		if !strings.HasPrefix(c.WebSocketPath, "/") {
+			return nil, fmt.Errorf("websocket_path: must start with /")
+		}
+	}
+	if c.Proxy != nil {
+		if c.Transport == tunnel.TransportQUIC {
+			return nil, fmt.Errorf("proxy: unexpected with transport %q", c.Transport)
+		}
+		if err := validateProxy(c.Proxy); err != nil {
+			return nil, fmt.Errorf("proxy %s", err)
+		}
+	}
 
 	for name, t := range c.Tunnels {
 		switch t.Protocol {
@@ -99,6 +191,10 @@ func loadClientConfigFromFile(file string) (*ClientConfig, error) {
 			if err := validateSNI(t); err != nil {
 				return nil, fmt.Errorf("%s %s", name, err)
 			}
+		case proto.SOCKS5:
+			if err := validateSOCKS5(t); err != nil {
+				return nil, fmt.Errorf("%s %s", name, err)
+			}
 		default:
 			return nil, fmt.Errorf("%s invalid protocol %q", name, t.Protocol)
 		}
@@ -107,6 +203,26 @@ func loadClientConfigFromFile(file string) (*ClientConfig, error) {
 	return &c, nil
 }
 
+func validateProxy(p *ProxyConfig) error {
+	if p.URL == "" {
+		return fmt.Errorf("url: missing")
+	}
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return fmt.Errorf("url: %s", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("url: unsupported scheme %q, choose 'http', 'https', 'socks5' or 'socks5h'", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("url: missing host")
+	}
+
+	return nil
+}
+
 func validateHTTP(t *Tunnel) error {
 	var err error
 	if t.Host == "" {
@@ -118,6 +234,12 @@ func validateHTTP(t *Tunnel) error {
 	if t.Addr, err = normalizeURL(t.Addr); err != nil {
 		return fmt.Errorf("addr: %s", err)
 	}
+	if _, err := tunnel.NewHeaderRewriter("", t.Headers); err != nil {
+		return fmt.Errorf("headers: %s", err)
+	}
+	if _, err := tunnel.NewHeaderRewriter("", t.LocalHeaders); err != nil {
+		return fmt.Errorf("local_headers: %s", err)
+	}
 
 	// unexpected
 
@@ -148,6 +270,15 @@ func validateTCP(t *Tunnel) error {
 	if t.Auth != "" {
 		return fmt.Errorf("auth: unexpected")
 	}
+	if t.HTTPAuth != nil {
+		return fmt.Errorf("http_auth: unexpected")
+	}
+	if t.Headers != nil {
+		return fmt.Errorf("headers: unexpected")
+	}
+	if t.LocalHeaders != nil {
+		return fmt.Errorf("local_headers: unexpected")
+	}
 
 	return nil
 }
@@ -157,6 +288,24 @@ func validateHttpConnect(t *Tunnel) error {
 	if t.RemoteAddr, err = normalizeAddress(t.RemoteAddr); err != nil {
 		return fmt.Errorf("remote_addr: %s", err)
 	}
+	if err := validateUsers(t.Users); err != nil {
+		return fmt.Errorf("users: %s", err)
+	}
+	if _, err := destinations(t); err != nil {
+		return fmt.Errorf("destinations: %s", err)
+	}
+	if f := t.Forward; f != nil {
+		if f.DialTimeout < 0 || f.IdleTimeout < 0 || f.IdleConnTimeout < 0 ||
+			f.TLSHandshakeTimeout < 0 || f.ResponseHeaderTimeout < 0 {
+			return fmt.Errorf("forward: negative timeout")
+		}
+		if f.MaxIdleConns < 0 || f.MaxIdleConnsPerHost < 0 {
+			return fmt.Errorf("forward: negative max idle connections")
+		}
+		if _, err := upstream(f); err != nil {
+			return fmt.Errorf("forward: upstream: %s", err)
+		}
+	}
 
 	// unexpected
 	if t.Addr != "" {
@@ -168,10 +317,87 @@ func validateHttpConnect(t *Tunnel) error {
 	if t.Auth != "" {
 		return fmt.Errorf("auth: unexpected")
 	}
+	if t.HTTPAuth != nil {
+		return fmt.Errorf("http_auth: unexpected")
+	}
+	if t.Headers != nil {
+		return fmt.Errorf("headers: unexpected")
+	}
+	if t.LocalHeaders != nil {
+		return fmt.Errorf("local_headers: unexpected")
+	}
+
+	return nil
+}
+
+func validateUsers(users map[string]string) error {
+	for user, hash := range users {
+		if user == "" || hash == "" {
+			return fmt.Errorf("empty user name or password hash")
+		}
+		if err := tunnel.ValidatePasswordHash(hash); err != nil {
+			return fmt.Errorf("user %q: %s", user, err)
+		}
+	}
+	return nil
+}
+
+func validateSOCKS5(t *Tunnel) error {
+	var err error
+	if t.RemoteAddr, err = normalizeAddress(t.RemoteAddr); err != nil {
+		return fmt.Errorf("remote_addr: %s", err)
+	}
+	if err := validateUsers(t.Users); err != nil {
+		return fmt.Errorf("users: %s", err)
+	}
+	if _, err := destinations(t); err != nil {
+		return fmt.Errorf("destinations: %s", err)
+	}
+
+	// unexpected
+	if t.Addr != "" {
+		return fmt.Errorf("addr: unexpected")
+	}
+	if t.Host != "" {
+		return fmt.Errorf("host: unexpected")
+	}
+	if t.Auth != "" {
+		return fmt.Errorf("auth: unexpected")
+	}
+	if t.HTTPAuth != nil {
+		return fmt.Errorf("http_auth: unexpected")
+	}
+	if t.Headers != nil {
+		return fmt.Errorf("headers: unexpected")
+	}
+	if t.LocalHeaders != nil {
+		return fmt.Errorf("local_headers: unexpected")
+	}
 
 	return nil
 }
 
+// upstream returns Upstream of forward proxy, nil if upstream is not
+// configured.
+func upstream(f *ForwardConfig) (*tunnel.Upstream, error) {
+	if f.Upstream == nil {
+		return nil, nil
+	}
+	if f.Upstream.URL == "" {
+		return nil, fmt.Errorf("url: missing")
+	}
+	return tunnel.NewUpstream(f.Upstream.URL, f.Upstream.Rules)
+}
+
+// destinations returns DestinationACL of tunnel, nil if destinations are not
+// configured.
+func destinations(t *Tunnel) (*tunnel.DestinationACL, error) {
+	if t.Destinations == nil {
+		return nil, nil
+	}
+	return tunnel.NewDestinationACL(t.Destinations.Allow, t.Destinations.Deny)
+}
+
 func validateSNI(t *Tunnel) error {
 	var err error
 	if t.Host == "" {
@@ -192,6 +418,15 @@ func validateSNI(t *Tunnel) error {
 	if t.Auth != "" {
 		return fmt.Errorf("auth: unexpected")
 	}
+	if t.HTTPAuth != nil {
+		return fmt.Errorf("http_auth: unexpected")
+	}
+	if t.Headers != nil {
+		return fmt.Errorf("headers: unexpected")
+	}
+	if t.LocalHeaders != nil {
+		return fmt.Errorf("local_headers: unexpected")
+	}
 
 	return nil
 }
@@ -0,0 +1,46 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateUsers(t *testing.T) {
+	t.Parallel()
+
+	const (
+		bcrypt = "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy"
+		argon2 = "$argon2id$v=19$m=65536,t=3,p=4$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+	)
+
+	tests := []struct {
+		users map[string]string
+		error string
+	}{
+		{map[string]string{"bob": bcrypt, "alice": argon2}, ""},
+		{map[string]string{"": bcrypt}, "empty user name"},
+		{map[string]string{"bob": ""}, "empty user name"},
+		{map[string]string{"bob": "password"}, "unsupported password hash"},
+		{map[string]string{"bob": "$argon2i$v=19$m=65536,t=3,p=4$c2FsdA$a2V5"}, "unsupported password hash"},
+		{map[string]string{"bob": strings.Replace(argon2, "t=3", "t=0", 1)}, "argon2id t must be"},
+		{map[string]string{"bob": strings.Replace(argon2, "p=4", "p=0", 1)}, "argon2id p must be"},
+		{map[string]string{"bob": strings.Replace(argon2, "m=65536", "m=4294967295", 1)}, "argon2id m must be"},
+	}
+
+	for i, tt := range tests {
+		err := validateUsers(tt.users)
+		if tt.error == "" {
+			if err != nil {
+				t.Errorf("[%d] unexpected error %s", i, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.error) {
+			t.Errorf("[%d] expected error contains %q, got %v", i, tt.error, err)
+		}
+	}
+}
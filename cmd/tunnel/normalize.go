@@ -35,9 +35,9 @@ func normalizeURL(rawurl string) (string, error) {
 	s := strings.SplitN(rawurl, "://", 2)
 	if len(s) > 1 {
 		switch s[0] {
-		case "http", "https":
+		case "http", "https", "h2c":
 		default:
-			return "", fmt.Errorf("unsupported url schema, choose 'http' or 'https'")
+			return "", fmt.Errorf("unsupported url schema, choose 'http', 'https' or 'h2c'")
 		}
 	} else {
 		rawurl = fmt.Sprint("http://", rawurl)
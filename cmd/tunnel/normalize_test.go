@@ -93,6 +93,10 @@ func TestNormalizeURL(t *testing.T) {
 			rawurl: "https://localhost:443/path",
 			error:  "/",
 		},
+		{
+			rawurl:   "h2c://localhost:50051",
+			expected: "h2c://localhost:50051",
+		},
 		{
 			rawurl: "ftp://localhost",
 			error:  "unsupported url schema",
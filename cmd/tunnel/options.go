@@ -28,6 +28,7 @@ Examples:
 
 config.yaml:
 	server_addr: SERVER_IP:5223
+	token_file: token.jwt          # optional, instead of client certificate
 	tunnels:
 	  webui:
 	    proto: http
@@ -59,24 +60,30 @@ func init() {
 }
 
 type options struct {
-	config   string
-	logLevel int
-	version  bool
-	command  string
-	args     []string
+	config    string
+	logLevel  int
+	logFormat string
+	otlp      string
+	version   bool
+	command   string
+	args      []string
 }
 
 func parseArgs() (*options, error) {
 	config := flag.String("config", "tunnel.yml", "Path to tunnel configuration file")
 	logLevel := flag.Int("log-level", 1, "Level of messages to log, 0-3")
+	logFormat := flag.String("log-format", "text", "Log format, one of text, json or logfmt")
+	otlp := flag.String("otlpEndpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "OpenTelemetry collector OTLP/HTTP endpoint receiving traces of proxied HTTP requests, empty string to disable")
 	version := flag.Bool("version", false, "Prints tunnel version")
 	flag.Parse()
 
 	opts := &options{
-		config:   *config,
-		logLevel: *logLevel,
-		version:  *version,
-		command:  flag.Arg(0),
+		config:    *config,
+		logLevel:  *logLevel,
+		logFormat: *logFormat,
+		otlp:      *otlp,
+		version:   *version,
+		command:   flag.Arg(0),
 	}
 
 	if opts.version {
@@ -20,12 +20,13 @@ import (
 	"github.com/mmatczuk/go-http-tunnel/id"
 	"github.com/mmatczuk/go-http-tunnel/log"
 	"github.com/mmatczuk/go-http-tunnel/proto"
+	"github.com/mmatczuk/go-http-tunnel/trace"
 )
 
 func main() {
 	opts, err := parseArgs()
 	if err != nil {
-		fatal(err.Error())
+		fatal("%s", err)
 	}
 
 	if opts.version {
@@ -33,7 +34,11 @@ func main() {
 		return
 	}
 
-	logger := log.NewFilterLogger(log.NewStdLogger(), opts.logLevel)
+	l, err := log.New(opts.logFormat, os.Stderr)
+	if err != nil {
+		fatal("%s", err)
+	}
+	logger := log.NewFilterLogger(l, opts.logLevel)
 
 	// read configuration file
 	config, err := loadClientConfigFromFile(opts.config)
@@ -88,7 +93,19 @@ func main() {
 		fatal("failed to configure tls: %s", err)
 	}
 
-	b, err := yaml.Marshal(config)
+	dump := *config
+	if dump.Token != "" {
+		dump.Token = "<redacted>"
+	}
+	dump.Tunnels = make(map[string]*Tunnel, len(config.Tunnels))
+	for name, t := range config.Tunnels {
+		c := *t
+		if c.HTTPAuth != nil {
+			c.HTTPAuth = redactAuth(c.HTTPAuth)
+		}
+		dump.Tunnels[name] = &c
+	}
+	b, err := yaml.Marshal(dump)
 	if err != nil {
 		fatal("failed to dump config: %s", err)
 	}
@@ -99,14 +116,35 @@ func main() {
 		fatal("failed to parse KeepAliveConfig: %s", err)
 	}
 
+	var tracer *trace.Tracer
+	if opts.otlp != "" {
+		trace.SetErrorFunc(func(err error) {
+			log.Error(logger, "msg", "trace export failed", "err", err)
+		})
+		tracer, err = trace.NewOTLPTracer(opts.otlp, "tunnel")
+		if err != nil {
+			fatal("failed to create tracer: %s", err)
+		}
+	}
+
+	proxyURL := tunnel.ProxyFromEnvironment
+	if config.Proxy != nil {
+		proxyURL = tunnel.ProxyURL(config.Proxy.URL, config.Proxy.NoProxy)
+	}
+
 	client, err := tunnel.NewClient(&tunnel.ClientConfig{
 		ServerAddr:      config.ServerAddr,
+		Transport:       config.Transport,
+		WebSocketPath:   config.WebSocketPath,
+		ProxyURL:        proxyURL,
 		TLSClientConfig: tlsconf,
 		Backoff:         expBackoff(config.Backoff),
 		Tunnels:         tunnels(config.Tunnels),
-		Proxy:           proxy(config.Tunnels, logger),
+		Proxy:           proxy(config.Tunnels, tracer, logger),
 		Logger:          logger,
 		KeepAlive:       keepAlive,
+		Token:           config.Token,
+		Tracer:          tracer,
 	})
 	if err != nil {
 		fatal("failed to create client: %s", err)
@@ -118,8 +156,12 @@ func main() {
 }
 
 func tlsConfig(config *ClientConfig) (*tls.Config, error) {
+	var certs []tls.Certificate
 	cert, err := tls.LoadX509KeyPair(config.TLSCrt, config.TLSKey)
-	if err != nil {
+	if err == nil {
+		certs = append(certs, cert)
+	} else if config.Token == "" || !os.IsNotExist(err) {
+		// certificate is optional only when authenticating with token
 		return nil, err
 	}
 
@@ -142,7 +184,7 @@ func tlsConfig(config *ClientConfig) (*tls.Config, error) {
 
 	return &tls.Config{
 		ServerName:         host,
-		Certificates:       []tls.Certificate{cert},
+		Certificates:       certs,
 		InsecureSkipVerify: roots == nil,
 		RootCAs:            roots,
 	}, nil
@@ -158,27 +200,48 @@ func expBackoff(c BackoffConfig) *backoff.ExponentialBackOff {
 	return b
 }
 
+// redactAuth returns copy of c with secrets replaced, password hashes are
+// kept.
+func redactAuth(c *proto.AuthConfig) *proto.AuthConfig {
+	r := *c
+	r.BearerTokens = make([]string, len(c.BearerTokens))
+	for i := range r.BearerTokens {
+		r.BearerTokens[i] = "<redacted>"
+	}
+	r.APIKeys = make([]string, len(c.APIKeys))
+	for i := range r.APIKeys {
+		r.APIKeys[i] = "<redacted>"
+	}
+	return &r
+}
+
 func tunnels(m map[string]*Tunnel) map[string]*proto.Tunnel {
 	p := make(map[string]*proto.Tunnel)
 
 	for name, t := range m {
 		p[name] = &proto.Tunnel{
-			Protocol: t.Protocol,
-			Host:     t.Host,
-			Auth:     t.Auth,
-			Addr:     t.RemoteAddr,
+			Protocol:    t.Protocol,
+			Host:        t.Host,
+			Auth:        t.Auth,
+			HTTPAuth:    t.HTTPAuth,
+			Addr:        t.RemoteAddr,
+			AllowCIDRs:  t.AllowCIDRs,
+			DenyCIDRs:   t.DenyCIDRs,
+			Headers:     t.Headers,
+			Compression: t.Compression,
 		}
 	}
 
 	return p
 }
 
-func proxy(m map[string]*Tunnel, logger log.Logger) tunnel.ProxyFunc {
+func proxy(m map[string]*Tunnel, tracer *trace.Tracer, logger log.Logger) tunnel.ProxyFunc {
 	httpURL := make(map[string]*url.URL)
 	tcpAddr := make(map[string]string)
-	forwardAddr := make(map[string]string)
-	for _, t := range m {
-		fmt.Println("Protocol", t.Protocol)
+	forwardConfig := make(map[string]*tunnel.ForwardingConfig)
+	socksConfig := make(map[string]*tunnel.SOCKS5Config)
+	headers := make(map[string]*tunnel.HeaderRewriter)
+	for name, t := range m {
 		switch t.Protocol {
 		case proto.HTTP:
 			u, err := url.Parse(t.Addr)
@@ -186,22 +249,82 @@ func proxy(m map[string]*Tunnel, logger log.Logger) tunnel.ProxyFunc {
 				fatal("invalid tunnel address: %s", err)
 			}
 			httpURL[t.Host] = u
+			if headers[t.Host], err = tunnel.NewHeaderRewriter(name, t.LocalHeaders); err != nil {
+				fatal("invalid tunnel local headers: %s", err)
+			}
 		case proto.TCP, proto.TCP4, proto.TCP6:
 			tcpAddr[t.RemoteAddr] = t.Addr
 		case proto.HTTPCONNECT:
-			forwardAddr[t.RemoteAddr] = t.RemoteAddr
+			acl, err := destinations(t)
+			if err != nil {
+				fatal("invalid tunnel destinations: %s", err)
+			}
+			forwardConfig[t.RemoteAddr] = forwarding(t, acl)
 		case proto.SNI:
 			tcpAddr[t.Host] = t.Addr
+		case proto.SOCKS5:
+			acl, err := destinations(t)
+			if err != nil {
+				fatal("invalid tunnel destinations: %s", err)
+			}
+			socksConfig[t.RemoteAddr] = &tunnel.SOCKS5Config{
+				Users: t.Users,
+				ACL:   acl,
+			}
 		}
 	}
 
+	httpProxy := tunnel.NewMultiHTTPProxy(httpURL, log.NewContext(logger).WithPrefix("proxy", "HTTP"))
+	httpProxy.Tracer = tracer
+	httpProxy.Headers = headers
+
 	return tunnel.Proxy(tunnel.ProxyFuncs{
-		HTTP:        tunnel.NewMultiHTTPProxy(httpURL, log.NewContext(logger).WithPrefix("proxy", "HTTP")).Proxy,
+		HTTP:        httpProxy.Proxy,
 		TCP:         tunnel.NewMultiTCPProxy(tcpAddr, log.NewContext(logger).WithPrefix("proxy", "TCP")).Proxy,
-		HTTPCONNECT: tunnel.NewMultiForwardingProxy(forwardAddr, log.NewContext(logger).WithPrefix("proxy", "FORWAD")).Proxy,
+		HTTPCONNECT: tunnel.NewMultiForwardingProxy(forwardConfig, log.NewContext(logger).WithPrefix("proxy", "FORWARD")).Proxy,
+		SOCKS5:      tunnel.NewMultiSOCKS5Proxy(socksConfig, log.NewContext(logger).WithPrefix("proxy", "SOCKS5")).Proxy,
 	})
 }
 
+// forwarding returns forward proxy configuration of httpconnect tunnel.
+func forwarding(t *Tunnel, acl *tunnel.DestinationACL) *tunnel.ForwardingConfig {
+	c := &tunnel.ForwardingConfig{
+		Users:        t.Users,
+		Destinations: acl,
+	}
+
+	f := t.Forward
+	if f == nil {
+		return c
+	}
+
+	c.DialTimeout = f.DialTimeout
+	c.IdleTimeout = f.IdleTimeout
+
+	var err error
+	if c.Upstream, err = upstream(f); err != nil {
+		fatal("invalid tunnel upstream: %s", err)
+	}
+
+	tr := tunnel.NewForwardingTransport()
+	if f.MaxIdleConns != 0 {
+		tr.MaxIdleConns = f.MaxIdleConns
+	}
+	if f.MaxIdleConnsPerHost != 0 {
+		tr.MaxIdleConnsPerHost = f.MaxIdleConnsPerHost
+	}
+	if f.IdleConnTimeout != 0 {
+		tr.IdleConnTimeout = f.IdleConnTimeout
+	}
+	if f.TLSHandshakeTimeout != 0 {
+		tr.TLSHandshakeTimeout = f.TLSHandshakeTimeout
+	}
+	tr.ResponseHeaderTimeout = f.ResponseHeaderTimeout
+	c.Transport = tr
+
+	return c
+}
+
 func fatal(format string, a ...interface{}) {
 	fmt.Fprintf(os.Stderr, format, a...)
 	fmt.Fprint(os.Stderr, "\n")
@@ -10,5 +10,4 @@ const banner = `
  / / __/ __ \   / /_/ / / /   / / / /_/ /  / __/ / / / __ \/ __ \/ _ \/ /
 / /_/ / /_/ /  / __  / / /   / / / ____/  / /_/ /_/ / / / / / / /  __/ /
 \____/\____/  /_/ /_/ /_/   /_/ /_/       \__/\__,_/_/ /_/_/ /_/\___/_/
-github.com/mmatczuk/go-http-tunnel
-`
+github.com/mmatczuk/go-http-tunnel`
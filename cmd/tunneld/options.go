@@ -7,8 +7,11 @@ package main
 import (
 	"flag"
 	"fmt"
-	"github.com/mmatczuk/go-http-tunnel/keepalive"
 	"os"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel"
+	"github.com/mmatczuk/go-http-tunnel/keepalive"
 )
 
 const usage1 string = `Usage: tunneld [OPTIONS]
@@ -21,6 +24,59 @@ Example:
 	tunneld -clients YMBKT3V-ESUTZ2Z-7MRILIJ-T35FHGO-D2DHO7D-FXMGSSR-V4LBSZX-BNDONQ4
 	tunneld -httpAddr :8080 -httpsAddr ""
 	tunneld -httpsAddr "" -sniAddr ":443" -rootCA client_root.crt -tlsCrt server.crt -tlsKey server.key
+	tunneld -httpsAddr :443 -http3Addr :443
+	tunneld -quicAddr :5223
+	tunneld -httpsAddr :443 -wsPath /_tunnel -wsHost tunnel.example.com
+	tunneld -rootCA client_root.crt -crl client_root.crl -denyList denied.txt -adminAddr 127.0.0.1:8081
+	tunneld -authPolicy policy.yml
+	tunneld -denyCIDRs 198.51.100.0/24,2001:db8::/32
+	tunneld -limits limits.yml
+	tunneld -usageFile usage.json -quotas quotas.yml -adminAddr 127.0.0.1:8081
+	tunneld -accessLog access.log -accessLogFormat json
+	tunneld -tokenJWKS jwks.json -tokenIssuer https://ci.example.com -tokenAudience tunneld
+	TUNNELD_OIDC_CLIENT_SECRET=secret tunneld -oidcIssuer https://accounts.google.com -oidcClientID tunneld -httpAuth http_auth.yml
+
+policy.yml:
+	rules:
+	  - ou: ci
+	    protocols: [http]
+	    hosts: ["*.ci.my-tunnel-host.com"]
+	  - id: YMBKT3V-ESUTZ2Z-7MRILIJ-T35FHGO-D2DHO7D-FXMGSSR-V4LBSZX-BNDONQ4
+	    ports: ["22", "8000-8100"]
+
+http_auth.yml:
+	"*.internal.my-tunnel-host.com":
+	  oidc:
+	    domains: [example.com]
+	"api.my-tunnel-host.com":
+	  users:
+	    ci: $2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy
+	  bearer_tokens: [s3cr3t]
+
+limits.yml:
+	client:
+	  requests_per_second: 100
+	  concurrent_streams: 250
+	  bytes_per_second: 10485760
+	tunnel:
+	  requests_per_second: 20
+	  requests_burst: 50
+	  connections_per_second: 5
+
+quotas.yml:
+	default:
+	  bytes: 107374182400
+	  throttle:
+	    bytes_per_second: 65536
+	clients:
+	  YMBKT3V-ESUTZ2Z-7MRILIJ-T35FHGO-D2DHO7D-FXMGSSR-V4LBSZX-BNDONQ4:
+	    bytes: 1099511627776
+	    requests: 10000000
+
+Signals:
+	SIGHUP reloads -crl, -denyList, -authPolicy and -tokenJWKS files and disconnects revoked clients
+	SIGUSR1 reopens -accessLog file
+	SIGINT and SIGTERM stop the server and save -usageFile
 
 Author:
 	Written by M. Matczuk (mmatczuk@gmail.com)
@@ -41,46 +97,151 @@ func init() {
 type options struct {
 	httpAddr    string
 	httpsAddr   string
+	http3Addr   string
 	tunnelAddr  string
+	quicAddr    string
+	wsPath      string
+	wsHost      string
 	sniAddr     string
 	tlsCrt      string
 	tlsKey      string
 	rootCA      string
 	clients     string
 	logLevel    int
+	logFormat   string
 	version     bool
 	keepAlive   *keepalive.Config
 	hlthChkAddr string
+	crl         string
+	denyList    string
+	certExpiry  time.Duration
+	adminAddr   string
+	authPolicy  string
+	authWebhook string
+	tokenJWKS   string
+	tokenIss    string
+	tokenAud    string
+	tokenMaxAge time.Duration
+	httpAuth    string
+	oidcIss     string
+	oidcID      string
+	oidcCookie  string
+	allowCIDRs  string
+	denyCIDRs   string
+	limits      string
+	usageFile   string
+	usageSave   time.Duration
+	quotas      string
+	accessLog   string
+	accessFmt   string
+	accessSize  int64
+	accessKeep  int
+	otlp        string
+	eventHook   string
+	eventSecret string
+	eventTypes  string
+	errorPages  string
+	maintenance string
 }
 
 func parseArgs() *options {
 
 	httpAddr := flag.String("httpAddr", ":80", "Public address for HTTP connections, empty string to disable")
 	httpsAddr := flag.String("httpsAddr", ":443", "Public address listening for HTTPS connections, empty string to disable")
+	http3Addr := flag.String("http3Addr", "", "Public UDP address listening for HTTP/3 connections advertised by HTTPS listener with Alt-Svc, empty string to disable")
 	tunnelAddr := flag.String("tunnelAddr", ":5223", "Public address listening for tunnel client")
+	quicAddr := flag.String("quicAddr", "", "Public UDP address listening for tunnel clients connecting over QUIC, empty string to disable")
+	wsPath := flag.String("wsPath", "", "Path of HTTPS listener accepting tunnel clients connecting over WebSocket on -wsHost, empty string to disable")
+	wsHost := flag.String("wsHost", "", "Host name of the server used by tunnel clients connecting over WebSocket, HTTPS listener requests client certificates only in TLS handshakes with this name")
 	sniAddr := flag.String("sniAddr", "", "Public address listening for TLS SNI connections, empty string to disable")
 	tlsCrt := flag.String("tlsCrt", "server.crt", "Path to a TLS certificate file")
 	tlsKey := flag.String("tlsKey", "server.key", "Path to a TLS key file")
 	rootCA := flag.String("rootCA", "", "Path to the trusted certificate chain used for client certificate authentication, if empty any client certificate is accepted")
 	clients := flag.String("clients", "", "Comma-separated list of tunnel client ids, if empty accept all clients")
 	logLevel := flag.Int("log-level", 1, "Level of messages to log, 0-3")
+	logFormat := flag.String("log-format", "text", "Log format, one of text, json or logfmt")
 	version := flag.Bool("version", false, "Prints tunneld version")
 	keepAlive := keepalive.AddKeepAliveFlag()
 	hlthChkAddr := flag.String("hlthChkAddr", "", "Public address to use for health check probes, if empty no health check listener will be started.")
+	crl := flag.String("crl", "", "Path to a certificate revocation list signed by -rootCA used to reject revoked client certificates, reloaded on SIGHUP")
+	denyList := flag.String("denyList", "", "Path to a file with denied client ids and certificate serial numbers, reloaded on SIGHUP")
+	certExpiry := flag.Duration("certExpiryWarning", tunnel.DefaultCertExpiryWarning, "Warn about client certificates expiring within this duration")
+	adminAddr := flag.String("adminAddr", "", "Address of the admin HTTP API serving metrics at /debug/vars, empty string to disable")
+	authPolicy := flag.String("authPolicy", "", "Path to a YAML policy file with rules deciding which tunnels clients may open, reloaded on SIGHUP")
+	authWebhook := flag.String("authWebhook", "", "URL of a webhook deciding which tunnels clients may open")
+	tokenJWKS := flag.String("tokenJWKS", "", "Path to a JSON Web Key Set used to verify client tokens, if set clients may authenticate with a token instead of a certificate")
+	tokenIss := flag.String("tokenIssuer", "", "Required issuer of client tokens")
+	tokenAud := flag.String("tokenAudience", "", "Required audience of client tokens")
+	tokenMaxAge := flag.Duration("tokenMaxLifetime", tunnel.DefaultTokenMaxLifetime, "Maximal lifetime of client tokens, tokens must have an exp claim no further than that from iat")
+	httpAuth := flag.String("httpAuth", "", "Path to a YAML file mapping host patterns to authentication of HTTP tunnels, overrides auth requested by clients")
+	oidcIss := flag.String("oidcIssuer", "", "OpenID Connect issuer URL used by tunnels with oidc auth, client secret is read from TUNNELD_OIDC_CLIENT_SECRET")
+	oidcID := flag.String("oidcClientID", "", "OpenID Connect client id")
+	oidcCookie := flag.String("oidcCookieSecretFile", "", "Path to a file with key signing OpenID Connect session cookies, if empty sessions do not survive restarts")
+	allowCIDRs := flag.String("allowCIDRs", "", "Comma-separated list of networks allowed to access all tunnels regardless of tunnel lists")
+	denyCIDRs := flag.String("denyCIDRs", "", "Comma-separated list of networks denied access to all tunnels")
+	limits := flag.String("limits", "", "Path to a YAML file with rate limits of clients and tunnels")
+	usageFile := flag.String("usageFile", "", "Path to a file accounting usage of clients, usage is served by the admin API at /usage")
+	usageSave := flag.Duration("usageSaveInterval", time.Minute, "How often usage is saved to -usageFile")
+	quotas := flag.String("quotas", "", "Path to a YAML file with monthly quotas of clients")
+	accessLog := flag.String("accessLog", "", "Path to HTTP request and TCP connection log file, reopened on SIGUSR1")
+	accessFmt := flag.String("accessLogFormat", tunnel.AccessLogCombined, "Access log format, combined or json")
+	accessSize := flag.Int64("accessLogMaxSize", 100<<20, "Access log file size in bytes that triggers rotation, 0 disables rotation")
+	accessKeep := flag.Int("accessLogMaxBackups", 5, "Number of rotated access log files to keep")
+	otlp := flag.String("otlpEndpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "OpenTelemetry collector OTLP/HTTP endpoint receiving traces of proxied HTTP requests, empty string to disable")
+	eventHook := flag.String("eventWebhook", "", "URL of a webhook receiving client and tunnel events")
+	eventSecret := flag.String("eventWebhookSecretFile", "", "Path to a file with key signing event webhook requests")
+	eventTypes := flag.String("eventWebhookEvents", "", "Comma-separated list of event types sent to -eventWebhook, if empty all events are sent")
+	errorPages := flag.String("errorPages", "", "Path to a YAML file with error page templates of status codes and classes per host")
+	maintenance := flag.String("maintenance", "", "Path to a file listing host patterns in maintenance, one per line, reloaded on SIGHUP")
 	flag.Parse()
 
 	return &options{
 		httpAddr:    *httpAddr,
 		httpsAddr:   *httpsAddr,
+		http3Addr:   *http3Addr,
 		tunnelAddr:  *tunnelAddr,
+		quicAddr:    *quicAddr,
+		wsPath:      *wsPath,
+		wsHost:      *wsHost,
 		sniAddr:     *sniAddr,
 		tlsCrt:      *tlsCrt,
 		tlsKey:      *tlsKey,
 		rootCA:      *rootCA,
 		clients:     *clients,
 		logLevel:    *logLevel,
+		logFormat:   *logFormat,
 		version:     *version,
 		keepAlive:   keepAlive,
 		hlthChkAddr: *hlthChkAddr,
+		crl:         *crl,
+		denyList:    *denyList,
+		certExpiry:  *certExpiry,
+		adminAddr:   *adminAddr,
+		authPolicy:  *authPolicy,
+		authWebhook: *authWebhook,
+		tokenJWKS:   *tokenJWKS,
+		tokenIss:    *tokenIss,
+		tokenAud:    *tokenAud,
+		tokenMaxAge: *tokenMaxAge,
+		httpAuth:    *httpAuth,
+		oidcIss:     *oidcIss,
+		oidcID:      *oidcID,
+		oidcCookie:  *oidcCookie,
+		allowCIDRs:  *allowCIDRs,
+		denyCIDRs:   *denyCIDRs,
+		limits:      *limits,
+		usageFile:   *usageFile,
+		usageSave:   *usageSave,
+		quotas:      *quotas,
+		accessLog:   *accessLog,
+		accessFmt:   *accessFmt,
+		accessSize:  *accessSize,
+		accessKeep:  *accessKeep,
+		otlp:        *otlp,
+		eventHook:   *eventHook,
+		eventSecret: *eventSecret,
+		eventTypes:  *eventTypes,
+		errorPages:  *errorPages,
+		maintenance: *maintenance,
 	}
 }
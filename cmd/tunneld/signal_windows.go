@@ -0,0 +1,12 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+)
+
+// notifyReopen does nothing, there is no SIGUSR1 on windows.
+func notifyReopen(c chan<- os.Signal) {}
@@ -5,18 +5,31 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
+	"expvar"
 	"fmt"
-	"golang.org/x/net/http2"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path"
 	"strings"
+	"syscall"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"gopkg.in/yaml.v2"
 
 	"github.com/mmatczuk/go-http-tunnel"
 	"github.com/mmatczuk/go-http-tunnel/id"
 	"github.com/mmatczuk/go-http-tunnel/log"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+	"github.com/mmatczuk/go-http-tunnel/trace"
 )
 
 func main() {
@@ -29,13 +42,21 @@ func main() {
 
 	fmt.Println(banner)
 
-	logger := log.NewFilterLogger(log.NewStdLogger(), opts.logLevel)
+	l, err := log.New(opts.logFormat, os.Stderr)
+	if err != nil {
+		fatal("%s", err)
+	}
+	logger := log.NewFilterLogger(l, opts.logLevel)
 
 	tlsconf, err := tlsConfig(opts)
 	if err != nil {
 		fatal("failed to configure tls: %s", err)
 	}
 
+	if opts.wsPath != "" && opts.wsHost == "" {
+		fatal("wsPath requires wsHost")
+	}
+
 	autoSubscribe := opts.clients == ""
 
 	keepAlive, err := opts.keepAlive.Parse()
@@ -43,20 +64,230 @@ func main() {
 		fatal("failed to parse KeepAliveConfig: %s", err)
 	}
 
+	var (
+		authorizer tunnel.Authorizer
+		policy     *tunnel.PolicyAuthorizer
+	)
+	switch {
+	case opts.authPolicy != "" && opts.authWebhook != "":
+		fatal("authPolicy and authWebhook are mutually exclusive")
+	case opts.authPolicy != "":
+		policy, err = tunnel.NewPolicyAuthorizer(opts.authPolicy)
+		if err != nil {
+			fatal("failed to load auth policy: %s", err)
+		}
+		authorizer = policy
+	case opts.authWebhook != "":
+		authorizer = &tunnel.WebhookAuthorizer{
+			URL: opts.authWebhook,
+		}
+	}
+
+	var tokenAuth *tunnel.TokenAuth
+	if opts.tokenJWKS != "" {
+		tokenAuth, err = tunnel.NewTokenAuth(opts.tokenJWKS, opts.tokenIss, opts.tokenAud)
+		if err != nil {
+			fatal("failed to load token key set: %s", err)
+		}
+		tokenAuth.MaxLifetime = opts.tokenMaxAge
+	}
+
+	var httpAuth map[string]*proto.AuthConfig
+	if opts.httpAuth != "" {
+		httpAuth, err = loadHTTPAuth(opts.httpAuth)
+		if err != nil {
+			fatal("failed to load http auth: %s", err)
+		}
+	}
+
+	var oidc *tunnel.OIDCConfig
+	if opts.oidcIss != "" {
+		oidc = &tunnel.OIDCConfig{
+			Issuer:       opts.oidcIss,
+			ClientID:     opts.oidcID,
+			ClientSecret: os.Getenv("TUNNELD_OIDC_CLIENT_SECRET"),
+		}
+		if opts.oidcCookie != "" {
+			b, err := ioutil.ReadFile(opts.oidcCookie)
+			if err != nil {
+				fatal("failed to read oidc cookie secret: %s", err)
+			}
+			oidc.CookieSecret = bytes.TrimSpace(b)
+		}
+	}
+
+	var limits struct {
+		Client *tunnel.Limits `yaml:"client"`
+		Tunnel *tunnel.Limits `yaml:"tunnel"`
+	}
+	if opts.limits != "" {
+		if err := loadYAML(opts.limits, &limits); err != nil {
+			fatal("failed to load limits: %s", err)
+		}
+	}
+
+	var ledger *tunnel.Ledger
+	if opts.usageFile != "" || opts.quotas != "" {
+		var quotas struct {
+			Default *tunnel.Quota            `yaml:"default"`
+			Clients map[string]*tunnel.Quota `yaml:"clients"`
+		}
+		if opts.quotas != "" {
+			if err := loadYAML(opts.quotas, &quotas); err != nil {
+				fatal("failed to load quotas: %s", err)
+			}
+		}
+		m := make(map[id.ID]*tunnel.Quota, len(quotas.Clients))
+		for c, q := range quotas.Clients {
+			var identifier id.ID
+			if err := identifier.UnmarshalText([]byte(c)); err != nil {
+				fatal("invalid identifier %q: %s", c, err)
+			}
+			m[identifier] = q
+		}
+
+		ledger, err = tunnel.NewLedger(opts.usageFile, quotas.Default, m)
+		if err != nil {
+			fatal("failed to load usage: %s", err)
+		}
+		go func() {
+			for range time.Tick(opts.usageSave) {
+				if err := ledger.Save(); err != nil {
+					logger.Log(
+						"level", 0,
+						"msg", "usage save failed",
+						"err", err,
+					)
+				}
+			}
+		}()
+	}
+
+	var (
+		accessLog     tunnel.AccessLogger
+		accessLogFile *log.RotatingFile
+	)
+	if opts.accessLog != "" {
+		accessLogFile, err = log.OpenRotatingFile(opts.accessLog, opts.accessSize, opts.accessKeep)
+		if err != nil {
+			fatal("failed to open access log: %s", err)
+		}
+		accessLog, err = tunnel.NewAccessLog(accessLogFile, opts.accessFmt)
+		if err != nil {
+			fatal("failed to create access log: %s", err)
+		}
+
+		go func() {
+			c := make(chan os.Signal, 1)
+			notifyReopen(c)
+			for range c {
+				if err := accessLogFile.Reopen(); err != nil {
+					logger.Log(
+						"level", 0,
+						"msg", "access log reopen failed",
+						"err", err,
+					)
+				}
+			}
+		}()
+	}
+
+	var tracer *trace.Tracer
+	if opts.otlp != "" {
+		trace.SetErrorFunc(func(err error) {
+			log.Error(logger, "msg", "trace export failed", "err", err)
+		})
+		tracer, err = trace.NewOTLPTracer(opts.otlp, "tunneld")
+		if err != nil {
+			fatal("failed to create tracer: %s", err)
+		}
+	}
+
+	var errorPages *tunnel.ErrorPages
+	if opts.errorPages != "" {
+		var c tunnel.ErrorPagesConfig
+		if err := loadYAML(opts.errorPages, &c); err != nil {
+			fatal("failed to load error pages: %s", err)
+		}
+		if errorPages, err = tunnel.NewErrorPages(&c); err != nil {
+			fatal("failed to load error pages: %s", err)
+		}
+	}
+
+	var maintenance []string
+	if opts.maintenance != "" {
+		if maintenance, err = loadMaintenance(opts.maintenance); err != nil {
+			fatal("failed to load maintenance hosts: %s", err)
+		}
+	}
+
+	var crlIssuers []*x509.Certificate
+	if opts.crl != "" {
+		if opts.rootCA == "" {
+			fatal("crl requires rootCA")
+		}
+		if crlIssuers, err = loadCertificates(opts.rootCA); err != nil {
+			fatal("failed to load CRL issuers: %s", err)
+		}
+	}
+
 	// setup server
 	server, err := tunnel.NewServer(&tunnel.ServerConfig{
-		Addr:            opts.tunnelAddr,
-		SNIAddr:         opts.sniAddr,
-		AutoSubscribe:   autoSubscribe,
-		TLSConfig:       tlsconf,
-		Logger:          logger,
-		KeepAlive:       keepAlive,
-		HealthCheckAddr: opts.hlthChkAddr,
+		Addr:              opts.tunnelAddr,
+		QUICAddr:          opts.quicAddr,
+		SNIAddr:           opts.sniAddr,
+		AutoSubscribe:     autoSubscribe,
+		TLSConfig:         tlsconf,
+		Logger:            logger,
+		KeepAlive:         keepAlive,
+		HealthCheckAddr:   opts.hlthChkAddr,
+		CRLFile:           opts.crl,
+		CRLIssuers:        crlIssuers,
+		DenyListFile:      opts.denyList,
+		CertExpiryWarning: opts.certExpiry,
+		Authorizer:        authorizer,
+		TokenAuth:         tokenAuth,
+		AuthOverrides:     httpAuth,
+		OIDC:              oidc,
+		AllowCIDRs:        splitList(opts.allowCIDRs),
+		DenyCIDRs:         splitList(opts.denyCIDRs),
+		ClientLimits:      limits.Client,
+		TunnelLimits:      limits.Tunnel,
+		Ledger:            ledger,
+		AccessLog:         accessLog,
+		Tracer:            tracer,
+		ErrorPages:        errorPages,
+		Maintenance:       maintenance,
 	})
 	if err != nil {
 		fatal("failed to create server: %s", err)
 	}
 
+	if opts.eventHook != "" {
+		webhook := &tunnel.EventWebhook{
+			URL:    opts.eventHook,
+			Logger: logger,
+		}
+		if opts.eventSecret != "" {
+			b, err := ioutil.ReadFile(opts.eventSecret)
+			if err != nil {
+				fatal("failed to read event webhook secret: %s", err)
+			}
+			webhook.Secret = bytes.TrimSpace(b)
+		}
+		for _, t := range splitList(opts.eventTypes) {
+			switch v := tunnel.EventType(t); v {
+			case tunnel.EventClientConnected, tunnel.EventClientDisconnected, tunnel.EventClientRejected,
+				tunnel.EventTunnelOpened, tunnel.EventTunnelClosed:
+				webhook.Types = append(webhook.Types, v)
+			default:
+				fatal("unknown event type %q", t)
+			}
+		}
+		events, _ := server.SubscribeEvents(1024)
+		go webhook.Run(events)
+	}
+
 	if !autoSubscribe {
 		for _, c := range strings.Split(opts.clients, ",") {
 			if c == "" {
@@ -71,6 +302,73 @@ func main() {
 		}
 	}
 
+	// reload revocation and auth policy on SIGHUP
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGHUP)
+		for range c {
+			if err := server.ReloadRevocation(); err != nil {
+				logger.Log(
+					"level", 0,
+					"msg", "revocation reload failed",
+					"err", err,
+				)
+			}
+			if tokenAuth != nil {
+				if err := tokenAuth.Reload(); err != nil {
+					logger.Log(
+						"level", 0,
+						"msg", "token key set reload failed",
+						"err", err,
+					)
+				}
+			}
+			if policy != nil {
+				if err := policy.Reload(); err != nil {
+					logger.Log(
+						"level", 0,
+						"msg", "auth policy reload failed",
+						"err", err,
+					)
+				}
+			}
+			if opts.maintenance != "" {
+				m, err := loadMaintenance(opts.maintenance)
+				if err == nil {
+					err = server.SetMaintenance(m)
+				}
+				if err != nil {
+					logger.Log(
+						"level", 0,
+						"msg", "maintenance hosts reload failed",
+						"err", err,
+					)
+				}
+			}
+		}
+	}()
+
+	// start admin API
+	if opts.adminAddr != "" {
+		expvar.Publish("tunnel", server.Metrics())
+
+		go func() {
+			logger.Log(
+				"level", 1,
+				"action", "start admin",
+				"addr", opts.adminAddr,
+			)
+
+			mux := http.NewServeMux()
+			mux.Handle("/debug/vars", expvar.Handler())
+			if ledger != nil {
+				mux.Handle("/usage", ledger)
+			}
+
+			fatal("failed to start admin API: %s", http.ListenAndServe(opts.adminAddr, mux))
+		}()
+	}
+
 	// start HTTP
 	if opts.httpAddr != "" {
 		go func() {
@@ -84,6 +382,35 @@ func main() {
 		}()
 	}
 
+	// HTTPS and HTTP/3 share certificate
+	var httpsConf *tls.Config
+	if opts.httpsAddr != "" || opts.http3Addr != "" {
+		httpsConf, err = httpsTLSConfig(opts)
+		if err != nil {
+			fatal("failed to configure https tls: %s", err)
+		}
+	}
+
+	// start HTTP/3
+	var h3 *http3.Server
+	if opts.http3Addr != "" {
+		h3 = &http3.Server{
+			Addr:      opts.http3Addr,
+			Handler:   server,
+			TLSConfig: http3.ConfigureTLSConfig(httpsConf),
+		}
+
+		go func() {
+			logger.Log(
+				"level", 1,
+				"action", "start http3",
+				"addr", opts.http3Addr,
+			)
+
+			fatal("failed to start HTTP/3: %s", h3.ListenAndServe())
+		}()
+	}
+
 	// start HTTPS
 	if opts.httpsAddr != "" {
 		go func() {
@@ -93,17 +420,42 @@ func main() {
 				"addr", opts.httpsAddr,
 			)
 
+			var handler http.Handler = server
+			conf := httpsConf
+			if opts.wsPath != "" {
+				handler = controlPath(opts.wsHost, opts.wsPath, server, handler)
+				conf = controlTLSConfig(httpsConf, opts.wsHost, tlsconf)
+			}
+			if h3 != nil {
+				handler = altSvc(h3, handler)
+			}
 			s := &http.Server{
-				Addr:    opts.httpsAddr,
-				Handler: server,
+				Addr:      opts.httpsAddr,
+				Handler:   handler,
+				TLSConfig: conf,
 			}
 			http2.ConfigureServer(s, nil)
 
-			fatal("failed to start HTTPS: %s", s.ListenAndServeTLS(opts.tlsCrt, opts.tlsKey))
+			fatal("failed to start HTTPS: %s", s.ListenAndServeTLS("", ""))
 		}()
 	}
 
+	// stop on SIGINT and SIGTERM
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		<-c
+		server.Stop()
+	}()
+
 	server.Start()
+
+	tracer.Close()
+	if ledger != nil {
+		if err := ledger.Save(); err != nil {
+			fatal("failed to save usage: %s", err)
+		}
+	}
 }
 
 func tlsConfig(opts *options) (*tls.Config, error) {
@@ -115,19 +467,23 @@ func tlsConfig(opts *options) (*tls.Config, error) {
 
 	// load root CA for client authentication
 	clientAuth := tls.RequireAnyClientCert
-	var roots *x509.CertPool
-	if opts.rootCA != "" {
-		roots = x509.NewCertPool()
-		rootPEM, err := ioutil.ReadFile(opts.rootCA)
-		if err != nil {
-			return nil, err
-		}
-		if ok := roots.AppendCertsFromPEM(rootPEM); !ok {
-			return nil, err
-		}
+	roots, err := loadRootCA(opts.rootCA)
+	if err != nil {
+		return nil, err
+	}
+	if roots != nil {
 		clientAuth = tls.RequireAndVerifyClientCert
 	}
 
+	// token authenticated clients connect without certificate
+	if opts.tokenJWKS != "" {
+		if roots != nil {
+			clientAuth = tls.VerifyClientCertIfGiven
+		} else {
+			clientAuth = tls.RequestClientCert
+		}
+	}
+
 	return &tls.Config{
 		Certificates:           []tls.Certificate{cert},
 		ClientAuth:             clientAuth,
@@ -142,6 +498,160 @@ func tlsConfig(opts *options) (*tls.Config, error) {
 	}, nil
 }
 
+// httpsTLSConfig returns TLS configuration of public HTTPS and HTTP/3
+// listeners.
+func httpsTLSConfig(opts *options) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(opts.tlsCrt, opts.tlsKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}, nil
+}
+
+// controlTLSConfig returns TLS configuration of HTTPS listener accepting
+// control connections over WebSocket. Handshakes with server name host
+// authenticate clients the same way as the tunnel listener configured by
+// control, other handshakes use c so users of HTTPS tunnels are not asked
+// for certificates.
+func controlTLSConfig(c *tls.Config, host string, control *tls.Config) *tls.Config {
+	ws := c.Clone()
+	ws.ClientAuth = control.ClientAuth
+	ws.ClientCAs = control.ClientCAs
+	ws.NextProtos = []string{"h2", "http/1.1"}
+
+	c = c.Clone()
+	c.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if strings.EqualFold(hello.ServerName, host) {
+			return ws, nil
+		}
+		return nil, nil
+	}
+	return c
+}
+
+func loadRootCA(file string) (*x509.CertPool, error) {
+	if file == "" {
+		return nil, nil
+	}
+	rootPEM, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if ok := roots.AppendCertsFromPEM(rootPEM); !ok {
+		return nil, fmt.Errorf("no certificates found in %q", file)
+	}
+	return roots, nil
+}
+
+// loadCertificates reads PEM encoded certificates from file.
+func loadCertificates(file string) ([]*x509.Certificate, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var p *pem.Block
+		p, b = pem.Decode(b)
+		if p == nil {
+			break
+		}
+		if p.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(p.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in %q", file)
+	}
+	return certs, nil
+}
+
+// controlPath serves control connections upgraded to WebSocket on path of
+// host, other requests including requests to tunnels on the same path are
+// served by h.
+func controlPath(host, path string, server *tunnel.Server, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.Host
+		if hostname, _, err := net.SplitHostPort(r.Host); err == nil {
+			name = hostname
+		}
+		if r.URL.Path == path && strings.EqualFold(name, host) {
+			server.ServeWebSocket(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// altSvc advertises HTTP/3 listener in responses of h.
+func altSvc(h3 *http3.Server, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fails until HTTP/3 listener is started
+		h3.SetQUICHeaders(w.Header())
+		h.ServeHTTP(w, r)
+	})
+}
+
+func loadYAML(file string, v interface{}) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return yaml.UnmarshalStrict(b, v)
+}
+
+// loadMaintenance reads host patterns, one per line, empty lines and lines
+// starting with # are ignored.
+func loadMaintenance(file string) ([]string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var patterns []string
+	for _, l := range strings.Split(string(b), "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		patterns = append(patterns, l)
+	}
+	return patterns, nil
+}
+
+func loadHTTPAuth(file string) (map[string]*proto.AuthConfig, error) {
+	var m map[string]*proto.AuthConfig
+	if err := loadYAML(file, &m); err != nil {
+		return nil, err
+	}
+	for pattern, c := range m {
+		if c == nil {
+			return nil, fmt.Errorf("%s: missing auth", pattern)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s: %s", pattern, err)
+		}
+	}
+
+	return m, nil
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
 func fatal(format string, a ...interface{}) {
 	fmt.Fprintf(os.Stderr, format, a...)
 	fmt.Fprint(os.Stderr, "\n")
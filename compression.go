@@ -0,0 +1,214 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// streamEncodings lists supported stream encodings in order of preference.
+var streamEncodings = []string{proto.EncodingGzip}
+
+// negotiateEncoding returns the first supported encoding from accepted, or
+// empty string if none is supported.
+func negotiateEncoding(accepted []string) string {
+	for _, a := range accepted {
+		for _, e := range streamEncodings {
+			if strings.EqualFold(a, e) {
+				return e
+			}
+		}
+	}
+	return ""
+}
+
+// streamEncoder compresses a stream, Flush writes pending data so that
+// the peer can decompress everything written so far.
+type streamEncoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func newStreamEncoder(encoding string, w io.Writer) (streamEncoder, error) {
+	switch encoding {
+	case proto.EncodingGzip:
+		return gzip.NewWriter(w), nil
+	}
+	return nil, fmt.Errorf("unsupported stream encoding %q", encoding)
+}
+
+// syncEncoder flushes encoder after every write, it's used for TCP streams
+// where latency matters more than compression ratio.
+type syncEncoder struct {
+	streamEncoder
+}
+
+func (e syncEncoder) Write(p []byte) (int, error) {
+	n, err := e.streamEncoder.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, e.streamEncoder.Flush()
+}
+
+// newStreamDecoder returns reader decompressing r, empty streams are allowed.
+func newStreamDecoder(encoding string, r io.ReadCloser) (io.ReadCloser, error) {
+	switch encoding {
+	case proto.EncodingGzip:
+		return &gzipDecoder{r: r}, nil
+	}
+	return nil, fmt.Errorf("unsupported stream encoding %q", encoding)
+}
+
+// gzipDecoder reads gzip header lazily so that creating it does not block.
+type gzipDecoder struct {
+	r  io.ReadCloser
+	zr *gzip.Reader
+}
+
+func (d *gzipDecoder) Read(p []byte) (int, error) {
+	if d.zr == nil {
+		zr, err := gzip.NewReader(d.r)
+		if err != nil {
+			return 0, err
+		}
+		// stream may be kept open after gzip trailer
+		zr.Multistream(false)
+		d.zr = zr
+	}
+	n, err := d.zr.Read(p)
+	if err == io.EOF {
+		// read stream to the end so that HTTP/2 trailers are received
+		io.Copy(ioutil.Discard, d.r)
+	}
+	return n, err
+}
+
+func (d *gzipDecoder) Close() error {
+	return d.r.Close()
+}
+
+// compressedContent returns true if body described by header is already
+// compressed and compressing it again would be a waste of CPU.
+func compressedContent(h http.Header) bool {
+	if ce := h.Get("Content-Encoding"); ce != "" && !strings.EqualFold(ce, "identity") {
+		return true
+	}
+
+	ct, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	switch {
+	case strings.HasPrefix(ct, "image/"):
+		return ct != "image/svg+xml" && ct != "image/bmp"
+	case strings.HasPrefix(ct, "video/"), strings.HasPrefix(ct, "audio/"):
+		return true
+	}
+	switch ct {
+	case "application/gzip",
+		"application/x-gzip",
+		"application/zip",
+		"application/zstd",
+		"application/x-bzip2",
+		"application/x-xz",
+		"application/x-7z-compressed",
+		"application/x-rar-compressed",
+		"font/woff",
+		"font/woff2":
+		return true
+	}
+	return false
+}
+
+// grpcContent returns true if body described by header is a gRPC message
+// stream, messages must reach the peer as they are written so the stream
+// can not be compressed.
+func grpcContent(h http.Header) bool {
+	return strings.HasPrefix(h.Get("Content-Type"), "application/grpc")
+}
+
+// compressWriter compresses response stream sent to server unless response
+// is already compressed.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	enc         streamEncoder
+	wroteHeader bool
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.Header()
+	if bodyAllowed(code) && h.Get(proto.HeaderProxyError) == "" && !compressedContent(h) {
+		if enc, err := newStreamEncoder(w.encoding, w.ResponseWriter); err == nil {
+			w.enc = enc
+			h.Set(proto.HeaderStreamEncoding, w.encoding)
+			h.Del("Content-Length")
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.enc != nil {
+		return w.enc.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *compressWriter) Flush() {
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close finishes compressed stream.
+func (w *compressWriter) Close() error {
+	if w.enc != nil {
+		return w.enc.Close()
+	}
+	return nil
+}
+
+func bodyAllowed(code int) bool {
+	return code >= 200 && code != http.StatusNoContent && code != http.StatusNotModified
+}
+
+// decodeResponse replaces body of response compressed by client with
+// decompressing reader.
+func decodeResponse(resp *http.Response) error {
+	encoding := resp.Header.Get(proto.HeaderStreamEncoding)
+	if encoding == "" {
+		return nil
+	}
+
+	body, err := newStreamDecoder(encoding, resp.Body)
+	if err != nil {
+		return err
+	}
+	resp.Body = body
+	resp.ContentLength = -1
+	resp.Header.Del(proto.HeaderStreamEncoding)
+	resp.Header.Del("Content-Length")
+
+	return nil
+}
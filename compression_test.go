@@ -0,0 +1,181 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		accepted []string
+		expected string
+	}{
+		{nil, ""},
+		{[]string{"zstd"}, ""},
+		{[]string{"zstd", "GZIP"}, proto.EncodingGzip},
+	}
+	for _, tt := range tests {
+		if e := negotiateEncoding(tt.accepted); e != tt.expected {
+			t.Errorf("%v: expected %q got %q", tt.accepted, tt.expected, e)
+		}
+	}
+}
+
+func TestCompressedContent(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		header   http.Header
+		expected bool
+	}{
+		{http.Header{}, false},
+		{http.Header{"Content-Type": {"text/html; charset=utf-8"}}, false},
+		{http.Header{"Content-Type": {"image/svg+xml"}}, false},
+		{http.Header{"Content-Type": {"image/png"}}, true},
+		{http.Header{"Content-Type": {"application/zip"}}, true},
+		{http.Header{"Content-Type": {"text/plain"}, "Content-Encoding": {"br"}}, true},
+		{http.Header{"Content-Encoding": {"identity"}}, false},
+	}
+	for _, tt := range tests {
+		if v := compressedContent(tt.header); v != tt.expected {
+			t.Errorf("%v: expected %v", tt.header, tt.expected)
+		}
+	}
+}
+
+func TestCompressWriter(t *testing.T) {
+	t.Parallel()
+
+	payload := bytes.Repeat([]byte("hello tunnel "), 1000)
+
+	tests := []struct {
+		contentType string
+		status      int
+		compressed  bool
+	}{
+		{"text/plain", http.StatusOK, true},
+		{"image/jpeg", http.StatusOK, false},
+		{"text/plain", http.StatusNotModified, false},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		w := &compressWriter{ResponseWriter: rec, encoding: proto.EncodingGzip}
+		w.Header().Set("Content-Type", tt.contentType)
+		w.Header().Set("Content-Length", "13000")
+		w.WriteHeader(tt.status)
+		if bodyAllowed(tt.status) {
+			w.Write(payload)
+		}
+		w.Close()
+
+		resp := rec.Result()
+		if compressed := resp.Header.Get(proto.HeaderStreamEncoding) != ""; compressed != tt.compressed {
+			t.Errorf("%s %d: expected compressed %v", tt.contentType, tt.status, tt.compressed)
+			continue
+		}
+		if tt.compressed && rec.Body.Len() >= len(payload) {
+			t.Errorf("%s: body not compressed", tt.contentType)
+		}
+
+		if err := decodeResponse(resp); err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bodyAllowed(tt.status) && !bytes.Equal(b, payload) {
+			t.Errorf("%s: payload mismatch", tt.contentType)
+		}
+		if tt.compressed && (resp.Header.Get("Content-Length") != "" || resp.Header.Get(proto.HeaderStreamEncoding) != "") {
+			t.Errorf("unexpected headers %v", resp.Header)
+		}
+	}
+}
+
+func TestCompressWriterProxyError(t *testing.T) {
+	t.Parallel()
+
+	rec := httptest.NewRecorder()
+	w := &compressWriter{ResponseWriter: rec, encoding: proto.EncodingGzip}
+	ReportProxyError(w, proto.ProxyErrorDialRefused)
+	w.Close()
+
+	if rec.Header().Get(proto.HeaderStreamEncoding) != "" || rec.Body.Len() != 0 {
+		t.Error("proxy error compressed")
+	}
+}
+
+func TestStreamDecoderEmpty(t *testing.T) {
+	t.Parallel()
+
+	r, err := newStreamDecoder(proto.EncodingGzip, ioutil.NopCloser(&bytes.Buffer{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("expected EOF got %d %v", n, err)
+	}
+}
+
+func TestSyncEncoder(t *testing.T) {
+	t.Parallel()
+
+	pr, pw := io.Pipe()
+	enc, err := newStreamEncoder(proto.EncodingGzip, pw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, _ := newStreamDecoder(proto.EncodingGzip, pr)
+
+	go syncEncoder{enc}.Write([]byte("ping"))
+
+	// data must be readable before encoder is closed
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(dec, b); err != nil || string(b) != "ping" {
+		t.Errorf("unexpected read %q %v", b, err)
+	}
+	pw.Close()
+}
+
+func BenchmarkStreamEncoding(b *testing.B) {
+	text := bytes.Repeat([]byte(`{"id":1,"name":"tunnel","tags":["a","b","c"]},`), 1<<12)
+	random := make([]byte, len(text))
+	rand.Read(random)
+
+	for _, p := range []struct {
+		name    string
+		payload []byte
+	}{{"text", text}, {"random", random}} {
+		b.Run(p.name, func(b *testing.B) {
+			b.SetBytes(int64(len(p.payload)))
+			var (
+				buf bytes.Buffer
+				n   int
+			)
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				enc, _ := newStreamEncoder(proto.EncodingGzip, &buf)
+				enc.Write(p.payload)
+				enc.Close()
+				n = buf.Len()
+				dec, _ := newStreamDecoder(proto.EncodingGzip, ioutil.NopCloser(&buf))
+				io.Copy(ioutil.Discard, dec)
+			}
+			b.ReportMetric(float64(n)/float64(len(p.payload)), "ratio")
+		})
+	}
+}
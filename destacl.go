@@ -0,0 +1,270 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ErrDestinationDenied is returned when destination is denied by
+// DestinationACL.
+var ErrDestinationDenied = errors.New("destination denied")
+
+// DestinationACL decides which destinations forward proxies may connect to.
+//
+// Rules have form "pattern" or "pattern:ports". Pattern is a host name
+// pattern matched with path.Match, i.e. "*.corp.example.com", an IP address
+// or a CIDR, IPv6 addresses and networks must be enclosed in square brackets
+// when ports are given. Ports is a comma-separated list of ports and port
+// ranges, i.e. "443" or "80,8000-8999". Destination is denied if it matches
+// any deny rule, if there are allow rules it must match one of them.
+type DestinationACL struct {
+	allow []destRule
+	deny  []destRule
+}
+
+// NewDestinationACL creates DestinationACL from allow and deny rules.
+func NewDestinationACL(allow, deny []string) (*DestinationACL, error) {
+	a := &DestinationACL{}
+
+	for _, s := range allow {
+		r, err := parseDestRule(s)
+		if err != nil {
+			return nil, err
+		}
+		a.allow = append(a.allow, r)
+	}
+	for _, s := range deny {
+		r, err := parseDestRule(s)
+		if err != nil {
+			return nil, err
+		}
+		a.deny = append(a.deny, r)
+	}
+
+	return a, nil
+}
+
+// Resolve resolves host of addr and checks destination against the rules.
+// It returns address with the first allowed IP, connecting to that address
+// rather than to the host name prevents DNS rebinding. If a is nil all
+// destinations are allowed.
+func (a *DestinationACL) Resolve(ctx context.Context, addr string) (string, error) {
+	return a.resolve(ctx, addr, false)
+}
+
+// resolve is Resolve, if denyLocal is set loopback, link-local and
+// unspecified addresses are denied unless allowed by an IP or CIDR rule.
+func (a *DestinationACL) resolve(ctx context.Context, addr string, denyLocal bool) (string, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return "", fmt.Errorf("invalid port %q", portStr)
+	}
+
+	var (
+		name string
+		ips  []net.IP
+	)
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		name = strings.ToLower(strings.TrimSuffix(host, "."))
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return "", err
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+
+	for _, ip := range ips {
+		if denyLocal && isLocalIP(ip) && !a.allowedNetwork(ip, port) {
+			continue
+		}
+		if a.allowed(name, ip, port) {
+			return net.JoinHostPort(ip.String(), portStr), nil
+		}
+	}
+
+	return "", fmt.Errorf("%s: %w", addr, ErrDestinationDenied)
+}
+
+// check checks destination against the rules without resolving host of
+// addr, network rules match only IP addresses. It's used for destinations
+// resolved by an upstream proxy.
+func (a *DestinationACL) check(addr string, denyLocal bool) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	var (
+		name string
+		ip   = net.ParseIP(host)
+	)
+	if ip == nil {
+		name = strings.ToLower(strings.TrimSuffix(host, "."))
+	} else if denyLocal && isLocalIP(ip) && !a.allowedNetwork(ip, port) {
+		return fmt.Errorf("%s: %w", addr, ErrDestinationDenied)
+	}
+
+	if !a.allowed(name, ip, port) {
+		return fmt.Errorf("%s: %w", addr, ErrDestinationDenied)
+	}
+	return nil
+}
+
+func (a *DestinationACL) allowed(name string, ip net.IP, port int) bool {
+	if a == nil {
+		return true
+	}
+
+	for _, r := range a.deny {
+		if r.match(name, ip, port) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, r := range a.allow {
+		if r.match(name, ip, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedNetwork checks if ip is explicitly allowed by an IP or CIDR rule.
+func (a *DestinationACL) allowedNetwork(ip net.IP, port int) bool {
+	if a == nil {
+		return false
+	}
+
+	for _, r := range a.allow {
+		if r.ipnet != nil && r.match("", ip, port) {
+			return true
+		}
+	}
+	return false
+}
+
+func isLocalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// destRule matches destinations by host name pattern or network, and ports.
+type destRule struct {
+	host  string
+	ipnet *net.IPNet
+	ports [][2]int
+}
+
+func parseDestRule(s string) (destRule, error) {
+	var (
+		r       destRule
+		pattern = s
+		ports   string
+	)
+
+	if strings.HasPrefix(s, "[") {
+		i := strings.IndexByte(s, ']')
+		if i < 0 {
+			return r, fmt.Errorf("rule %q: missing ]", s)
+		}
+		pattern = s[1:i]
+		if rest := s[i+1:]; rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return r, fmt.Errorf("rule %q: unexpected %q", s, rest)
+			}
+			ports = rest[1:]
+			if ports == "" {
+				return r, fmt.Errorf("rule %q: missing ports", s)
+			}
+		}
+	} else if strings.Count(s, ":") == 1 {
+		i := strings.IndexByte(s, ':')
+		pattern, ports = s[:i], s[i+1:]
+		if ports == "" {
+			return r, fmt.Errorf("rule %q: missing ports", s)
+		}
+	}
+
+	if pattern == "" {
+		return r, fmt.Errorf("rule %q: missing pattern", s)
+	}
+	if strings.Contains(pattern, "/") {
+		_, ipnet, err := net.ParseCIDR(pattern)
+		if err != nil {
+			return r, fmt.Errorf("rule %q: %s", s, err)
+		}
+		r.ipnet = ipnet
+	} else if ip := net.ParseIP(pattern); ip != nil {
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		r.ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return r, fmt.Errorf("rule %q: %s", s, err)
+		}
+		r.host = strings.ToLower(pattern)
+	}
+
+	if ports != "" {
+		for _, p := range strings.Split(ports, ",") {
+			lo, hi, err := parsePortRange(p)
+			if err != nil {
+				return r, fmt.Errorf("rule %q: %s", s, err)
+			}
+			r.ports = append(r.ports, [2]int{lo, hi})
+		}
+	}
+
+	return r, nil
+}
+
+func (r destRule) match(name string, ip net.IP, port int) bool {
+	if len(r.ports) > 0 {
+		ok := false
+		for _, p := range r.ports {
+			if port >= p[0] && port <= p[1] {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	if r.ipnet != nil {
+		return r.ipnet.Contains(ip)
+	}
+	if r.host == "*" {
+		return true
+	}
+	if name == "" {
+		return false
+	}
+	ok, _ := path.Match(r.host, name)
+	return ok
+}
@@ -0,0 +1,116 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestDestinationACL(t *testing.T) {
+	t.Parallel()
+
+	for _, s := range []string{"", "host:", "10.0.0.0/33:80", "[::1", "[::1]80", "host:0-70000", "host:x", "[a-"} {
+		if _, err := NewDestinationACL([]string{s}, nil); err == nil {
+			t.Errorf("%q expected error", s)
+		}
+	}
+
+	acl, err := NewDestinationACL(
+		[]string{"*.example.com:443", "10.0.0.0/8:80,8000-8999", "[2001:db8::/32]", "192.0.2.1"},
+		[]string{"10.0.0.13", "secret.example.com"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deny, err := NewDestinationACL(nil, []string{"*:25", "169.254.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		acl      *DestinationACL
+		name     string
+		ip       string
+		port     int
+		expected bool
+	}{
+		{nil, "", "10.0.0.1", 22, true},
+		{acl, "www.example.com", "192.0.2.10", 443, true},
+		{acl, "WWW.example.com", "192.0.2.10", 80, false},
+		{acl, "secret.example.com", "192.0.2.10", 443, false},
+		{acl, "example.org", "192.0.2.10", 443, false},
+		{acl, "", "10.1.2.3", 80, true},
+		{acl, "", "10.1.2.3", 8080, true},
+		{acl, "", "10.1.2.3", 9000, false},
+		{acl, "", "10.0.0.13", 80, false},
+		{acl, "", "2001:db8::1", 22, true},
+		{acl, "", "192.0.2.1", 22, true},
+		{deny, "mail.example.com", "192.0.2.10", 25, false},
+		{deny, "", "192.0.2.10", 25, false},
+		{deny, "", "169.254.169.254", 80, false},
+		{deny, "", "192.0.2.10", 80, true},
+	}
+
+	for _, tt := range tests {
+		if actual := tt.acl.allowed(tt.name, net.ParseIP(tt.ip), tt.port); actual != tt.expected {
+			t.Errorf("%+v got %v", tt, actual)
+		}
+	}
+}
+
+func TestDestinationACL_Resolve(t *testing.T) {
+	t.Parallel()
+
+	acl, err := NewDestinationACL([]string{"127.0.0.1:80"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, err := acl.Resolve(context.Background(), "127.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != "127.0.0.1:80" {
+		t.Fatal("unexpected address", addr)
+	}
+
+	if _, err := acl.Resolve(context.Background(), "127.0.0.1:81"); !errors.Is(err, ErrDestinationDenied) {
+		t.Fatal("expected denied, got", err)
+	}
+	if _, err := acl.Resolve(context.Background(), "127.0.0.1"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestDestinationACL_Check(t *testing.T) {
+	t.Parallel()
+
+	acl, err := NewDestinationACL([]string{"*.example.com:443", "10.0.0.0/8"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		acl  *DestinationACL
+		addr string
+		ok   bool
+	}{
+		{nil, "localhost:80", true},
+		{nil, "127.0.0.1:80", false},
+		{nil, "[::1]:80", false},
+		{acl, "www.example.com:443", true},
+		{acl, "www.example.com:80", false},
+		{acl, "10.1.2.3:22", true},
+		{acl, "internal.corp:22", false},
+	}
+	for _, tt := range tests {
+		if err := tt.acl.check(tt.addr, true); (err == nil) != tt.ok {
+			t.Errorf("%s got %v", tt.addr, err)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// ProxyURL returns function selecting proxy used to reach server address.
+// Proxy is a URL with scheme http, https, socks5 or socks5h, credentials
+// from URL user info are used for basic or SOCKS5 authentication. noProxy is
+// comma-separated list of hosts, domains and networks reached directly, with
+// the syntax of NO_PROXY environment variable. Loopback addresses are always
+// reached directly.
+func ProxyURL(proxy, noProxy string) func(addr string) (*url.URL, error) {
+	c := &httpproxy.Config{
+		HTTPSProxy: proxy,
+		NoProxy:    noProxy,
+	}
+	f := c.ProxyFunc()
+
+	return func(addr string) (*url.URL, error) {
+		return f(&url.URL{Scheme: "https", Host: addr})
+	}
+}
+
+// ProxyFromEnvironment selects proxy used to reach server address based on
+// HTTPS_PROXY, ALL_PROXY and NO_PROXY environment variables or lowercase
+// versions thereof. HTTPS_PROXY takes precedence over ALL_PROXY.
+func ProxyFromEnvironment(addr string) (*url.URL, error) {
+	c := httpproxy.FromEnvironment()
+	p := c.HTTPSProxy
+	if p == "" {
+		p = getenv("ALL_PROXY", "all_proxy")
+	}
+	return ProxyURL(p, c.NoProxy)(addr)
+}
+
+func getenv(names ...string) string {
+	for _, n := range names {
+		if v := os.Getenv(n); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// proxyAddr returns address of proxy, URL port or default port of scheme.
+func proxyAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	switch u.Scheme {
+	case "https":
+		return net.JoinHostPort(u.Hostname(), "443")
+	case "socks5", "socks5h":
+		return net.JoinHostPort(u.Hostname(), "1080")
+	default:
+		return net.JoinHostPort(u.Hostname(), "80")
+	}
+}
+
+// proxyConnect opens connection to addr through proxy u over conn connected
+// to the proxy.
+func proxyConnect(conn net.Conn, u *url.URL, addr string) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(DefaultTimeout))
+
+	var err error
+	switch u.Scheme {
+	case "http":
+		conn, err = httpConnect(conn, u, addr)
+	case "https":
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err = tlsConn.Handshake(); err == nil {
+			conn, err = httpConnect(tlsConn, u, addr)
+		}
+	case "socks5", "socks5h":
+		conn, err = socks5Connect(conn, u, addr)
+	default:
+		err = fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, conn.SetDeadline(time.Time{})
+}
+
+func httpConnect(conn net.Conn, u *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		req.SetBasicAuth(u.User.Username(), password)
+		req.Header["Proxy-Authorization"] = req.Header["Authorization"]
+		req.Header.Del("Authorization")
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy CONNECT failed: %s", resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+
+	return conn, nil
+}
+
+// bufferedConn is connection with data read ahead of handshake.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func socks5Connect(conn net.Conn, u *url.URL, addr string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = &proxy.Auth{
+			User:     u.User.Username(),
+			Password: password,
+		}
+	}
+
+	d, err := proxy.SOCKS5("tcp", conn.RemoteAddr().String(), auth, connDialer{conn})
+	if err != nil {
+		return nil, err
+	}
+	return d.Dial("tcp", addr)
+}
+
+// connDialer is proxy.Dialer returning already established connection.
+type connDialer struct {
+	conn net.Conn
+}
+
+func (d connDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.conn, nil
+}
@@ -0,0 +1,278 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/mmatczuk/go-http-tunnel/keepalive"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+func TestProxyURL(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		proxy    string
+		noProxy  string
+		addr     string
+		expected string
+	}{
+		{"", "", "tunnel.example.com:5223", ""},
+		{"http://proxy:3128", "", "tunnel.example.com:5223", "http://proxy:3128"},
+		{"proxy:3128", "", "tunnel.example.com:5223", "http://proxy:3128"},
+		{"socks5://u:p@proxy:1080", "", "tunnel.example.com:5223", "socks5://u:p@proxy:1080"},
+		{"http://proxy:3128", "example.com", "tunnel.example.com:5223", ""},
+		{"http://proxy:3128", "other.com", "tunnel.example.com:5223", "http://proxy:3128"},
+		{"http://proxy:3128", "10.0.0.0/8", "10.1.2.3:5223", ""},
+		{"http://proxy:3128", "*", "tunnel.example.com:5223", ""},
+		{"http://proxy:3128", "", "127.0.0.1:5223", ""},
+	}
+
+	for _, tt := range tests {
+		u, err := ProxyURL(tt.proxy, tt.noProxy)(tt.addr)
+		if err != nil {
+			t.Fatal(tt, err)
+		}
+		actual := ""
+		if u != nil {
+			actual = u.String()
+		}
+		if actual != tt.expected {
+			t.Errorf("%+v got %q", tt, actual)
+		}
+	}
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	for _, k := range []string{"HTTPS_PROXY", "https_proxy", "ALL_PROXY", "all_proxy", "NO_PROXY", "no_proxy"} {
+		t.Setenv(k, "")
+	}
+
+	t.Setenv("ALL_PROXY", "socks5://proxy:1080")
+	t.Setenv("NO_PROXY", "internal.example.com")
+
+	tests := []struct {
+		addr     string
+		expected string
+	}{
+		{"tunnel.example.com:5223", "socks5://proxy:1080"},
+		{"tunnel.internal.example.com:5223", ""},
+	}
+	for _, tt := range tests {
+		u, err := ProxyFromEnvironment(tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual := ""
+		if u != nil {
+			actual = u.String()
+		}
+		if actual != tt.expected {
+			t.Errorf("%s got %q expected %q", tt.addr, actual, tt.expected)
+		}
+	}
+
+	t.Setenv("HTTPS_PROXY", "http://proxy:3128")
+	u, err := ProxyFromEnvironment("tunnel.example.com:5223")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.String() != "http://proxy:3128" {
+		t.Errorf("HTTPS_PROXY not preferred, got %s", u)
+	}
+}
+
+func TestClient_DialProxy(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewTLSServer(nil)
+	defer s.Close()
+
+	httpProxy := httpProxyStub(t, "user", "secret")
+	defer httpProxy.Close()
+	socksProxy := socks5ProxyStub(t, "user", "secret")
+	defer socksProxy.Close()
+
+	tests := []struct {
+		proxy string
+		ok    bool
+	}{
+		{"http://user:secret@" + httpProxy.Addr().String(), true},
+		{"http://user:wrong@" + httpProxy.Addr().String(), false},
+		{"socks5://user:secret@" + socksProxy.Addr().String(), true},
+		{"socks5h://user:wrong@" + socksProxy.Addr().String(), false},
+		{"ftp://" + httpProxy.Addr().String(), false},
+	}
+
+	for _, tt := range tests {
+		u, err := url.Parse(tt.proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := NewClient(&ClientConfig{
+			ServerAddr: s.Listener.Addr().String(),
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			ProxyURL: func(addr string) (*url.URL, error) {
+				return u, nil
+			},
+			Tunnels: map[string]*proto.Tunnel{"test": {}},
+			Proxy:   Proxy(ProxyFuncs{}),
+			KeepAlive: &keepalive.KeepAlive{
+				KeepAliveIdleTime: keepalive.DefaultKeepAliveIdleTime,
+				KeepAliveCount:    keepalive.DefaultKeepAliveCount,
+				KeepAliveInterval: keepalive.DefaultKeepAliveInterval,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := c.dial()
+		if tt.ok {
+			if err != nil {
+				t.Fatal(tt.proxy, err)
+			}
+			conn.Close()
+		} else if err == nil {
+			t.Fatal(tt.proxy, "expected error")
+		}
+	}
+}
+
+// httpProxyStub is HTTP CONNECT proxy requiring basic authentication.
+func httpProxyStub(t *testing.T, user, password string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+
+				br := bufio.NewReader(conn)
+				r, err := http.ReadRequest(br)
+				if err != nil || r.Method != http.MethodConnect {
+					return
+				}
+				r.Header.Set("Authorization", r.Header.Get("Proxy-Authorization"))
+				if u, p, ok := r.BasicAuth(); !ok || u != user || p != password {
+					io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+
+				target, err := net.Dial("tcp", r.Host)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+
+				go io.Copy(target, br)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+
+	return l
+}
+
+// socks5ProxyStub is SOCKS5 proxy requiring username/password authentication,
+// it supports CONNECT command with IPv4 and domain name addresses.
+func socks5ProxyStub(t *testing.T, user, password string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readString := func(r io.Reader) string {
+		n := make([]byte, 1)
+		io.ReadFull(r, n)
+		b := make([]byte, n[0])
+		io.ReadFull(r, b)
+		return string(b)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+
+				// methods
+				b := make([]byte, 2)
+				if _, err := io.ReadFull(conn, b); err != nil || b[0] != 5 {
+					return
+				}
+				io.ReadFull(conn, make([]byte, b[1]))
+				conn.Write([]byte{5, 2})
+
+				// username/password
+				if _, err := io.ReadFull(conn, b[:1]); err != nil {
+					return
+				}
+				if readString(conn) != user || readString(conn) != password {
+					conn.Write([]byte{1, 1})
+					return
+				}
+				conn.Write([]byte{1, 0})
+
+				// request
+				req := make([]byte, 4)
+				if _, err := io.ReadFull(conn, req); err != nil || req[1] != 1 {
+					return
+				}
+				var host string
+				switch req[3] {
+				case 1:
+					ip := make([]byte, 4)
+					io.ReadFull(conn, ip)
+					host = net.IP(ip).String()
+				case 3:
+					host = readString(conn)
+				default:
+					return
+				}
+				port := make([]byte, 2)
+				io.ReadFull(conn, port)
+
+				target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+				if err != nil {
+					conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer target.Close()
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+
+	return l
+}
@@ -0,0 +1,233 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// ErrorTemplates maps status codes or status classes, i.e. "502" or "5xx",
+// to paths of html/template files rendering error pages. Templates are
+// executed with ErrorPage.
+type ErrorTemplates map[string]string
+
+// ErrorPagesConfig specifies error page templates.
+type ErrorPagesConfig struct {
+	// Default templates are used for hosts without matching templates.
+	Default ErrorTemplates `yaml:"default"`
+	// Hosts maps host patterns to templates, patterns are matched with
+	// path.Match, the longest matching pattern wins.
+	Hosts map[string]ErrorTemplates `yaml:"hosts"`
+}
+
+// ErrorPage describes an error sent to user instead of proxied response.
+type ErrorPage struct {
+	Status     int    `json:"status"`
+	StatusText string `json:"error"`
+	Message    string `json:"message"`
+	Host       string `json:"host"`
+}
+
+// ErrorPages renders error pages from templates.
+type ErrorPages struct {
+	def   map[string]*template.Template
+	hosts map[string]map[string]*template.Template
+}
+
+// NewErrorPages parses error page templates.
+func NewErrorPages(c *ErrorPagesConfig) (*ErrorPages, error) {
+	p := &ErrorPages{
+		hosts: make(map[string]map[string]*template.Template, len(c.Hosts)),
+	}
+
+	var err error
+	if p.def, err = parseErrorTemplates(c.Default); err != nil {
+		return nil, err
+	}
+	for pattern, t := range c.Hosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("host pattern %q: %s", pattern, err)
+		}
+		if p.hosts[pattern], err = parseErrorTemplates(t); err != nil {
+			return nil, fmt.Errorf("host pattern %q: %s", pattern, err)
+		}
+	}
+
+	return p, nil
+}
+
+func parseErrorTemplates(t ErrorTemplates) (map[string]*template.Template, error) {
+	m := make(map[string]*template.Template, len(t))
+	for k, file := range t {
+		if !validStatusKey(k) {
+			return nil, fmt.Errorf("invalid status %q, expected code or class like 5xx", k)
+		}
+		tmpl, err := template.ParseFiles(file)
+		if err != nil {
+			return nil, err
+		}
+		m[strings.ToLower(k)] = tmpl
+	}
+	return m, nil
+}
+
+func validStatusKey(k string) bool {
+	if len(k) != 3 || k[0] < '1' || k[0] > '5' {
+		return false
+	}
+	if strings.ToLower(k[1:]) == "xx" {
+		return true
+	}
+	_, err := strconv.Atoi(k)
+	return err == nil
+}
+
+// template returns the most specific template for host and status, host
+// templates take precedence over default templates and status codes over
+// status classes.
+func (p *ErrorPages) template(host string, status int) *template.Template {
+	if p == nil {
+		return nil
+	}
+
+	var (
+		hostTemplates map[string]*template.Template
+		n             = -1
+	)
+	for pattern, m := range p.hosts {
+		if len(pattern) > n && globMatch(pattern, host) {
+			hostTemplates, n = m, len(pattern)
+		}
+	}
+
+	code := strconv.Itoa(status)
+	class := code[:1] + "xx"
+	for _, m := range []map[string]*template.Template{hostTemplates, p.def} {
+		if t := m[code]; t != nil {
+			return t
+		}
+		if t := m[class]; t != nil {
+			return t
+		}
+	}
+	return nil
+}
+
+// writeError sends error page as JSON if request accepts JSON, otherwise
+// renders error page template or falls back to plain text.
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	e := &ErrorPage{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    message,
+		Host:       trimPort(r.Host),
+	}
+
+	h := w.Header()
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Cache-Control", "no-store")
+
+	if acceptsJSON(r) {
+		h.Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+
+	if t := s.config.ErrorPages.template(e.Host, status); t != nil {
+		var buf bytes.Buffer
+		err := t.Execute(&buf, e)
+		if err == nil {
+			h.Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(status)
+			w.Write(buf.Bytes())
+			return
+		}
+		s.logger.Log(
+			"level", 0,
+			"msg", "error page template failed",
+			"host", e.Host,
+			"status", status,
+			"err", err,
+		)
+	}
+
+	http.Error(w, message, status)
+}
+
+// acceptsJSON returns true if Accept header lists JSON before HTML.
+func acceptsJSON(r *http.Request) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept"), ",") {
+		t, _, err := mime.ParseMediaType(strings.TrimSpace(v))
+		if err != nil {
+			continue
+		}
+		switch {
+		case t == "application/json" || strings.HasSuffix(t, "+json"):
+			return true
+		case t == "text/html":
+			return false
+		}
+	}
+	return false
+}
+
+// proxyError is failure reported by client in proto.HeaderProxyError.
+type proxyError struct {
+	code string
+}
+
+func (e *proxyError) Error() string {
+	return "local service error: " + e.code
+}
+
+// errorStatus maps error to HTTP status and message safe to show to user.
+func errorStatus(err error) (int, string) {
+	switch err {
+	case errClientNotSubscribed:
+		return http.StatusNotFound, "unknown host"
+	case errClientNotConnected:
+		return http.StatusBadGateway, "client offline"
+	case errMaintenance:
+		return http.StatusServiceUnavailable, "service under maintenance"
+	case errForbidden:
+		return http.StatusForbidden, "forbidden"
+	case errUnauthorised:
+		return http.StatusUnauthorized, "unauthorised"
+	case errQuotaExceeded:
+		return http.StatusTooManyRequests, "quota exceeded"
+	}
+
+	switch e := err.(type) {
+	case *rateLimitError:
+		return http.StatusTooManyRequests, "rate limit exceeded"
+	case *proxyError:
+		switch e.code {
+		case proto.ProxyErrorTimeout:
+			return http.StatusGatewayTimeout, "local service timeout"
+		case proto.ProxyErrorDialRefused:
+			return http.StatusBadGateway, "local service unavailable"
+		case proto.ProxyErrorNoRoute:
+			return http.StatusBadGateway, "no route to local service"
+		case proto.ProxyErrorUnsupportedProtocol:
+			return http.StatusBadGateway, "unsupported protocol"
+		case proto.ProxyErrorForbidden:
+			return http.StatusForbidden, "destination denied"
+		}
+		return http.StatusBadGateway, "local service error"
+	}
+
+	return http.StatusBadGateway, "bad gateway"
+}
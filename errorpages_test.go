@@ -0,0 +1,233 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+func TestServer_ErrorPages(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "errorpages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"4xx.html":     "default {{.Status}} {{.Message}}",
+		"preview.html": "preview {{.Host}} is {{.Message}}",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pages, err := NewErrorPages(&ErrorPagesConfig{
+		Default: ErrorTemplates{"4xx": filepath.Join(dir, "4xx.html")},
+		Hosts: map[string]ErrorTemplates{
+			"*.preview.example.com": {"5XX": filepath.Join(dir, "preview.html")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewErrorPages(&ErrorPagesConfig{Default: ErrorTemplates{"6xx": "x"}}); err == nil {
+		t.Error("expected invalid status error")
+	}
+
+	cert, err := tls.LoadX509KeyPair("./testdata/selfsigned.crt", "./testdata/selfsigned.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(&ServerConfig{
+		Addr:        "127.0.0.1:0",
+		TLSConfig:   &tls.Config{Certificates: []tls.Certificate{cert}},
+		ErrorPages:  pages,
+		Maintenance: []string{"down.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.listener.Close()
+
+	identifier := id.New([]byte("client"))
+	s.Subscribe(identifier)
+	if err := s.addTunnels(map[string]*proto.Tunnel{
+		"web": {Protocol: proto.HTTP, Host: "app.preview.example.com"},
+		"api": {Protocol: proto.HTTP, Host: "api.example.com"},
+	}, identifier); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url    string
+		accept string
+		status int
+		body   string
+	}{
+		{"http://unknown.example.com/", "", http.StatusNotFound, "default 404 unknown host"},
+		{"http://app.preview.example.com/", "text/html", http.StatusBadGateway, "preview app.preview.example.com is client offline"},
+		{"http://api.example.com/", "", http.StatusBadGateway, "client offline\n"},
+		{"http://down.example.com/", "", http.StatusServiceUnavailable, "service under maintenance\n"},
+		{"http://api.example.com/", "application/json, text/html", http.StatusBadGateway,
+			`{"status":502,"error":"Bad Gateway","message":"client offline","host":"api.example.com"}` + "\n"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.url, nil)
+		r.Header.Set("Accept", tt.accept)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != tt.status || w.Body.String() != tt.body {
+			t.Errorf("%s: unexpected response %d %q", tt.url, w.Code, w.Body.String())
+		}
+	}
+
+	if err := s.SetMaintenance([]string{"*.preview.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if !s.inMaintenance("app.preview.example.com:80") || s.inMaintenance("down.example.com") {
+		t.Error("maintenance not updated")
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{&proxyError{proto.ProxyErrorTimeout}, http.StatusGatewayTimeout},
+		{&proxyError{proto.ProxyErrorDialRefused}, http.StatusBadGateway},
+		{&rateLimitError{}, http.StatusTooManyRequests},
+		{errForbidden, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if status, _ := errorStatus(tt.err); status != tt.status {
+			t.Errorf("%s: expected %d got %d", tt.err, tt.status, status)
+		}
+	}
+}
+
+func TestHTTPProxy_ReportsDialError(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	p := NewHTTPProxy(&url.URL{Scheme: "http", Host: addr}, nil)
+	w := httptest.NewRecorder()
+	p.Proxy(w, ioutil.NopCloser(strings.NewReader("GET / HTTP/1.1\r\nHost: app.example.com\r\n\r\n")), &proto.ControlMessage{
+		Action:         proto.ActionProxy,
+		ForwardedHost:  "app.example.com",
+		ForwardedProto: proto.HTTP,
+	})
+
+	if w.Code != http.StatusBadGateway || w.Header().Get(proto.HeaderProxyError) != proto.ProxyErrorDialRefused {
+		t.Errorf("unexpected response %d %v", w.Code, w.Header())
+	}
+}
+
+func TestHTTPProxy_StripsProxyErrorHeader(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(proto.HeaderProxyError, proto.ProxyErrorDialRefused)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer s.Close()
+
+	u, _ := url.Parse(s.URL)
+	p := NewHTTPProxy(u, nil)
+	w := httptest.NewRecorder()
+	p.Proxy(w, ioutil.NopCloser(strings.NewReader("GET / HTTP/1.1\r\nHost: app.example.com\r\n\r\n")), &proto.ControlMessage{
+		Action:         proto.ActionProxy,
+		ForwardedHost:  "app.example.com",
+		ForwardedProto: proto.HTTP,
+	})
+
+	if w.Code != http.StatusBadGateway || w.Header().Get(proto.HeaderProxyError) != "" {
+		t.Errorf("unexpected response %d %v", w.Code, w.Header())
+	}
+}
+
+func TestAcceptsJSON(t *testing.T) {
+	t.Parallel()
+
+	for accept, expected := range map[string]bool{
+		"":                                 false,
+		"application/json":                 true,
+		"application/problem+json":         true,
+		"text/html,application/json;q=0.9": false,
+		"*/*":                              false,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept", accept)
+		if acceptsJSON(r) != expected {
+			t.Errorf("%q: expected %v", accept, expected)
+		}
+	}
+}
+
+func TestTCPProxy_ReportsErrors(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	p := NewMultiTCPProxy(map[string]string{"80": addr}, nil)
+	proxy := Proxy(ProxyFuncs{TCP: p.Proxy})
+
+	tests := []struct {
+		msg  *proto.ControlMessage
+		code string
+	}{
+		{&proto.ControlMessage{ForwardedProto: proto.TCP, ForwardedHost: "127.0.0.1:80"}, proto.ProxyErrorDialRefused},
+		{&proto.ControlMessage{ForwardedProto: proto.TCP, ForwardedHost: "127.0.0.1:81"}, proto.ProxyErrorNoRoute},
+		{&proto.ControlMessage{ForwardedProto: proto.HTTP, ForwardedHost: "127.0.0.1:80"}, proto.ProxyErrorUnsupportedProtocol},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		proxy(w, ioutil.NopCloser(strings.NewReader("")), tt.msg)
+		if w.Code != http.StatusBadGateway || w.Header().Get(proto.HeaderProxyError) != tt.code {
+			t.Errorf("%s %s: unexpected response %d %v", tt.msg.ForwardedProto, tt.msg.ForwardedHost, w.Code, w.Header())
+		}
+	}
+}
+
+func TestUnwrapConn(t *testing.T) {
+	t.Parallel()
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	conn := &loggedConn{Conn: &meteredConn{Conn: &shapedConn{Conn: c1}}}
+	if unwrapConn(conn) != c1 {
+		t.Error("connection not unwrapped")
+	}
+}
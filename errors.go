@@ -12,4 +12,6 @@ var (
 	errClientAlreadyConnected = errors.New("client already connected")
 
 	errUnauthorised = errors.New("unauthorised")
+	errForbidden    = errors.New("forbidden")
+	errMaintenance  = errors.New("maintenance")
 )
@@ -0,0 +1,318 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/log"
+)
+
+// EventType identifies kind of Event.
+type EventType string
+
+// Event types.
+const (
+	EventClientConnected    EventType = "client.connected"
+	EventClientDisconnected EventType = "client.disconnected"
+	EventClientRejected     EventType = "client.rejected"
+	EventTunnelOpened       EventType = "tunnel.opened"
+	EventTunnelClosed       EventType = "tunnel.closed"
+)
+
+// Event describes a change of client or tunnel state.
+type Event struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+	// Identifier is the client identifier, it's zero if client was
+	// rejected before it was identified.
+	Identifier id.ID `json:"-"`
+	// RemoteAddr is the network address of the client, it's set for
+	// client connected and rejected events.
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// Tunnel, Protocol, Host and Addr describe tunnel, Host is set for
+	// HTTP and SNI tunnels, Addr is the public listener address of TCP
+	// tunnels.
+	Tunnel   string `json:"tunnel,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	Host     string `json:"host,omitempty"`
+	Addr     string `json:"addr,omitempty"`
+	// Reason is the reason client was rejected.
+	Reason string `json:"reason,omitempty"`
+}
+
+// MarshalJSON adds client id to JSON encoded event.
+func (e *Event) MarshalJSON() ([]byte, error) {
+	type event Event
+	var clientID string
+	if e.Identifier != (id.ID{}) {
+		clientID = e.Identifier.String()
+	}
+	return json.Marshal(struct {
+		*event
+		ClientID string `json:"client_id,omitempty"`
+	}{(*event)(e), clientID})
+}
+
+// eventBus delivers events to subscribers, slow subscribers lose events
+// instead of blocking publisher.
+type eventBus struct {
+	subs map[chan *Event]struct{}
+	mu   sync.RWMutex
+}
+
+func (b *eventBus) subscribe(buffer int) (<-chan *Event, func()) {
+	ch := make(chan *Event, buffer)
+
+	b.mu.Lock()
+	if b.subs == nil {
+		b.subs = make(map[chan *Event]struct{})
+	}
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// publish returns number of subscribers that did not receive event.
+func (b *eventBus) publish(e *Event) (dropped int) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			dropped++
+		}
+	}
+	return
+}
+
+// SubscribeEvents returns channel receiving server events and function
+// that cancels subscription and closes the channel. Events are dropped if
+// channel buffer is full.
+func (s *Server) SubscribeEvents(buffer int) (<-chan *Event, func()) {
+	return s.events.subscribe(buffer)
+}
+
+func (s *Server) publish(e *Event) {
+	e.Time = time.Now()
+	if n := s.events.publish(e); n > 0 {
+		s.metrics.Add(MetricEventsDropped, int64(n))
+		s.logger.Log(
+			"level", 1,
+			"msg", "event dropped",
+			"event", e.Type,
+			"subscribers", n,
+		)
+	}
+}
+
+func (s *Server) publishTunnel(typ EventType, identifier id.ID, t *tunnelInfo) {
+	s.publish(&Event{
+		Type:       typ,
+		Identifier: identifier,
+		Tunnel:     t.name,
+		Protocol:   t.protocol,
+		Host:       t.host,
+		Addr:       t.addr,
+	})
+}
+
+// Webhook defaults.
+const (
+	DefaultWebhookRetries       = 5
+	DefaultWebhookRetryInterval = time.Second
+	DefaultWebhookConcurrency   = 16
+)
+
+// Webhook HTTP headers.
+const (
+	HeaderEventType      = "X-Tunnel-Event"
+	HeaderEventDelivery  = "X-Tunnel-Delivery"
+	HeaderEventSignature = "X-Tunnel-Signature"
+)
+
+// EventWebhook POSTs JSON encoded events to URL. Failed deliveries are
+// retried with exponential backoff. If Secret is set every request is signed,
+// HeaderEventSignature holds "sha256=" followed by hex encoded HMAC-SHA256 of
+// the request body. HeaderEventDelivery is unique per event and does not
+// change between retries.
+type EventWebhook struct {
+	// URL is the webhook endpoint.
+	URL string
+	// Secret is optional HMAC key.
+	Secret []byte
+	// Types limits events sent to the webhook, if empty all events are
+	// sent.
+	Types []EventType
+	// Client is the HTTP client used to call the webhook, if nil
+	// http.DefaultClient is used.
+	Client *http.Client
+	// Timeout specifies webhook call timeout, if zero DefaultTimeout is
+	// used.
+	Timeout time.Duration
+	// Retries specifies how many times failed delivery is retried, if zero
+	// DefaultWebhookRetries is used, if negative delivery is not retried.
+	Retries int
+	// RetryInterval is the initial retry interval, it's doubled after
+	// every retry, if zero DefaultWebhookRetryInterval is used.
+	RetryInterval time.Duration
+	// Concurrency limits deliveries in progress, if zero
+	// DefaultWebhookConcurrency is used.
+	Concurrency int
+	// Logger is optional logger. If nil logging is disabled.
+	Logger log.Logger
+}
+
+// Run delivers events until channel is closed and waits for deliveries in
+// progress. Events are delivered concurrently so that a retried delivery
+// does not hold newer events, they may arrive out of order.
+func (w *EventWebhook) Run(events <-chan *Event) {
+	logger := w.Logger
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	n := w.Concurrency
+	if n <= 0 {
+		n = DefaultWebhookConcurrency
+	}
+
+	var (
+		sem = make(chan struct{}, n)
+		wg  sync.WaitGroup
+	)
+	for e := range events {
+		if !w.accepts(e.Type) {
+			continue
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(e *Event) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := w.Deliver(e); err != nil {
+				logger.Log(
+					"level", 0,
+					"msg", "event webhook failed",
+					"event", e.Type,
+					"err", err,
+				)
+			}
+		}(e)
+	}
+	wg.Wait()
+}
+
+func (w *EventWebhook) accepts(t EventType) bool {
+	if len(w.Types) == 0 {
+		return true
+	}
+	for _, v := range w.Types {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Deliver sends event retrying on failure.
+func (w *EventWebhook) Deliver(e *Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	delivery := randString()
+
+	retries := w.Retries
+	if retries == 0 {
+		retries = DefaultWebhookRetries
+	}
+	interval := w.RetryInterval
+	if interval == 0 {
+		interval = DefaultWebhookRetryInterval
+	}
+
+	for i := 0; ; i++ {
+		retry, err := w.send(e.Type, delivery, b)
+		if err == nil {
+			return nil
+		}
+		if !retry || i >= retries {
+			return err
+		}
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
+
+// send returns error and true if delivery should be retried.
+func (w *EventWebhook) send(t EventType, delivery string, b []byte) (bool, error) {
+	timeout := w.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	r, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(b))
+	if err != nil {
+		return false, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(HeaderEventType, string(t))
+	r.Header.Set(HeaderEventDelivery, delivery)
+	if len(w.Secret) > 0 {
+		r.Header.Set(HeaderEventSignature, SignEvent(w.Secret, b))
+	}
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(r.WithContext(ctx))
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<20))
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout
+		return retry, fmt.Errorf("webhook status %s", resp.Status)
+	}
+	return false, nil
+}
+
+// SignEvent returns HeaderEventSignature value for a given request body.
+func SignEvent(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
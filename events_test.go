@@ -0,0 +1,176 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/log"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+func TestServer_Events(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{
+		registry: newRegistry(nil),
+		config:   &ServerConfig{},
+		logger:   log.NewNopLogger(),
+		metrics:  newMetrics(),
+	}
+	events, cancel := s.SubscribeEvents(10)
+	slow, cancelSlow := s.SubscribeEvents(0)
+	defer cancelSlow()
+
+	identifier := id.New([]byte("client"))
+	s.Subscribe(identifier)
+	err := s.set(&RegistryItem{
+		tunnels: []*tunnelInfo{{name: "web", protocol: proto.HTTP, host: "app.example.com"}},
+	}, identifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.disconnected(identifier)
+	s.disconnected(identifier)
+	cancel()
+
+	var got []*Event
+	for e := range events {
+		got = append(got, e)
+	}
+	if len(got) != 2 {
+		t.Fatal("expected 2 events, got", len(got))
+	}
+	if got[0].Type != EventClientDisconnected || got[0].Identifier != identifier {
+		t.Errorf("unexpected event %+v", got[0])
+	}
+	if e := got[1]; e.Type != EventTunnelClosed || e.Tunnel != "web" || e.Protocol != proto.HTTP || e.Host != "app.example.com" {
+		t.Errorf("unexpected event %+v", e)
+	}
+
+	b, err := json.Marshal(got[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v map[string]interface{}
+	json.Unmarshal(b, &v)
+	if v["client_id"] != identifier.String() || v["type"] != string(EventTunnelClosed) || v["tunnel"] != "web" {
+		t.Errorf("unexpected JSON %s", b)
+	}
+
+	select {
+	case <-slow:
+		t.Error("expected no events")
+	default:
+	}
+	if s.metrics.Get(MetricEventsDropped).String() != "2" {
+		t.Error("expected dropped events metric")
+	}
+}
+
+func TestEventWebhook(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu         sync.Mutex
+		deliveries []string
+		failures   = 2
+	)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(HeaderEventSignature) != SignEvent([]byte("secret"), body) {
+			t.Error("bad signature")
+		}
+		if r.Header.Get(HeaderEventType) != string(EventClientConnected) {
+			t.Error("unexpected event type", r.Header.Get(HeaderEventType))
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		deliveries = append(deliveries, r.Header.Get(HeaderEventDelivery))
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer hook.Close()
+
+	w := &EventWebhook{
+		URL:           hook.URL,
+		Secret:        []byte("secret"),
+		Types:         []EventType{EventClientConnected},
+		RetryInterval: time.Millisecond,
+	}
+
+	events := make(chan *Event, 2)
+	events <- &Event{Type: EventTunnelOpened}
+	events <- &Event{Type: EventClientConnected, Identifier: id.New([]byte("client"))}
+	close(events)
+	w.Run(events)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(deliveries) != 3 || deliveries[0] == "" || deliveries[0] != deliveries[1] || deliveries[1] != deliveries[2] {
+		t.Errorf("unexpected deliveries %v", deliveries)
+	}
+
+	// client errors are not retried
+	bad := httptest.NewServer(http.NotFoundHandler())
+	defer bad.Close()
+	w.URL = bad.URL
+	w.Retries = 3
+	w.RetryInterval = time.Second
+	start := time.Now()
+	if err := w.Deliver(&Event{Type: EventClientConnected}); err == nil {
+		t.Error("expected error")
+	}
+	if time.Since(start) > time.Second {
+		t.Error("delivery retried")
+	}
+}
+
+func TestEventWebhook_FailingDeliveryDoesNotBlock(t *testing.T) {
+	t.Parallel()
+
+	delivered := make(chan string, 2)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e Event
+		json.NewDecoder(r.Body).Decode(&e)
+		if e.Tunnel == "failing" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		delivered <- e.Tunnel
+	}))
+	defer hook.Close()
+
+	w := &EventWebhook{
+		URL:           hook.URL,
+		RetryInterval: time.Hour,
+	}
+
+	events := make(chan *Event, 2)
+	defer close(events)
+	go w.Run(events)
+	events <- &Event{Type: EventTunnelOpened, Tunnel: "failing"}
+	events <- &Event{Type: EventTunnelOpened, Tunnel: "web"}
+
+	select {
+	case name := <-delivered:
+		if name != "web" {
+			t.Error("unexpected delivery", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event blocked by failing delivery")
+	}
+}
@@ -2,76 +2,103 @@ package tunnel
 
 import (
 	"bufio"
+	"context"
 	"encoding/base64"
-	"fmt"
+	"errors"
 	"io"
 	"net"
 	"net/http"
-	"net/http/httputil"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/mmatczuk/go-http-tunnel/keepalive"
 	"github.com/mmatczuk/go-http-tunnel/log"
 	"github.com/mmatczuk/go-http-tunnel/proto"
 )
 
-// ForwardingProxy uses http tunnel.
+// ForwardingConfig specifies forward proxy of an httpconnect tunnel.
+type ForwardingConfig struct {
+	// Users maps user names to bcrypt or argon2id password hashes checked
+	// with Proxy-Authorization basic authentication, if empty
+	// authentication is not required.
+	Users map[string]string
+	// Destinations specifies destinations the tunnel may connect to,
+	// loopback and link-local destinations are denied unless allowed by an
+	// IP or CIDR rule.
+	Destinations *DestinationACL
+	// DialTimeout specifies timeout of connecting destination, if zero
+	// DefaultTimeout is used.
+	DialTimeout time.Duration
+	// IdleTimeout specifies how long CONNECT tunnel may have no traffic in
+	// either direction before it's closed, if zero DefaultProxyIdleTimeout
+	// is used.
+	IdleTimeout time.Duration
+	// Transport is used to forward plain HTTP requests, if nil
+	// NewForwardingTransport is used. Destinations are dialed by the proxy,
+	// Proxy and DialContext of the transport are ignored.
+	Transport *http.Transport
+	// Upstream is proxy destinations are connected through, if nil
+	// destinations are connected directly. Destinations connected through
+	// the proxy are resolved by the proxy, Destinations rules are checked
+	// before name resolution.
+	Upstream *Upstream
+}
+
+// ForwardingProxy is forward proxy of httpconnect tunnels, it handles CONNECT
+// requests and plain HTTP requests with absolute URLs, destinations are
+// connected from the client network.
 type ForwardingProxy struct {
-	// localAddr specifies default TCP address of the local server.
-	localAddr string
-	// localAddrMap specifies mapping from ControlMessage.ForwardedHost to
-	// local server address, keys may contain host and port, only host or
-	// only port. The order of precedence is the following
-	// * host and port
-	// * port
-	// * host
-	localAddrMap map[string]string
+	// config specifies default forward proxy configuration.
+	config *ForwardingConfig
+	// configMap specifies mapping from ControlMessage.ForwardedHost to
+	// forward proxy configuration, keys may contain host and port, only
+	// host or only port. The order of precedence is the same as in
+	// TCPProxy.
+	configMap map[string]*ForwardingConfig
 	// logger is the proxy logger.
-	logger              log.Logger
-	AuthUser            string
-	AuthPass            string
-	ForwardingHTTPProxy *httputil.ReverseProxy
-	DestDialTimeout     time.Duration
-	DestReadTimeout     time.Duration
-	DestWriteTimeout    time.Duration
-	ClientReadTimeout   time.Duration
-	ClientWriteTimeout  time.Duration
-}
-
-// NewForwardingProxy creates new direct TCPProxy, everything will be proxied to
-// localAddr.
-func NewForwardingProxy(localAddr string, logger log.Logger) *ForwardingProxy {
+	logger log.Logger
+
+	transports   map[*ForwardingConfig]*http.Transport
+	transportsMu sync.Mutex
+}
+
+// NewForwardingProxy creates new ForwardingProxy, all tunnels share config.
+func NewForwardingProxy(config *ForwardingConfig, logger log.Logger) *ForwardingProxy {
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
 
 	return &ForwardingProxy{
-		localAddr: localAddr,
-		logger:    logger,
+		config:     config,
+		logger:     logger,
+		transports: make(map[*ForwardingConfig]*http.Transport),
 	}
 }
 
-// NewMultiForwardingProxy creates a new dispatching TCPProxy, connections may go to
-// different backends based on localAddrMap.
-func NewMultiForwardingProxy(localAddrMap map[string]string, logger log.Logger) *ForwardingProxy {
+// NewMultiForwardingProxy creates new ForwardingProxy, tunnels may have
+// different configuration based on configMap.
+func NewMultiForwardingProxy(configMap map[string]*ForwardingConfig, logger log.Logger) *ForwardingProxy {
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
 
 	return &ForwardingProxy{
-		localAddrMap:        localAddrMap,
-		logger:              logger,
-		ForwardingHTTPProxy: NewReverseProxy(),
-		AuthUser:            "",
-		AuthPass:            "",
-		DestDialTimeout:     10 * time.Second,
-		DestReadTimeout:     5 * time.Second,
-		DestWriteTimeout:    5 * time.Second,
-		ClientReadTimeout:   5 * time.Second,
-		ClientWriteTimeout:  5 * time.Second,
+		configMap:  configMap,
+		logger:     logger,
+		transports: make(map[*ForwardingConfig]*http.Transport),
 	}
 }
 
+// NewForwardingTransport returns transport used to forward plain HTTP
+// requests by default.
+func NewForwardingTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	return t
+}
+
 // Proxy is a ProxyFunc.
 func (p *ForwardingProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage) {
 	switch msg.ForwardedProto {
@@ -83,19 +110,23 @@ func (p *ForwardingProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.Control
 			"msg", "unsupported protocol",
 			"ctrlMsg", msg,
 		)
+		ReportProxyError(w, proto.ProxyErrorUnsupportedProtocol)
 		return
 	}
 
-	rw, ok := w.(http.ResponseWriter)
-	if !ok {
+	config := p.configFor(msg.ForwardedHost)
+	if config == nil {
 		p.logger.Log(
-			"level", 0,
-			"msg", "expected http.ResponseWriter",
+			"level", 1,
+			"msg", "no target",
 			"ctrlMsg", msg,
 		)
+		ReportProxyError(w, proto.ProxyErrorNoRoute)
+		return
 	}
 
-	req, err := http.ReadRequest(bufio.NewReader(r))
+	br := bufio.NewReader(r)
+	req, err := http.ReadRequest(br)
 	if err != nil {
 		p.logger.Log(
 			"level", 0,
@@ -105,84 +136,364 @@ func (p *ForwardingProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.Control
 		)
 		return
 	}
-	setXForwardedFor(req.Header, msg.RemoteAddr)
-	req.URL.Host = msg.ForwardedHost
+	req.RemoteAddr = msg.RemoteAddr
 
-	p.ServeHTTP(rw, req, r)
+	user, ok := p.authenticate(config, req)
+	if !ok {
+		p.logger.Log(
+			"level", 1,
+			"action", "proxy auth failed",
+			"ctrlMsg", msg,
+			"user", user,
+		)
+		h := http.Header{}
+		h.Set("Proxy-Authenticate", "Basic realm=\"User Visible Realm\"")
+		writeProxyResponse(w, http.StatusProxyAuthRequired, h)
+		return
+	}
 
+	switch {
+	case req.Method == http.MethodConnect:
+		p.connect(w, r, br, req, msg, config, user)
+	case req.URL.Scheme == "http" && req.URL.Host != "":
+		p.forward(w, req, msg, config, user)
+	default:
+		p.logger.Log(
+			"level", 1,
+			"msg", "unsupported request",
+			"ctrlMsg", msg,
+			"method", req.Method,
+			"url", req.URL,
+		)
+		writeProxyResponse(w, http.StatusMethodNotAllowed, nil)
+	}
 }
 
-func (p *ForwardingProxy) ServeHTTP(w http.ResponseWriter, r *http.Request, rr io.ReadCloser) {
-	p.logger.Log("Incoming request host", r.Host)
-	if p.AuthUser != "" && p.AuthPass != "" {
-		user, pass, ok := parseBasicProxyAuth(r.Header.Get("Proxy-Authorization"))
-		if !ok || user != p.AuthUser || pass != p.AuthPass {
-			//p.Logger.Warn("Authorization attempt with invalid credentials")
-			http.Error(w, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
-			return
-		}
+func (p *ForwardingProxy) configFor(hostPort string) *ForwardingConfig {
+	if len(p.configMap) == 0 {
+		return p.config
 	}
-	if r.URL.Scheme == "http" {
-		p.ForwardingHTTPProxy.ServeHTTP(w, r)
-	} else {
-		p.handleTunneling(w, r, rr)
+
+	for _, k := range forwardedHostKeys(hostPort) {
+		if c := p.configMap[k]; c != nil {
+			return c
+		}
 	}
+
+	return p.config
 }
 
-func (p *ForwardingProxy) handleTunneling(w http.ResponseWriter, r *http.Request, rr io.ReadCloser) {
-	if r.Method != http.MethodConnect {
-		//p.Logger.Info("Method not allowed", zap.String("method", r.Method))
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-		return
+// authenticate checks Proxy-Authorization credentials, it returns user name
+// found in the header.
+func (p *ForwardingProxy) authenticate(config *ForwardingConfig, r *http.Request) (string, bool) {
+	if len(config.Users) == 0 {
+		return "", true
 	}
 
-	//p.Logger.Debug("Connecting", zap.String("host", r.Host))
+	user, password, ok := parseBasicProxyAuth(r.Header.Get("Proxy-Authorization"))
+	if !ok {
+		return "", false
+	}
+	hash, ok := config.Users[user]
+	return user, ok && checkPassword(hash, password)
+}
 
-	destConn, err := net.DialTimeout("tcp", r.Host, p.DestDialTimeout)
+// connect handles CONNECT request, r is the stream and br is the buffered
+// reader the request was read from.
+func (p *ForwardingProxy) connect(w io.Writer, r io.Closer, br *bufio.Reader, req *http.Request, msg *proto.ControlMessage, config *ForwardingConfig, user string) {
+	target, upstream, err := p.checkDestination(config, msg, user, req.Host)
 	if err != nil {
-		//p.Logger.Error("Destination dial failed", zap.Error(err))
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		ReportProxyError(w, destinationErrorCode(err))
 		return
 	}
 
-	now := time.Now()
-	destConn.SetReadDeadline(now.Add(p.DestReadTimeout))
-	destConn.SetWriteDeadline(now.Add(p.DestWriteTimeout))
-
-	//p.Logger.Debug("Connected", zap.String("host", r.Host))
-	fmt.Println("Connected to host", r.Host)
-
-	resp := http.Response{}
-	resp.StatusCode = 200
-	resp.Proto = "HTTP/1.1"
-	resp.ProtoMajor = 1
-	resp.ProtoMinor = 1
+	var conn net.Conn
+	if upstream != nil {
+		conn, err = upstream.dial(context.Background(), target, dialTimeout(config))
+	} else {
+		conn, err = net.DialTimeout("tcp", target, dialTimeout(config))
+	}
+	if err != nil {
+		p.logger.Log(
+			"level", 0,
+			"msg", "dial failed",
+			"target", target,
+			"ctrlMsg", msg,
+			"err", err,
+		)
+		ReportProxyError(w, proxyErrorCode(err))
+		return
+	}
+	defer conn.Close()
 
-	resp.Write(w)
+	// connection to upstream proxy has keepalive set by Upstream
+	if upstream == nil {
+		if err := keepalive.SetDefaultKeepAlive(conn); err != nil {
+			p.logger.Log(
+				"level", 1,
+				"msg", "TCP keepalive for tunneled connection failed",
+				"target", target,
+				"ctrlMsg", msg,
+				"err", err,
+			)
+		}
+	}
 
-	w.(http.Flusher).Flush()
+	fw := flushWriter{w}
+	if _, err := io.WriteString(fw, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
 
-	fmt.Println("Flushed to host", r.Host)
+	idleTimeout := config.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = DefaultProxyIdleTimeout
+	}
+	dst := &idleConn{Conn: conn, timeout: idleTimeout}
 
 	done := make(chan struct{})
 	go func() {
-		transfer(flushWriter{w}, destConn, log.NewContext(p.logger).With(
-			// "dst", msg.ForwardedHost,
-			"src", r.Host,
+		transfer(fw, dst, log.NewContext(p.logger).With(
+			"dst", msg.ForwardedHost,
+			"src", target,
 		))
+		// unblock reading from the stream if destination is done
+		r.Close()
 		close(done)
 	}()
 
-	transfer(destConn, rr, log.NewContext(p.logger).With(
-		"dst", r.Host,
-		// "src", msg.ForwardedHost,
+	transfer(dst, br, log.NewContext(p.logger).With(
+		"dst", target,
+		"src", msg.ForwardedHost,
 	))
+	if c, ok := conn.(*net.TCPConn); ok {
+		c.CloseWrite()
+	}
 
 	<-done
 
-	fmt.Println("Done for", r.Host)
-	destConn.Close()
-	rr.Close()
+	p.logger.Log(
+		"level", 2,
+		"action", "connect done",
+		"ctrlMsg", msg,
+		"target", target,
+	)
+}
+
+// forward sends plain HTTP request to destination, the stream is closed after
+// the response.
+func (p *ForwardingProxy) forward(w io.Writer, req *http.Request, msg *proto.ControlMessage, config *ForwardingConfig, user string) {
+	dst := req.URL.Host
+	if _, _, err := net.SplitHostPort(dst); err != nil {
+		dst = net.JoinHostPort(dst, "80")
+	}
+	target, upstream, err := p.checkDestination(config, msg, user, dst)
+	if err != nil {
+		ReportProxyError(w, destinationErrorCode(err))
+		return
+	}
+
+	ctx := req.Context()
+	if upstream != nil {
+		ctx = context.WithValue(ctx, upstreamKey{}, upstream.url)
+	} else {
+		ctx = context.WithValue(ctx, forwardTargetKey{}, target)
+	}
+	out := req.WithContext(ctx)
+	out.RequestURI = ""
+	removeHopHeaders(out.Header)
+	setXForwardedFor(out.Header, msg.RemoteAddr)
+
+	resp, err := p.transportFor(config).RoundTrip(out)
+	if err != nil {
+		p.logger.Log(
+			"level", 0,
+			"msg", "forward failed",
+			"target", target,
+			"ctrlMsg", msg,
+			"err", err,
+		)
+		ReportProxyError(w, proxyErrorCode(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	resp.Close = true
+	if err := resp.Write(flushWriter{w}); err != nil {
+		p.logger.Log(
+			"level", 2,
+			"msg", "copy error",
+			"ctrlMsg", msg,
+			"err", err,
+		)
+	}
+
+	p.logger.Log(
+		"level", 2,
+		"action", "forward done",
+		"ctrlMsg", msg,
+		"target", target,
+		"status", resp.StatusCode,
+	)
+}
+
+// transportFor returns transport of config dialing resolved destinations.
+func (p *ForwardingProxy) transportFor(config *ForwardingConfig) *http.Transport {
+	p.transportsMu.Lock()
+	defer p.transportsMu.Unlock()
+
+	t, ok := p.transports[config]
+	if !ok {
+		if config.Transport != nil {
+			t = config.Transport.Clone()
+		} else {
+			t = NewForwardingTransport()
+		}
+		t.Proxy = func(r *http.Request) (*url.URL, error) {
+			u, _ := r.Context().Value(upstreamKey{}).(*url.URL)
+			return u, nil
+		}
+		d := &net.Dialer{Timeout: dialTimeout(config)}
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if target, ok := ctx.Value(forwardTargetKey{}).(string); ok {
+				addr = target
+			}
+			return d.DialContext(ctx, network, addr)
+		}
+		p.transports[config] = t
+	}
+	return t
+}
+
+// checkDestination checks dst against destinations of the tunnel and
+// selects route to it. Destinations connected directly are resolved, the
+// returned address is the resolved one. If upstream is not nil dst shall be
+// connected through it. Every decision is logged.
+func (p *ForwardingProxy) checkDestination(config *ForwardingConfig, msg *proto.ControlMessage, user, dst string) (target string, upstream *Upstream, err error) {
+	route := "direct"
+	if config.Upstream.direct(dst) {
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout(config))
+		target, err = config.Destinations.resolve(ctx, dst, true)
+		cancel()
+	} else {
+		route = config.Upstream.String()
+		upstream = config.Upstream
+		target, err = dst, config.Destinations.check(dst, true)
+	}
+
+	if err != nil {
+		p.logger.Log(
+			"level", 1,
+			"action", "connect denied",
+			"tunnel", msg.ForwardedHost,
+			"remoteAddr", msg.RemoteAddr,
+			"user", user,
+			"dst", dst,
+			"route", route,
+			"err", err,
+		)
+		return "", nil, err
+	}
+
+	p.logger.Log(
+		"level", 1,
+		"action", "connect allowed",
+		"tunnel", msg.ForwardedHost,
+		"remoteAddr", msg.RemoteAddr,
+		"user", user,
+		"dst", dst,
+		"route", route,
+		"target", target,
+	)
+	return target, upstream, nil
+}
+
+func dialTimeout(config *ForwardingConfig) time.Duration {
+	if config.DialTimeout == 0 {
+		return DefaultTimeout
+	}
+	return config.DialTimeout
+}
+
+// destinationErrorCode classifies error of checkDestination.
+func destinationErrorCode(err error) string {
+	if errors.Is(err, ErrDestinationDenied) {
+		return proto.ProxyErrorForbidden
+	}
+	return proxyErrorCode(err)
+}
+
+// upstreamKey is context key of upstream proxy URL plain HTTP requests are
+// sent through.
+type upstreamKey struct{}
+
+// forwardTargetKey is context key of address plain HTTP requests are sent
+// to, it's the destination address resolved by checkDestination.
+type forwardTargetKey struct{}
+
+// idleConn is connection closed if there is no traffic in either direction
+// for timeout.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+// writeProxyResponse writes response with status text body to the user, the
+// user connection is closed after the response.
+func writeProxyResponse(w io.Writer, status int, h http.Header) error {
+	if h == nil {
+		h = http.Header{}
+	}
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+
+	body := http.StatusText(status) + "\n"
+	resp := &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+	}
+	return resp.Write(flushWriter{w})
+}
+
+// hopHeaders are removed from forwarded requests and responses, see
+// RFC 7230 section 6.1.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, f := range h.Values("Connection") {
+		for _, k := range strings.Split(f, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				h.Del(k)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
 }
 
 // parseBasicProxyAuth parses an HTTP Basic Authorization string.
@@ -203,22 +514,3 @@ func parseBasicProxyAuth(authz string) (username, password string, ok bool) {
 	}
 	return cs[:s], cs[s+1:], true
 }
-
-// NewReverseProxy retuns a new reverse proxy that takes an incoming
-// request and sends it to another server, proxying the response back to the
-// client.
-//
-// See: https://golang.org/pkg/net/http/httputil/#ReverseProxy
-func NewReverseProxy() *httputil.ReverseProxy {
-	director := func(req *http.Request) {
-		if _, ok := req.Header["User-Agent"]; !ok {
-			// explicitly disable User-Agent so it's not set to default value
-			req.Header.Set("User-Agent", "")
-		}
-	}
-	// TODO:(alesr) Use timeouts specified via flags to customize the default
-	// transport used by the reverse proxy.
-	return &httputil.ReverseProxy{
-		Director: director,
-	}
-}
@@ -0,0 +1,201 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestForwardingProxy_Destinations(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	acl := func(allow, deny []string) *DestinationACL {
+		a, err := NewDestinationACL(allow, deny)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+
+	tests := []struct {
+		acl    *DestinationACL
+		status int
+	}{
+		{nil, http.StatusForbidden},
+		{acl([]string{"*"}, nil), http.StatusForbidden},
+		{acl([]string{"127.0.0.0/8"}, nil), http.StatusOK},
+		{acl([]string{"127.0.0.1:" + port}, nil), http.StatusOK},
+		{acl([]string{"127.0.0.1:1-1023"}, nil), http.StatusForbidden},
+		{acl([]string{"127.0.0.1"}, []string{"*:" + port}), http.StatusForbidden},
+	}
+
+	for i, tt := range tests {
+		p := NewMultiForwardingProxy(map[string]*ForwardingConfig{
+			"0.0.0.0:1080": {Destinations: tt.acl},
+		}, nil)
+
+		w := httptest.NewRecorder()
+		r := io.NopCloser(strings.NewReader("CONNECT 127.0.0.1:" + port + " HTTP/1.1\r\nHost: 127.0.0.1:" + port + "\r\n\r\n"))
+		p.Proxy(w, r, &proto.ControlMessage{
+			Action:         proto.ActionProxy,
+			ForwardedProto: proto.HTTPCONNECT,
+			ForwardedHost:  "[::]:1080",
+			RemoteAddr:     "192.0.2.1:5678",
+		})
+
+		if tt.status == http.StatusOK {
+			if !strings.HasPrefix(w.Body.String(), "HTTP/1.1 200") {
+				t.Errorf("%d expected connection established, got %d %q", i, w.Code, w.Body)
+			}
+		} else if w.Code != tt.status || w.Header().Get(proto.HeaderProxyError) != proto.ProxyErrorForbidden {
+			t.Errorf("%d expected forbidden, got %d %q", i, w.Code, w.Header())
+		}
+	}
+}
+
+func TestForwardingProxy_Auth(t *testing.T) {
+	t.Parallel()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" || r.Header.Get("Proxy-Connection") != "" {
+			t.Error("hop-by-hop headers forwarded")
+		}
+		io.WriteString(w, "hello")
+	}))
+	defer s.Close()
+
+	acl, err := NewDestinationACL([]string{"127.0.0.1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewForwardingProxy(&ForwardingConfig{
+		Users:        map[string]string{"user": string(hash)},
+		Destinations: acl,
+	}, nil)
+
+	tests := []struct {
+		auth   string
+		status int
+	}{
+		{"", http.StatusProxyAuthRequired},
+		{"Basic " + base64.StdEncoding.EncodeToString([]byte("user:wrong")), http.StatusProxyAuthRequired},
+		{"Basic " + base64.StdEncoding.EncodeToString([]byte("other:secret")), http.StatusProxyAuthRequired},
+		{"Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret")), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req := "GET " + s.URL + "/ HTTP/1.1\r\nHost: " + s.Listener.Addr().String() + "\r\nProxy-Connection: keep-alive\r\n"
+		if tt.auth != "" {
+			req += "Proxy-Authorization: " + tt.auth + "\r\n"
+		}
+		req += "\r\n"
+
+		w := httptest.NewRecorder()
+		p.Proxy(w, io.NopCloser(strings.NewReader(req)), &proto.ControlMessage{
+			Action:         proto.ActionProxy,
+			ForwardedProto: proto.HTTPCONNECT,
+			ForwardedHost:  "[::]:1080",
+			RemoteAddr:     "192.0.2.1:5678",
+		})
+
+		resp, err := http.ReadResponse(bufio.NewReader(w.Body), nil)
+		if err != nil {
+			t.Fatal(tt.auth, err)
+		}
+		if resp.StatusCode != tt.status {
+			t.Errorf("%q expected status %d got %d", tt.auth, tt.status, resp.StatusCode)
+		}
+		if tt.status == http.StatusProxyAuthRequired && !strings.HasPrefix(resp.Header.Get("Proxy-Authenticate"), "Basic ") {
+			t.Errorf("%q missing challenge", tt.auth)
+		}
+		if tt.status == http.StatusOK {
+			b, _ := io.ReadAll(resp.Body)
+			if string(b) != "hello" {
+				t.Errorf("unexpected body %q", b)
+			}
+		}
+	}
+}
+
+func TestForwardingProxy_IdleTimeout(t *testing.T) {
+	t.Parallel()
+
+	// destination accepts connection and never responds
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	acl, err := NewDestinationACL([]string{"127.0.0.1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewForwardingProxy(&ForwardingConfig{
+		Destinations: acl,
+		IdleTimeout:  100 * time.Millisecond,
+	}, nil)
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go io.WriteString(pw, "CONNECT "+l.Addr().String()+" HTTP/1.1\r\nHost: "+l.Addr().String()+"\r\n\r\n")
+
+	done := make(chan struct{})
+	go func() {
+		p.Proxy(httptest.NewRecorder(), pr, &proto.ControlMessage{
+			Action:         proto.ActionProxy,
+			ForwardedProto: proto.HTTPCONNECT,
+			ForwardedHost:  "[::]:1080",
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle connection not closed")
+	}
+}
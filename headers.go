@@ -0,0 +1,179 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// HeaderData is passed to header value templates.
+type HeaderData struct {
+	// ClientIP is IP address of the user.
+	ClientIP string
+	// Tunnel is the tunnel name.
+	Tunnel string
+}
+
+// HeaderRewriter applies proto.HeaderRules of a tunnel. Setting Host
+// request header changes request host. A nil HeaderRewriter does nothing.
+type HeaderRewriter struct {
+	tunnel   string
+	request  *headerRule
+	response *headerRule
+}
+
+type headerRule struct {
+	remove []string
+	set    []headerValue
+	add    []headerValue
+}
+
+type headerValue struct {
+	name  string
+	value string
+	tmpl  *template.Template
+}
+
+// NewHeaderRewriter compiles rules of a tunnel, it returns nil if there are
+// no rules.
+func NewHeaderRewriter(tunnel string, rules *proto.HeaderRules) (*HeaderRewriter, error) {
+	if rules == nil || (rules.Request == nil && rules.Response == nil) {
+		return nil, nil
+	}
+
+	h := &HeaderRewriter{tunnel: tunnel}
+
+	var err error
+	if h.request, err = newHeaderRule(rules.Request); err != nil {
+		return nil, fmt.Errorf("request headers: %s", err)
+	}
+	if h.response, err = newHeaderRule(rules.Response); err != nil {
+		return nil, fmt.Errorf("response headers: %s", err)
+	}
+
+	return h, nil
+}
+
+func newHeaderRule(r *proto.HeaderRule) (*headerRule, error) {
+	if r == nil {
+		return nil, nil
+	}
+
+	rule := &headerRule{}
+	for _, name := range r.Remove {
+		if err := validHeaderName(name); err != nil {
+			return nil, err
+		}
+		rule.remove = append(rule.remove, http.CanonicalHeaderKey(name))
+	}
+
+	var err error
+	if rule.set, err = newHeaderValues(r.Set); err != nil {
+		return nil, err
+	}
+	if rule.add, err = newHeaderValues(r.Add); err != nil {
+		return nil, err
+	}
+
+	return rule, nil
+}
+
+func newHeaderValues(m map[string]string) ([]headerValue, error) {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	v := make([]headerValue, 0, len(m))
+	for _, name := range names {
+		if err := validHeaderName(name); err != nil {
+			return nil, err
+		}
+		hv := headerValue{
+			name:  http.CanonicalHeaderKey(name),
+			value: m[name],
+		}
+		if strings.Contains(hv.value, "{{") {
+			t, err := template.New(name).Option("missingkey=error").Parse(hv.value)
+			if err != nil {
+				return nil, fmt.Errorf("header %s: %s", name, err)
+			}
+			if err := t.Execute(ioutil.Discard, &HeaderData{}); err != nil {
+				return nil, fmt.Errorf("header %s: %s", name, err)
+			}
+			hv.tmpl = t
+		}
+		v = append(v, hv)
+	}
+
+	return v, nil
+}
+
+func validHeaderName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty header name")
+	}
+	for _, c := range name {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune("()<>@,;:\\\"/[]?={}", c) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	return nil
+}
+
+// RewriteRequest applies request rules to r.
+func (h *HeaderRewriter) RewriteRequest(r *http.Request, clientIP string) {
+	if h == nil || h.request == nil {
+		return
+	}
+
+	d := &HeaderData{ClientIP: clientIP, Tunnel: h.tunnel}
+	h.request.apply(r.Header, d)
+	if host := r.Header.Get("Host"); host != "" {
+		r.Host = host
+		r.Header.Del("Host")
+	}
+}
+
+// RewriteResponse applies response rules to header.
+func (h *HeaderRewriter) RewriteResponse(header http.Header, clientIP string) {
+	if h == nil || h.response == nil {
+		return
+	}
+
+	h.response.apply(header, &HeaderData{ClientIP: clientIP, Tunnel: h.tunnel})
+}
+
+func (r *headerRule) apply(header http.Header, d *HeaderData) {
+	for _, name := range r.remove {
+		header.Del(name)
+	}
+	for _, v := range r.set {
+		header.Set(v.name, v.execute(d))
+	}
+	for _, v := range r.add {
+		header.Add(v.name, v.execute(d))
+	}
+}
+
+func (v *headerValue) execute(d *HeaderData) string {
+	if v.tmpl == nil {
+		return v.value
+	}
+
+	var b strings.Builder
+	if err := v.tmpl.Execute(&b, d); err != nil {
+		return ""
+	}
+	return b.String()
+}
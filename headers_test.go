@@ -0,0 +1,91 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+func TestHeaderRewriter(t *testing.T) {
+	t.Parallel()
+
+	h, err := NewHeaderRewriter("web", &proto.HeaderRules{
+		Request: &proto.HeaderRule{
+			Set:    map[string]string{"host": "backend.local", "X-Real-IP": "{{.ClientIP}}"},
+			Add:    map[string]string{"X-Tunnel": "{{.Tunnel}}"},
+			Remove: []string{"cookie"},
+		},
+		Response: &proto.HeaderRule{
+			Set:    map[string]string{"Strict-Transport-Security": "max-age=63072000"},
+			Remove: []string{"Server"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+	r.Header.Set("Cookie", "a=b")
+	r.Header.Set("X-Tunnel", "prior")
+	h.RewriteRequest(r, "1.2.3.4")
+
+	if r.Host != "backend.local" || r.Header.Get("Host") != "" {
+		t.Errorf("unexpected host %q", r.Host)
+	}
+	if r.Header.Get("Cookie") != "" {
+		t.Error("cookie not removed")
+	}
+	if r.Header.Get("X-Real-Ip") != "1.2.3.4" {
+		t.Errorf("unexpected X-Real-IP %q", r.Header.Get("X-Real-Ip"))
+	}
+	if v := r.Header["X-Tunnel"]; len(v) != 2 || v[1] != "web" {
+		t.Errorf("unexpected X-Tunnel %q", v)
+	}
+
+	resp := http.Header{"Server": {"nginx"}}
+	h.RewriteResponse(resp, "1.2.3.4")
+	if resp.Get("Server") != "" || resp.Get("Strict-Transport-Security") != "max-age=63072000" {
+		t.Errorf("unexpected response headers %v", resp)
+	}
+
+	var nop *HeaderRewriter
+	nop.RewriteRequest(r, "")
+	nop.RewriteResponse(resp, "")
+}
+
+func TestNewHeaderRewriterErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, rule := range []*proto.HeaderRule{
+		{Set: map[string]string{"X-Foo": "{{.Unknown}}"}},
+		{Set: map[string]string{"X-Foo": "{{.ClientIP"}},
+		{Add: map[string]string{"Bad Name": "x"}},
+		{Remove: []string{""}},
+	} {
+		if _, err := NewHeaderRewriter("web", &proto.HeaderRules{Request: rule}); err == nil {
+			t.Errorf("expected error for %+v", rule)
+		}
+	}
+
+	if h, err := NewHeaderRewriter("web", &proto.HeaderRules{}); h != nil || err != nil {
+		t.Error("expected nil rewriter")
+	}
+}
+
+func TestLastForwardedFor(t *testing.T) {
+	t.Parallel()
+
+	h := http.Header{"X-Forwarded-For": {"10.0.0.1", "10.0.0.2, 1.2.3.4"}}
+	if v := lastForwardedFor(h); v != "1.2.3.4" {
+		t.Errorf("unexpected %q", v)
+	}
+	if v := lastForwardedFor(http.Header{}); v != "" {
+		t.Errorf("unexpected %q", v)
+	}
+}
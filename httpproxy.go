@@ -7,17 +7,26 @@ package tunnel
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"path"
+	"strings"
 
 	"github.com/mmatczuk/go-http-tunnel/log"
 	"github.com/mmatczuk/go-http-tunnel/proto"
+	"github.com/mmatczuk/go-http-tunnel/trace"
+	"golang.org/x/net/http2"
 )
 
+// schemeH2C is URL scheme of local services speaking HTTP/2 without TLS
+// (prior knowledge), i.e. gRPC servers.
+const schemeH2C = "h2c"
+
 // HTTPProxy forwards HTTP traffic.
 type HTTPProxy struct {
 	httputil.ReverseProxy
@@ -32,6 +41,13 @@ type HTTPProxy struct {
 	localURLMap map[string]*url.URL
 	// logger is the proxy logger.
 	logger log.Logger
+	// Tracer if not nil traces proxied requests and requests to local
+	// services.
+	Tracer *trace.Tracer
+	// Headers maps ControlMessage.ForwardedHost to header rewriting rules
+	// applied to requests to local services and their responses, keys are
+	// matched like in localURLMap.
+	Headers map[string]*HeaderRewriter
 }
 
 // NewHTTPProxy creates a new direct HTTPProxy, everything will be proxied to
@@ -46,6 +62,9 @@ func NewHTTPProxy(localURL *url.URL, logger log.Logger) *HTTPProxy {
 		logger:   logger,
 	}
 	p.ReverseProxy.Director = p.Director
+	p.ReverseProxy.ModifyResponse = p.modifyResponse
+	p.ReverseProxy.ErrorHandler = p.errorHandler
+	p.ReverseProxy.Transport = newLocalTransport()
 
 	return p
 }
@@ -62,6 +81,9 @@ func NewMultiHTTPProxy(localURLMap map[string]*url.URL, logger log.Logger) *HTTP
 		logger:      logger,
 	}
 	p.ReverseProxy.Director = p.Director
+	p.ReverseProxy.ModifyResponse = p.modifyResponse
+	p.ReverseProxy.ErrorHandler = p.errorHandler
+	p.ReverseProxy.Transport = newLocalTransport()
 
 	return p
 }
@@ -77,6 +99,7 @@ func (p *HTTPProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessag
 			"msg", "unsupported protocol",
 			"ctrlMsg", msg,
 		)
+		ReportProxyError(w, proto.ProxyErrorUnsupportedProtocol)
 		return
 	}
 
@@ -89,7 +112,13 @@ func (p *HTTPProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessag
 		)
 	}
 
-	req, err := http.ReadRequest(bufio.NewReader(r))
+	parent := parentSpan(msg.Traceparent)
+	ctx, span := p.Tracer.Start(trace.ContextWithRemote(context.Background(), parent),
+		"HTTPProxy.Proxy", trace.KindInternal)
+	defer span.End()
+
+	br := bufio.NewReader(r)
+	req, err := http.ReadRequest(br)
 	if err != nil {
 		p.logger.Log(
 			"level", 0,
@@ -97,13 +126,62 @@ func (p *HTTPProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessag
 			"ctrlMsg", msg,
 			"err", err,
 		)
+		span.SetError(err)
 		return
 	}
 
+	// server appends user IP to X-Forwarded-For
+	clientIP := lastForwardedFor(req.Header)
 	setXForwardedFor(req.Header, msg.RemoteAddr)
 	req.URL.Host = msg.ForwardedHost
 
-	p.ServeHTTP(rw, req)
+	if p.localURLFor(req.URL) == nil {
+		p.logger.Log(
+			"level", 1,
+			"msg", "no target",
+			"ctrlMsg", msg,
+		)
+		ReportProxyError(w, proto.ProxyErrorNoRoute)
+		span.SetError(fmt.Errorf("no target for %s", msg.ForwardedHost))
+		return
+	}
+
+	_, upstream := p.Tracer.Start(ctx, "HTTP "+req.Method, trace.KindClient,
+		trace.Attribute{Key: "http.method", Value: req.Method},
+		trace.Attribute{Key: "http.host", Value: req.Host},
+		trace.Attribute{Key: "http.target", Value: req.URL.RequestURI()},
+	)
+	if upstream != nil {
+		trace.Inject(req.Header, upstream.Context())
+	} else {
+		trace.Inject(req.Header, parent)
+	}
+
+	if h := p.headersFor(req.URL); h != nil {
+		ctx = context.WithValue(ctx, headersContextKey{}, &headersContext{h, clientIP})
+	}
+
+	if upgradeType(req.Header) != "" {
+		rw = &upgradeWriter{ResponseWriter: rw, br: br, body: r}
+	}
+
+	sw := &accessLogWriter{ResponseWriter: rw}
+	p.ServeHTTP(sw, req.WithContext(ctx))
+
+	upstream.SetHTTPStatus(sw.status)
+	upstream.End()
+}
+
+// errorHandler reports failure to reach local service back to server.
+func (p *HTTPProxy) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	p.logger.Log(
+		"level", 0,
+		"msg", "proxy error",
+		"url", r.URL,
+		"err", err,
+	)
+
+	ReportProxyError(w, proxyErrorCode(err))
 }
 
 // Director is ReverseProxy Director it changes request URL so that the request
@@ -143,6 +221,10 @@ func (p *HTTPProxy) Director(req *http.Request) {
 
 	req.Host = req.URL.Host
 
+	if hc, ok := req.Context().Value(headersContextKey{}).(*headersContext); ok {
+		hc.rewriter.RewriteRequest(req, hc.clientIP)
+	}
+
 	p.logger.Log(
 		"level", 2,
 		"action", "url rewrite",
@@ -151,6 +233,55 @@ func (p *HTTPProxy) Director(req *http.Request) {
 	)
 }
 
+// modifyResponse applies response header rules and removes proxy error
+// header, only ReportProxyError may set it so that local service can not make
+// server serve its error pages.
+func (p *HTTPProxy) modifyResponse(resp *http.Response) error {
+	if hc, ok := resp.Request.Context().Value(headersContextKey{}).(*headersContext); ok {
+		hc.rewriter.RewriteResponse(resp.Header, hc.clientIP)
+	}
+	resp.Header.Del(proto.HeaderProxyError)
+	return nil
+}
+
+// localTransport sends requests to local services, requests to h2c URLs
+// are sent over HTTP/2 without TLS, other requests use http.DefaultTransport
+// that negotiates HTTP/2 with https services.
+type localTransport struct {
+	h2c *http2.Transport
+}
+
+func newLocalTransport() *localTransport {
+	return &localTransport{
+		h2c: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		},
+	}
+}
+
+func (t *localTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Scheme != schemeH2C {
+		return http.DefaultTransport.RoundTrip(r)
+	}
+
+	outr := r.WithContext(r.Context())
+	u := *r.URL
+	u.Scheme = proto.HTTP
+	outr.URL = &u
+
+	return t.h2c.RoundTrip(outr)
+}
+
+type headersContextKey struct{}
+
+type headersContext struct {
+	rewriter *HeaderRewriter
+	clientIP string
+}
+
 func singleJoiningSlash(a, b string) string {
 	if a == "" || a == "/" {
 		return b
@@ -186,3 +317,31 @@ func (p *HTTPProxy) localURLFor(u *url.URL) *url.URL {
 
 	return p.localURL
 }
+
+func (p *HTTPProxy) headersFor(u *url.URL) *HeaderRewriter {
+	if len(p.Headers) == 0 {
+		return nil
+	}
+
+	if h := p.Headers[u.Host]; h != nil {
+		return h
+	}
+	host, port, _ := net.SplitHostPort(u.Host)
+	if h := p.Headers[port]; h != nil {
+		return h
+	}
+	return p.Headers[host]
+}
+
+// lastForwardedFor returns the last address in X-Forwarded-For header.
+func lastForwardedFor(h http.Header) string {
+	v := h["X-Forwarded-For"]
+	if len(v) == 0 {
+		return ""
+	}
+	last := v[len(v)-1]
+	if i := strings.LastIndexByte(last, ','); i >= 0 {
+		last = last[i+1:]
+	}
+	return strings.TrimSpace(last)
+}
@@ -11,8 +11,15 @@ import (
 
 var emptyID [32]byte
 
+// TLSConn is a connection secured with TLS, i.e. *tls.Conn or TLS state of a
+// QUIC connection.
+type TLSConn interface {
+	Handshake() error
+	ConnectionState() tls.ConnectionState
+}
+
 // PeerID is modified https://github.com/andrew-d/ptls/blob/b89c7dcc94630a77f225a48befd3710144c7c10e/ptls.go#L81
-func PeerID(conn *tls.Conn) (ID, error) {
+func PeerID(conn TLSConn) (ID, error) {
 	// Try a TLS connection over the given connection. We explicitly perform
 	// the handshake, since we want to maintain the invariant that, if this
 	// function returns successfully, then the connection should be valid
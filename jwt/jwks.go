@@ -0,0 +1,166 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+)
+
+// Key is a single verification key from a JSON Web Key Set.
+type Key struct {
+	// ID is the "kid" of the key, it may be empty.
+	ID string
+	// Algorithm is the "alg" of the key, if empty any algorithm matching
+	// the key type is accepted.
+	Algorithm string
+	// Key is *rsa.PublicKey, *ecdsa.PublicKey or []byte for HMAC keys.
+	Key interface{}
+}
+
+// KeySet is a set of keys used to verify tokens.
+type KeySet struct {
+	Keys []*Key
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	// oct
+	K string `json:"k"`
+}
+
+// LoadKeySet reads JSON Web Key Set from a file.
+func LoadKeySet(file string) (*KeySet, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %q: %s", file, err)
+	}
+
+	ks, err := ParseKeySet(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse file %q: %s", file, err)
+	}
+
+	return ks, nil
+}
+
+// ParseKeySet parses JSON Web Key Set as defined in RFC 7517, keys with
+// unsupported types or with use other than "sig" are skipped.
+func ParseKeySet(b []byte) (*KeySet, error) {
+	var v struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+
+	ks := &KeySet{}
+	for i, k := range v.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %s", i, err)
+		}
+		if key == nil {
+			continue
+		}
+
+		ks.Keys = append(ks.Keys, &Key{
+			ID:        k.Kid,
+			Algorithm: k.Alg,
+			Key:       key,
+		})
+	}
+
+	if len(ks.Keys) == 0 {
+		return nil, errors.New("no usable keys")
+	}
+
+	return ks, nil
+}
+
+func (k *jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("n: %s", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("e: %s", err)
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("e: too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("x: %s", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("y: %s", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "oct":
+		b, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil {
+			return nil, fmt.Errorf("k: %s", err)
+		}
+		if len(b) == 0 {
+			return nil, errors.New("k: empty")
+		}
+		return b, nil
+	default:
+		return nil, nil
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
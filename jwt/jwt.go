@@ -0,0 +1,245 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+// Package jwt implements verification of JSON Web Tokens signed with keys from
+// a JSON Web Key Set, it supports HMAC, RSA and ECDSA signatures.
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	// register hash functions
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// Leeway is the allowed clock skew when validating time based claims.
+var Leeway = time.Minute
+
+// Errors returned by Verify and Claims.Validate.
+var (
+	ErrMalformed        = errors.New("jwt: malformed token")
+	ErrUnsupportedAlg   = errors.New("jwt: unsupported algorithm")
+	ErrNoKey            = errors.New("jwt: no matching key")
+	ErrInvalidSignature = errors.New("jwt: invalid signature")
+	ErrExpired          = errors.New("jwt: token expired")
+	ErrMissingExpiry    = errors.New("jwt: missing exp claim")
+	ErrLifetime         = errors.New("jwt: token lifetime too long")
+	ErrNotValidYet      = errors.New("jwt: token not valid yet")
+	ErrIssuer           = errors.New("jwt: invalid issuer")
+	ErrAudience         = errors.New("jwt: invalid audience")
+)
+
+// Claims are the registered claims, embed it in a struct to decode custom
+// claims.
+type Claims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+}
+
+// Validate checks time based claims against now, and issuer and audience if
+// not empty. The "exp" claim is required.
+func (c *Claims) Validate(issuer, audience string, now time.Time) error {
+	if c.ExpiresAt == 0 {
+		return ErrMissingExpiry
+	}
+	if now.Add(-Leeway).After(time.Unix(c.ExpiresAt, 0)) {
+		return ErrExpired
+	}
+	if c.NotBefore != 0 && now.Add(Leeway).Before(time.Unix(c.NotBefore, 0)) {
+		return ErrNotValidYet
+	}
+	if issuer != "" && c.Issuer != issuer {
+		return ErrIssuer
+	}
+	if audience != "" && !c.Audience.Contains(audience) {
+		return ErrAudience
+	}
+	return nil
+}
+
+// ValidateLifetime returns ErrLifetime if token is valid for longer than max
+// since it was issued, or since now if "iat" claim is missing.
+func (c *Claims) ValidateLifetime(max time.Duration, now time.Time) error {
+	start := now
+	if c.IssuedAt != 0 {
+		start = time.Unix(c.IssuedAt, 0)
+	}
+	if time.Unix(c.ExpiresAt, 0).Sub(start) > max+Leeway {
+		return ErrLifetime
+	}
+	return nil
+}
+
+// Audience is the "aud" claim, it may be a string or an array of strings.
+type Audience []string
+
+// Contains returns true if aud is in the audience.
+func (a Audience) Contains(aud string) bool {
+	for _, v := range a {
+		if v == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (a *Audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = Audience{s}
+		return nil
+	}
+	var v []string
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*a = v
+	return nil
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Verify checks token signature with a key from the set and decodes payload
+// into claims. It does not validate claims.
+func (ks *KeySet) Verify(token string, claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrMalformed
+	}
+
+	hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return ErrMalformed
+	}
+	var h header
+	if err := json.Unmarshal(hb, &h); err != nil {
+		return ErrMalformed
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return ErrMalformed
+	}
+
+	hash, ok := algHash(h.Alg)
+	if !ok {
+		return ErrUnsupportedAlg
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	found := false
+	verified := false
+	for _, k := range ks.Keys {
+		if h.Kid != "" && k.ID != "" && k.ID != h.Kid {
+			continue
+		}
+		if k.Algorithm != "" && k.Algorithm != h.Alg {
+			continue
+		}
+		if !keyMatchesAlg(k.Key, h.Alg) {
+			continue
+		}
+		found = true
+		if verify(k.Key, h.Alg, hash, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !found {
+		return ErrNoKey
+	}
+	if !verified {
+		return ErrInvalidSignature
+	}
+
+	pb, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ErrMalformed
+	}
+	if err := json.Unmarshal(pb, claims); err != nil {
+		return fmt.Errorf("jwt: invalid claims: %s", err)
+	}
+
+	return nil
+}
+
+func algHash(alg string) (crypto.Hash, bool) {
+	if len(alg) != 5 {
+		return 0, false
+	}
+	switch alg[:2] {
+	case "HS", "RS", "PS", "ES":
+	default:
+		return 0, false
+	}
+	switch alg[2:] {
+	case "256":
+		return crypto.SHA256, true
+	case "384":
+		return crypto.SHA384, true
+	case "512":
+		return crypto.SHA512, true
+	}
+	return 0, false
+}
+
+func keyMatchesAlg(key interface{}, alg string) bool {
+	switch key.(type) {
+	case []byte:
+		return alg[:2] == "HS"
+	case *rsa.PublicKey:
+		return alg[:2] == "RS" || alg[:2] == "PS"
+	case *ecdsa.PublicKey:
+		return alg[:2] == "ES"
+	}
+	return false
+}
+
+func verify(key interface{}, alg string, hash crypto.Hash, signed, sig []byte) bool {
+	if k, ok := key.([]byte); ok {
+		m := hmac.New(hash.New, k)
+		m.Write(signed)
+		return hmac.Equal(m.Sum(nil), sig)
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg[:2] == "PS" {
+			return rsa.VerifyPSS(k, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+		}
+		return rsa.VerifyPKCS1v15(k, hash, digest, sig) == nil
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(k, digest, r, s)
+	}
+
+	return false
+}
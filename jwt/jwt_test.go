@@ -0,0 +1,176 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func sign(t *testing.T, alg, kid string, key interface{}, claims interface{}) string {
+	h, _ := json.Marshal(header{Alg: alg, Kid: kid})
+	c, _ := json.Marshal(claims)
+	signed := b64(h) + "." + b64(c)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		m := hmac.New(sha256.New, k)
+		m.Write([]byte(signed))
+		sig = m.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+
+	return signed + "." + b64(sig)
+}
+
+func TestKeySet_Verify(t *testing.T) {
+	t.Parallel()
+
+	secret := []byte("secret")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks := fmt.Sprintf(`{"keys": [
+		{"kty": "oct", "kid": "hmac", "k": %q},
+		{"kty": "RSA", "kid": "rsa", "alg": "RS256", "n": %q, "e": %q},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": %q, "y": %q},
+		{"kty": "EC", "kid": "enc", "use": "enc", "crv": "P-256", "x": %q, "y": %q},
+		{"kty": "OKP", "kid": "unsupported"}
+	]}`,
+		b64(secret),
+		b64(rsaKey.N.Bytes()), b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+		b64(ecKey.X.Bytes()), b64(ecKey.Y.Bytes()),
+		b64(otherKey.X.Bytes()), b64(otherKey.Y.Bytes()),
+	)
+	ks, err := ParseKeySet([]byte(jwks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ks.Keys) != 3 {
+		t.Fatal("expected 3 keys got", len(ks.Keys))
+	}
+
+	claims := map[string]interface{}{"sub": "ci", "aud": []string{"a", "tunnel"}}
+
+	tests := []struct {
+		token string
+		err   error
+	}{
+		{sign(t, "HS256", "hmac", secret, claims), nil},
+		{sign(t, "HS256", "", secret, claims), nil},
+		{sign(t, "RS256", "rsa", rsaKey, claims), nil},
+		{sign(t, "ES256", "ec", ecKey, claims), nil},
+		{sign(t, "ES256", "", ecKey, claims), nil},
+		{sign(t, "HS256", "hmac", []byte("other"), claims), ErrInvalidSignature},
+		{sign(t, "ES256", "enc", otherKey, claims), ErrNoKey},
+		{sign(t, "ES256", "", otherKey, claims), ErrInvalidSignature},
+		{sign(t, "RS256", "ec", rsaKey, claims), ErrNoKey},
+		{sign(t, "none", "", nil, claims), ErrUnsupportedAlg},
+		{"a.b", ErrMalformed},
+	}
+
+	for i, tt := range tests {
+		var c Claims
+		err := ks.Verify(tt.token, &c)
+		if err != tt.err {
+			t.Errorf("[%d] expected error %v got %v", i, tt.err, err)
+			continue
+		}
+		if err == nil && (c.Subject != "ci" || !c.Audience.Contains("tunnel")) {
+			t.Errorf("[%d] unexpected claims %+v", i, c)
+		}
+	}
+}
+
+func TestClaims_Validate(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	exp := now.Add(time.Hour).Unix()
+
+	tests := []struct {
+		claims Claims
+		err    error
+	}{
+		{Claims{}, ErrMissingExpiry},
+		{Claims{ExpiresAt: exp}, nil},
+		{Claims{ExpiresAt: now.Add(-time.Hour).Unix()}, ErrExpired},
+		{Claims{ExpiresAt: exp, NotBefore: now.Add(time.Hour).Unix()}, ErrNotValidYet},
+		{Claims{ExpiresAt: exp, NotBefore: now.Add(30 * time.Second).Unix()}, nil},
+		{Claims{ExpiresAt: exp, Issuer: "iss", Audience: Audience{"aud"}}, nil},
+		{Claims{ExpiresAt: exp, Issuer: "other", Audience: Audience{"aud"}}, ErrIssuer},
+		{Claims{ExpiresAt: exp, Issuer: "iss", Audience: Audience{"other"}}, ErrAudience},
+	}
+
+	for i, tt := range tests {
+		iss, aud := "", ""
+		if tt.claims.Issuer != "" {
+			iss, aud = "iss", "aud"
+		}
+		if err := tt.claims.Validate(iss, aud, now); err != tt.err {
+			t.Errorf("[%d] expected error %v got %v", i, tt.err, err)
+		}
+	}
+
+	lifetime := []struct {
+		claims Claims
+		err    error
+	}{
+		{Claims{ExpiresAt: exp}, nil},
+		{Claims{ExpiresAt: now.Add(48 * time.Hour).Unix()}, ErrLifetime},
+		{Claims{IssuedAt: now.Add(-time.Hour).Unix(), ExpiresAt: now.Add(23 * time.Hour).Unix()}, nil},
+		{Claims{IssuedAt: now.Add(-24 * time.Hour).Unix(), ExpiresAt: exp}, ErrLifetime},
+	}
+	for i, tt := range lifetime {
+		if err := tt.claims.ValidateLifetime(24*time.Hour, now); err != tt.err {
+			t.Errorf("[%d] expected lifetime error %v got %v", i, tt.err, err)
+		}
+	}
+
+	var a Audience
+	if err := json.Unmarshal([]byte(`"single"`), &a); err != nil || !a.Contains("single") {
+		t.Error("single audience", a, err)
+	}
+}
@@ -11,7 +11,7 @@ type filterLogger struct {
 
 // NewFilterLogger returns a Logger that accepts only log messages with
 // "level" value <= level. Currently there are four levels 0 - error, 1 - info,
-// 2 - debug, 3 - trace.
+// 2 - debug, 3 - trace, level value may be an int or a Level.
 func NewFilterLogger(logger Logger, level int) Logger {
 	return filterLogger{
 		level:  level,
@@ -33,10 +33,14 @@ func (p filterLogger) Log(keyvals ...interface{}) error {
 		if i+1 >= len(keyvals) {
 			break
 		}
-		v := keyvals[i+1]
-		level, ok := v.(int)
-		if !ok {
-			break
+		var level int
+		switch v := keyvals[i+1].(type) {
+		case int:
+			level = v
+		case Level:
+			level = int(v)
+		default:
+			return p.logger.Log(keyvals...)
 		}
 
 		if level > p.level {
@@ -0,0 +1,183 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log formats.
+const (
+	FormatText   = "text"
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+// TimestampKey is the key of timestamp added by JSON and logfmt loggers.
+const TimestampKey = "ts"
+
+// New returns logger writing in a given format to w, text format is
+// NewStdLogger and ignores w.
+func New(format string, w io.Writer) (Logger, error) {
+	switch format {
+	case FormatText, "":
+		return NewStdLogger(), nil
+	case FormatJSON:
+		return NewJSONLogger(w), nil
+	case FormatLogfmt:
+		return NewLogfmtLogger(w), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+type formatLogger struct {
+	w      io.Writer
+	format func(buf *bytes.Buffer, keyvals []interface{})
+	now    func() time.Time
+	mu     sync.Mutex
+}
+
+// NewJSONLogger returns logger writing one JSON object per line, keys are in
+// the order of keyvals preceded by timestamp.
+func NewJSONLogger(w io.Writer) Logger {
+	return &formatLogger{w: w, format: formatJSON, now: time.Now}
+}
+
+// NewLogfmtLogger returns logger writing key=value pairs per line preceded by
+// timestamp.
+func NewLogfmtLogger(w io.Writer) Logger {
+	return &formatLogger{w: w, format: formatLogfmt, now: time.Now}
+}
+
+func (l *formatLogger) Log(keyvals ...interface{}) error {
+	kv := make([]interface{}, 0, len(keyvals)+3)
+	kv = append(kv, TimestampKey, l.now().UTC().Format(time.RFC3339Nano))
+	kv = append(kv, keyvals...)
+	if len(kv)%2 != 0 {
+		kv = append(kv, "MISSING")
+	}
+
+	var buf bytes.Buffer
+	l.format(&buf, kv)
+	buf.WriteByte('\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.w.Write(buf.Bytes())
+	return err
+}
+
+func formatJSON(buf *bytes.Buffer, keyvals []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(keyvals); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(formatKey(keyvals[i]))
+		buf.Write(k)
+		buf.WriteByte(':')
+
+		v, err := json.Marshal(formatValue(keyvals[i], keyvals[i+1]))
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(keyvals[i+1]))
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+}
+
+func formatLogfmt(buf *bytes.Buffer, keyvals []interface{}) {
+	for i := 0; i < len(keyvals); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(strings.Map(func(r rune) rune {
+			if r <= ' ' || r == '=' || r == '"' {
+				return '_'
+			}
+			return r
+		}, formatKey(keyvals[i])))
+		buf.WriteByte('=')
+
+		var s string
+		switch v := formatValue(keyvals[i], keyvals[i+1]).(type) {
+		case nil:
+			s = "null"
+		case string:
+			s = v
+		default:
+			s = fmt.Sprint(v)
+		}
+		if s == "" || strings.ContainsAny(s, " =\"\\") || strings.IndexFunc(s, func(r rune) bool { return r < ' ' }) >= 0 {
+			s = strconv.Quote(s)
+		}
+		buf.WriteString(s)
+	}
+}
+
+func formatKey(k interface{}) string {
+	if s, ok := k.(string); ok {
+		return s
+	}
+	return fmt.Sprint(k)
+}
+
+// formatValue returns value that renders the same in every format, errors,
+// fmt.Stringer and encoding.TextMarshaler values are rendered as strings.
+// Integer level values are rendered as level names.
+func formatValue(k, v interface{}) interface{} {
+	if k == "level" {
+		if l, ok := v.(int); ok {
+			return Level(l).String()
+		}
+	}
+
+	switch x := v.(type) {
+	case nil:
+		return nil
+	case string, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return x
+	case time.Time:
+		return x.UTC().Format(time.RFC3339Nano)
+	case error:
+		if isNil(x) {
+			return nil
+		}
+		return x.Error()
+	case fmt.Stringer:
+		if isNil(x) {
+			return nil
+		}
+		return x.String()
+	case encoding.TextMarshaler:
+		if isNil(x) {
+			return nil
+		}
+		b, err := x.MarshalText()
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(b)
+	case []byte:
+		return string(x)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func isNil(v interface{}) bool {
+	rv := reflect.ValueOf(v)
+	return rv.Kind() == reflect.Ptr && rv.IsNil()
+}
@@ -0,0 +1,79 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+type stringer struct{}
+
+func (*stringer) String() string { return "stringer value" }
+
+func TestFormatLogger_Log(t *testing.T) {
+	t.Parallel()
+
+	now := func() time.Time { return time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC) }
+	keyvals := []interface{}{
+		"level", 1,
+		"msg", "proxy error",
+		"err", errors.New(`dial "tcp" failed`),
+		"ctrlMsg", &stringer{},
+		"nil", (*stringer)(nil),
+		"took", 1500 * time.Millisecond,
+		"empty", "",
+		"odd",
+	}
+
+	tests := []struct {
+		logger   *formatLogger
+		expected string
+	}{
+		{
+			&formatLogger{format: formatJSON, now: now},
+			`{"ts":"2017-01-02T03:04:05Z","level":"info","msg":"proxy error","err":"dial \"tcp\" failed","ctrlMsg":"stringer value","nil":null,"took":"1.5s","empty":"","odd":"MISSING"}` + "\n",
+		},
+		{
+			&formatLogger{format: formatLogfmt, now: now},
+			`ts=2017-01-02T03:04:05Z level=info msg="proxy error" err="dial \"tcp\" failed" ctrlMsg="stringer value" nil=null took=1.5s empty="" odd=MISSING` + "\n",
+		},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		tt.logger.w = &buf
+		if err := tt.logger.Log(keyvals...); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.expected {
+			t.Errorf("expected\n%s got\n%s", tt.expected, buf.String())
+		}
+	}
+}
+
+func TestLevel(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	l := &formatLogger{w: &buf, format: formatLogfmt, now: func() time.Time { return time.Time{} }}
+
+	Debug(NewFilterLogger(l, int(LevelInfo)), "msg", "dropped")
+	NewContext(NewFilterLogger(l, int(LevelInfo))).With("addr", ":80").Error("msg", "failed")
+
+	expected := "ts=0001-01-01T00:00:00Z level=error msg=failed addr=:80\n"
+	if buf.String() != expected {
+		t.Errorf("expected %q got %q", expected, buf.String())
+	}
+
+	if l, err := ParseLevel("trace"); err != nil || l != LevelTrace {
+		t.Error("unexpected level", l, err)
+	}
+	if _, err := New("xml", &buf); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import "fmt"
+
+// Level is log message level, it's logged as "level" value.
+type Level int
+
+// Known levels, NewFilterLogger accepts messages up to given level.
+const (
+	LevelError Level = iota
+	LevelInfo
+	LevelDebug
+	LevelTrace
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelError:
+		return "error"
+	case LevelInfo:
+		return "info"
+	case LevelDebug:
+		return "debug"
+	case LevelTrace:
+		return "trace"
+	default:
+		return fmt.Sprintf("level%d", int(l))
+	}
+}
+
+// ParseLevel returns level of a given name.
+func ParseLevel(s string) (Level, error) {
+	for l := LevelError; l <= LevelTrace; l++ {
+		if l.String() == s {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown level %q", s)
+}
+
+func withLevel(level Level, keyvals []interface{}) []interface{} {
+	return append([]interface{}{"level", level}, keyvals...)
+}
+
+// Error logs keyvals at error level.
+func Error(logger Logger, keyvals ...interface{}) error {
+	return logger.Log(withLevel(LevelError, keyvals)...)
+}
+
+// Info logs keyvals at info level.
+func Info(logger Logger, keyvals ...interface{}) error {
+	return logger.Log(withLevel(LevelInfo, keyvals)...)
+}
+
+// Debug logs keyvals at debug level.
+func Debug(logger Logger, keyvals ...interface{}) error {
+	return logger.Log(withLevel(LevelDebug, keyvals)...)
+}
+
+// Trace logs keyvals at trace level.
+func Trace(logger Logger, keyvals ...interface{}) error {
+	return logger.Log(withLevel(LevelTrace, keyvals)...)
+}
+
+// Error logs keyvals at error level.
+func (c *Context) Error(keyvals ...interface{}) error {
+	return Error(c, keyvals...)
+}
+
+// Info logs keyvals at info level.
+func (c *Context) Info(keyvals ...interface{}) error {
+	return Info(c, keyvals...)
+}
+
+// Debug logs keyvals at debug level.
+func (c *Context) Debug(keyvals ...interface{}) error {
+	return Debug(c, keyvals...)
+}
+
+// Trace logs keyvals at trace level.
+func (c *Context) Trace(keyvals ...interface{}) error {
+	return Trace(c, keyvals...)
+}
@@ -0,0 +1,69 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"expvar"
+	"net/http"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// Server metric names.
+const (
+	MetricClientsRevoked             = "clients_revoked"
+	MetricClientsRevokedDisconnected = "clients_revoked_disconnected"
+	MetricCertExpiryWarnings         = "client_cert_expiry_warnings"
+	MetricCertExpirySeconds          = "client_cert_expiry_seconds"
+	MetricRequestsDenied             = "requests_denied"
+	MetricConnectionsDenied          = "connections_denied"
+	MetricRequestsRateLimited        = "requests_rate_limited"
+	MetricConnectionsRateLimited     = "connections_rate_limited"
+	MetricStreamsLimited             = "streams_limited"
+	MetricRateLimits                 = "rate_limits"
+	MetricQuotaExceeded              = "quota_exceeded"
+	MetricEventsDropped              = "events_dropped"
+	MetricProxyErrors                = "proxy_errors"
+)
+
+func newMetrics() *expvar.Map {
+	m := new(expvar.Map).Init()
+	m.Set(MetricCertExpirySeconds, new(expvar.Map).Init())
+	m.Set(MetricProxyErrors, new(expvar.Map).Init())
+	return m
+}
+
+// Metrics returns server metrics, the result can be published using
+// expvar.Publish.
+func (s *Server) Metrics() *expvar.Map {
+	return s.metrics
+}
+
+// setCertExpiry registers a gauge with the number of seconds until client
+// certificate expires.
+func (s *Server) setCertExpiry(identifier id.ID, notAfter time.Time) {
+	m := s.metrics.Get(MetricCertExpirySeconds).(*expvar.Map)
+	m.Set(identifier.String(), expvar.Func(func() interface{} {
+		return int64(time.Until(notAfter).Seconds())
+	}))
+}
+
+// checkProxyError returns proxyError if client reported failure, the
+// failure is counted in MetricProxyErrors by code.
+func (s *Server) checkProxyError(resp *http.Response) error {
+	code := resp.Header.Get(proto.HeaderProxyError)
+	if code == "" {
+		return nil
+	}
+	s.metrics.Get(MetricProxyErrors).(*expvar.Map).Add(code, 1)
+	return &proxyError{code}
+}
+
+func (s *Server) deleteCertExpiry(identifier id.ID) {
+	m := s.metrics.Get(MetricCertExpirySeconds).(*expvar.Map)
+	m.Delete(identifier.String())
+}
@@ -0,0 +1,499 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/jwt"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// OIDC endpoints and cookies served on tunnel hosts.
+const (
+	OIDCCallbackPath  = "/.tunnel/oidc/callback"
+	OIDCSessionCookie = "_tunnel_session"
+	OIDCStateCookie   = "_tunnel_oidc_state"
+)
+
+// OIDCConfig configures OpenID Connect login for HTTP tunnels that enable it.
+// The server runs the authorization code flow, the redirect URL is
+// OIDCCallbackPath on the tunnel host and must be registered with the issuer.
+type OIDCConfig struct {
+	// Issuer is the issuer URL, provider configuration is discovered from
+	// Issuer/.well-known/openid-configuration.
+	Issuer string
+	// ClientID and ClientSecret are the client credentials.
+	ClientID     string
+	ClientSecret string
+	// Scopes are requested in addition to "openid", if empty "email" is
+	// requested.
+	Scopes []string
+	// CookieSecret is the key used to sign session cookies, if empty a
+	// random key is generated and sessions do not survive restarts.
+	CookieSecret []byte
+	// SessionTTL specifies session validity, if zero
+	// DefaultOIDCSessionTTL is used.
+	SessionTTL time.Duration
+	// HTTPClient is used to talk to the issuer, if nil http.DefaultClient
+	// is used.
+	HTTPClient *http.Client
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcClaims struct {
+	jwt.Claims
+	Nonce         string `json:"nonce"`
+	Email         string `json:"email"`
+	EmailVerified *bool  `json:"email_verified"`
+}
+
+// oidcSession is the payload of session and state cookies.
+type oidcSession struct {
+	Subject   string `json:"sub,omitempty"`
+	Email     string `json:"email,omitempty"`
+	Host      string `json:"host"`
+	ExpiresAt int64  `json:"exp"`
+	// state cookie only
+	State    string `json:"state,omitempty"`
+	Nonce    string `json:"nonce,omitempty"`
+	Redirect string `json:"redirect,omitempty"`
+}
+
+type oidcProvider struct {
+	config *OIDCConfig
+	key    []byte
+	client *http.Client
+
+	discovery *oidcDiscovery
+	keySet    *jwt.KeySet
+	mu        sync.Mutex
+}
+
+func newOIDCProvider(config *OIDCConfig) (*oidcProvider, error) {
+	if config.Issuer == "" || config.ClientID == "" {
+		return nil, errors.New("oidc: missing issuer or client id")
+	}
+
+	key := config.CookieSecret
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+
+	client := config.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &oidcProvider{
+		config: config,
+		key:    key,
+		client: client,
+	}, nil
+}
+
+// authenticate returns true if request carries valid session of a user
+// allowed by rule.
+func (p *oidcProvider) authenticate(r *http.Request, rule *proto.OIDCAuth) bool {
+	c, err := r.Cookie(OIDCSessionCookie)
+	if err != nil {
+		return false
+	}
+	var s oidcSession
+	if !p.decode(c.Value, &s) || s.State != "" {
+		return false
+	}
+	if !strings.EqualFold(s.Host, trimPort(r.Host)) {
+		return false
+	}
+
+	return oidcAllowed(rule, s.Subject, s.Email)
+}
+
+func oidcAllowed(rule *proto.OIDCAuth, subject, email string) bool {
+	if contains(rule.Subjects, subject) {
+		return true
+	}
+	if email == "" {
+		return false
+	}
+	for _, e := range rule.Emails {
+		if strings.EqualFold(e, email) {
+			return true
+		}
+	}
+	if i := strings.LastIndex(email, "@"); i >= 0 {
+		for _, d := range rule.Domains {
+			if strings.EqualFold(d, email[i+1:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// login redirects user to the issuer.
+func (p *oidcProvider) login(w http.ResponseWriter, r *http.Request) {
+	d, err := p.getDiscovery()
+	if err != nil {
+		http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	state, nonce := randString(), randString()
+	s := oidcSession{
+		Host:      trimPort(r.Host),
+		ExpiresAt: time.Now().Add(10 * time.Minute).Unix(),
+		State:     state,
+		Nonce:     nonce,
+		Redirect:  r.URL.RequestURI(),
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     OIDCStateCookie,
+		Value:    p.encode(&s),
+		Path:     OIDCCallbackPath,
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	scopes := p.config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"email"}
+	}
+	v := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.config.ClientID},
+		"redirect_uri":  {p.redirectURI(r)},
+		"scope":         {"openid " + strings.Join(scopes, " ")},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+
+	u := d.AuthorizationEndpoint
+	if strings.Contains(u, "?") {
+		u += "&" + v.Encode()
+	} else {
+		u += "?" + v.Encode()
+	}
+	http.Redirect(w, r, u, http.StatusFound)
+}
+
+// callback handles redirect from the issuer, it exchanges code for ID token
+// and sets session cookie.
+func (p *oidcProvider) callback(w http.ResponseWriter, r *http.Request, rule *proto.OIDCAuth) error {
+	c, err := r.Cookie(OIDCStateCookie)
+	if err != nil {
+		return errors.New("missing state cookie")
+	}
+	var s oidcSession
+	if !p.decode(c.Value, &s) || s.State == "" {
+		return errors.New("invalid state cookie")
+	}
+	if !strings.EqualFold(s.Host, trimPort(r.Host)) || equal(s.State, r.URL.Query().Get("state")) != 1 {
+		return errors.New("state mismatch")
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		return fmt.Errorf("identity provider error: %s", e)
+	}
+
+	claims, err := p.exchange(r, r.URL.Query().Get("code"))
+	if err != nil {
+		return err
+	}
+	if equal(claims.Nonce, s.Nonce) != 1 {
+		return errors.New("nonce mismatch")
+	}
+
+	email := claims.Email
+	if claims.EmailVerified != nil && !*claims.EmailVerified {
+		email = ""
+	}
+	if !oidcAllowed(rule, claims.Subject, email) {
+		return fmt.Errorf("user %q not allowed", claims.Subject)
+	}
+
+	ttl := p.config.SessionTTL
+	if ttl == 0 {
+		ttl = DefaultOIDCSessionTTL
+	}
+	session := oidcSession{
+		Subject:   claims.Subject,
+		Email:     email,
+		Host:      s.Host,
+		ExpiresAt: time.Now().Add(ttl).Unix(),
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     OIDCSessionCookie,
+		Value:    p.encode(&session),
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:   OIDCStateCookie,
+		Path:   OIDCCallbackPath,
+		MaxAge: -1,
+	})
+
+	redirect := s.Redirect
+	if !localRedirect(redirect) {
+		redirect = "/"
+	}
+	http.Redirect(w, r, redirect, http.StatusFound)
+
+	return nil
+}
+
+// localRedirect returns true if redirect is an absolute path on the same
+// host, browsers treat backslash as slash so "/\evil.com" is rejected too.
+func localRedirect(redirect string) bool {
+	if !strings.HasPrefix(redirect, "/") || strings.ContainsAny(redirect, "\\\r\n\t") {
+		return false
+	}
+	u, err := url.Parse(redirect)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "" && u.Host == "" && u.User == nil &&
+		!strings.HasPrefix(u.Path, "//") && !strings.Contains(u.Path, "\\")
+}
+
+func (p *oidcProvider) exchange(r *http.Request, code string) (*oidcClaims, error) {
+	if code == "" {
+		return nil, errors.New("missing code")
+	}
+
+	d, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {p.redirectURI(r)},
+	}
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+
+	var v struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := p.do(req, &v); err != nil {
+		return nil, fmt.Errorf("token exchange: %s", err)
+	}
+
+	var claims oidcClaims
+	if err := p.verify(v.IDToken, &claims); err != nil {
+		return nil, err
+	}
+	if err := claims.Validate(d.Issuer, p.config.ClientID, time.Now()); err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("missing sub claim")
+	}
+
+	return &claims, nil
+}
+
+// verify checks ID token signature, the key set is refreshed if no key
+// matches the token.
+func (p *oidcProvider) verify(token string, claims interface{}) error {
+	ks, err := p.getKeySet(false)
+	if err != nil {
+		return err
+	}
+	err = ks.Verify(token, claims)
+	if err == jwt.ErrNoKey || err == jwt.ErrInvalidSignature {
+		if ks, err = p.getKeySet(true); err != nil {
+			return err
+		}
+		err = ks.Verify(token, claims)
+	}
+	return err
+}
+
+func (p *oidcProvider) getDiscovery() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(p.config.Issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	var d oidcDiscovery
+	if err := p.do(req, &d); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %s", err)
+	}
+	if d.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer mismatch %q", d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("oidc discovery: missing endpoints")
+	}
+	p.discovery = &d
+
+	return p.discovery, nil
+}
+
+func (p *oidcProvider) getKeySet(refresh bool) (*jwt.KeySet, error) {
+	d, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.keySet != nil && !refresh {
+		return p.keySet, nil
+	}
+
+	resp, err := p.client.Get(d.JWKSURI)
+	if err != nil {
+		return nil, fmt.Errorf("oidc keys: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc keys: status %s", resp.Status)
+	}
+	b, err := readAllLimited(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("oidc keys: %s", err)
+	}
+	ks, err := jwt.ParseKeySet(b)
+	if err != nil {
+		return nil, fmt.Errorf("oidc keys: %s", err)
+	}
+	p.keySet = ks
+
+	return ks, nil
+}
+
+func (p *oidcProvider) do(req *http.Request, v interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	b, err := readAllLimited(resp.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (p *oidcProvider) redirectURI(r *http.Request) string {
+	scheme := proto.HTTP
+	if r.TLS != nil {
+		scheme = proto.HTTPS
+	}
+	return scheme + "://" + r.Host + OIDCCallbackPath
+}
+
+// encode returns signed cookie value.
+func (p *oidcProvider) encode(s *oidcSession) string {
+	b, _ := json.Marshal(s)
+	v := base64.RawURLEncoding.EncodeToString(b)
+	return v + "." + base64.RawURLEncoding.EncodeToString(p.sign(v))
+}
+
+// decode verifies cookie signature and expiry.
+func (p *oidcProvider) decode(value string, s *oidcSession) bool {
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err != nil || !hmac.Equal(sig, p.sign(value[:i])) {
+		return false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(value[:i])
+	if err != nil {
+		return false
+	}
+	if err := json.Unmarshal(b, s); err != nil {
+		return false
+	}
+	return time.Now().Unix() < s.ExpiresAt
+}
+
+func (p *oidcProvider) sign(v string) []byte {
+	m := hmac.New(sha256.New, p.key)
+	m.Write([]byte(v))
+	return m.Sum(nil)
+}
+
+// stripOIDCCookies removes session cookies from request header before passing
+// it to the client.
+func stripOIDCCookies(r *http.Request, h http.Header) {
+	cookies := r.Cookies()
+	if len(cookies) == 0 {
+		return
+	}
+
+	var keep []string
+	for _, c := range cookies {
+		if c.Name == OIDCSessionCookie || c.Name == OIDCStateCookie {
+			continue
+		}
+		keep = append(keep, c.String())
+	}
+
+	h.Del("Cookie")
+	if len(keep) != 0 {
+		h.Set("Cookie", strings.Join(keep, "; "))
+	}
+}
+
+func randString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func readAllLimited(r io.Reader) ([]byte, error) {
+	return ioutil.ReadAll(io.LimitReader(r, 1<<20))
+}
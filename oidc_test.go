@@ -0,0 +1,208 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// newTestIssuer returns OpenID Connect provider stub issuing ID tokens for
+// email with nonce taken from the last authorization request.
+func newTestIssuer(email func() string, nonce func() string) *httptest.Server {
+	mux := http.NewServeMux()
+	ts := httptest.NewServer(mux)
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 ts.URL,
+			"authorization_endpoint": ts.URL + "/authorize",
+			"token_endpoint":         ts.URL + "/token",
+			"jwks_uri":               ts.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"keys":[{"kty":"oct","k":"` + base64.RawURLEncoding.EncodeToString(tokenSecret) + `"}]}`))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if user, password, _ := r.BasicAuth(); user != "tunneld" || password != "secret" || r.FormValue("code") != "code" {
+			http.Error(w, "invalid client", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"id_token": signToken(map[string]interface{}{
+				"iss":            ts.URL,
+				"aud":            "tunneld",
+				"sub":            "1234",
+				"email":          email(),
+				"email_verified": true,
+				"nonce":          nonce(),
+				"exp":            time.Now().Add(time.Minute).Unix(),
+			}),
+		})
+	})
+
+	return ts
+}
+
+func TestServer_OIDC(t *testing.T) {
+	t.Parallel()
+
+	var email, nonce string
+	issuer := newTestIssuer(func() string { return email }, func() string { return nonce })
+	defer issuer.Close()
+
+	cert, err := tls.LoadX509KeyPair("./testdata/selfsigned.crt", "./testdata/selfsigned.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(&ServerConfig{
+		Addr:      "127.0.0.1:0",
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		OIDC: &OIDCConfig{
+			Issuer:       issuer.URL,
+			ClientID:     "tunneld",
+			ClientSecret: "secret",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.listener.Close()
+
+	identifier := id.New([]byte("client"))
+	s.Subscribe(identifier)
+	if err := s.set(&RegistryItem{
+		Hosts: []*HostAuth{{
+			Host: "app.example.com",
+			Auth: NewHTTPAuth("", &proto.AuthConfig{
+				OIDC: &proto.OIDCAuth{Domains: []string{"example.com"}},
+			}),
+		}},
+	}, identifier); err != nil {
+		t.Fatal(err)
+	}
+
+	login := func() (*http.Cookie, string) {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://app.example.com/page?a=b", nil))
+		if w.Code != http.StatusFound {
+			t.Fatal("expected redirect got", w.Code)
+		}
+		u, err := url.Parse(w.Header().Get("Location"))
+		if err != nil || !strings.HasPrefix(u.String(), issuer.URL+"/authorize") {
+			t.Fatal("unexpected location", u)
+		}
+		q := u.Query()
+		if q.Get("redirect_uri") != "http://app.example.com"+OIDCCallbackPath || q.Get("client_id") != "tunneld" {
+			t.Fatal("unexpected authorization request", q)
+		}
+		nonce = q.Get("nonce")
+
+		return (&http.Response{Header: w.Header()}).Cookies()[0], q.Get("state")
+	}
+
+	callback := func(state *http.Cookie, v string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "http://app.example.com"+OIDCCallbackPath+"?code=code&state="+v, nil)
+		r.AddCookie(state)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	// user from other domain
+	email = "eve@other.com"
+	state, v := login()
+	if w := callback(state, v); w.Code != http.StatusUnauthorized {
+		t.Fatal("expected unauthorised got", w.Code)
+	}
+
+	// state mismatch
+	email = "bob@example.com"
+	state, _ = login()
+	if w := callback(state, "forged"); w.Code != http.StatusUnauthorized {
+		t.Fatal("expected unauthorised got", w.Code)
+	}
+
+	state, v = login()
+	w := callback(state, v)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/page?a=b" {
+		t.Fatal("unexpected callback response", w.Code, w.Header())
+	}
+	var session *http.Cookie
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		if c.Name == OIDCSessionCookie {
+			session = c
+		}
+	}
+	if session == nil {
+		t.Fatal("missing session cookie")
+	}
+
+	_, auth, _ := s.Subscriber("app.example.com")
+
+	r := httptest.NewRequest(http.MethodGet, "http://app.example.com/page", nil)
+	r.AddCookie(session)
+	r.AddCookie(&http.Cookie{Name: "app", Value: "1"})
+	if !s.oidcAuthenticate(r, auth) {
+		t.Fatal("session not accepted")
+	}
+
+	h := http.Header{}
+	stripOIDCCookies(r, h)
+	if h.Get("Cookie") != "app=1" {
+		t.Fatal("unexpected cookies", h)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "http://other.example.com/page", nil)
+	r.AddCookie(session)
+	if s.oidcAuthenticate(r, auth) {
+		t.Fatal("session accepted on other host")
+	}
+
+	session.Value = strings.Replace(session.Value, ".", ".x", 1)
+	r = httptest.NewRequest(http.MethodGet, "http://app.example.com/page", nil)
+	r.AddCookie(session)
+	if s.oidcAuthenticate(r, auth) {
+		t.Fatal("tampered session accepted")
+	}
+}
+
+func TestLocalRedirect(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		redirect string
+		local    bool
+	}{
+		{"/", true},
+		{"/app?x=1#top", true},
+		{"", false},
+		{"app", false},
+		{"//evil.com", false},
+		{"/\\evil.com", false},
+		{"/\\/evil.com", false},
+		{"/%5Cevil.com", false},
+		{"/%2F/evil.com", false},
+		{"/\tevil.com", false},
+		{"https://evil.com/", false},
+		{"javascript:alert(1)", false},
+	}
+	for _, tt := range tests {
+		if actual := localRedirect(tt.redirect); actual != tt.local {
+			t.Errorf("%q got %v", tt.redirect, actual)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// PolicyRule matches clients and lists tunnels they may open. Empty ID, CN
+// and OU match any client.
+type PolicyRule struct {
+	// ID is the client identifier.
+	ID string `yaml:"id,omitempty"`
+	// CN is a glob pattern matched against certificate subject common
+	// name.
+	CN string `yaml:"cn,omitempty"`
+	// OU is a glob pattern matched against certificate subject
+	// organizational units.
+	OU string `yaml:"ou,omitempty"`
+	// Protocols limits allowed tunnel protocols, if empty any protocol is
+	// allowed.
+	Protocols []string `yaml:"protocols,omitempty"`
+	// Hosts are glob patterns of allowed HTTP and SNI hosts.
+	Hosts []string `yaml:"hosts,omitempty"`
+	// Ports are allowed TCP ports or port ranges i.e. "8000-8100".
+	Ports []string `yaml:"ports,omitempty"`
+
+	id    id.ID
+	ports [][2]int
+}
+
+// PolicyAuthorizer is an Authorizer based on a YAML file with a list of
+// rules, a tunnel is allowed if any rule matching the client allows it.
+//
+//	rules:
+//	  - ou: ci
+//	    protocols: [http]
+//	    hosts: ["*.ci.example.com"]
+//	  - id: YMBKT3V-ESUTZ2Z-7MRILIJ-T35FHGO-D2DHO7D-FXMGSSR-V4LBSZX-BNDONQ4
+//	    ports: ["22", "8000-8100"]
+type PolicyAuthorizer struct {
+	file  string
+	rules []*PolicyRule
+	mu    sync.RWMutex
+}
+
+// NewPolicyAuthorizer creates PolicyAuthorizer from a YAML file.
+func NewPolicyAuthorizer(file string) (*PolicyAuthorizer, error) {
+	a := &PolicyAuthorizer{
+		file: file,
+	}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload reads the policy file again.
+func (a *PolicyAuthorizer) Reload() error {
+	b, err := ioutil.ReadFile(a.file)
+	if err != nil {
+		return fmt.Errorf("failed to read file %q: %s", a.file, err)
+	}
+
+	rules, err := parsePolicy(b)
+	if err != nil {
+		return fmt.Errorf("failed to parse file %q: %s", a.file, err)
+	}
+
+	a.mu.Lock()
+	a.rules = rules
+	a.mu.Unlock()
+
+	return nil
+}
+
+func parsePolicy(b []byte) ([]*PolicyRule, error) {
+	var v struct {
+		Rules []*PolicyRule `yaml:"rules"`
+	}
+	if err := yaml.UnmarshalStrict(b, &v); err != nil {
+		return nil, err
+	}
+
+	for i, r := range v.Rules {
+		if r.ID != "" {
+			if err := r.id.UnmarshalText([]byte(r.ID)); err != nil {
+				return nil, fmt.Errorf("rule %d: id: %s", i, err)
+			}
+		}
+		for _, p := range append(r.Hosts, r.CN, r.OU) {
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("rule %d: pattern %q: %s", i, p, err)
+			}
+		}
+		for _, p := range r.Ports {
+			lo, hi, err := parsePortRange(p)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: ports: %s", i, err)
+			}
+			r.ports = append(r.ports, [2]int{lo, hi})
+		}
+	}
+
+	return v.Rules, nil
+}
+
+func parsePortRange(s string) (lo, hi int, err error) {
+	p := strings.SplitN(s, "-", 2)
+	if lo, err = strconv.Atoi(p[0]); err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", s)
+	}
+	hi = lo
+	if len(p) > 1 {
+		if hi, err = strconv.Atoi(p[1]); err != nil {
+			return 0, 0, fmt.Errorf("invalid port %q", s)
+		}
+	}
+	if lo < 0 || hi > 65535 || lo > hi {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return lo, hi, nil
+}
+
+// Authorize implements Authorizer.
+func (a *PolicyAuthorizer) Authorize(req *AuthorizationRequest) (map[string]Decision, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	var rules []*PolicyRule
+	for _, r := range a.rules {
+		if r.matchClient(req) {
+			rules = append(rules, r)
+		}
+	}
+
+	d := make(map[string]Decision, len(req.Tunnels))
+	for name, t := range req.Tunnels {
+		d[name] = Decision{Reason: "no matching rule"}
+		for i, r := range rules {
+			if r.allowTunnel(t) {
+				d[name] = Decision{Allow: true, Reason: fmt.Sprintf("rule %d", i)}
+				break
+			}
+		}
+	}
+
+	return d, nil
+}
+
+func (r *PolicyRule) matchClient(req *AuthorizationRequest) bool {
+	if r.ID != "" && !r.id.Equals(req.Identifier) {
+		return false
+	}
+	if r.CN == "" && r.OU == "" {
+		return true
+	}
+
+	c := req.Certificate
+	if c == nil {
+		return false
+	}
+	if r.CN != "" && !globMatch(r.CN, c.Subject.CommonName) {
+		return false
+	}
+	if r.OU != "" {
+		for _, ou := range c.Subject.OrganizationalUnit {
+			if globMatch(r.OU, ou) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+func (r *PolicyRule) allowTunnel(t *proto.Tunnel) bool {
+	if len(r.Protocols) != 0 && !contains(r.Protocols, t.Protocol) {
+		return false
+	}
+
+	switch t.Protocol {
+	case proto.HTTP, proto.SNI:
+		for _, h := range r.Hosts {
+			if globMatch(h, trimPort(t.Host)) {
+				return true
+			}
+		}
+	default:
+		_, p, err := net.SplitHostPort(t.Addr)
+		if err != nil {
+			return false
+		}
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			return false
+		}
+		for _, pr := range r.ports {
+			if port >= pr[0] && port <= pr[1] {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func globMatch(pattern, s string) bool {
+	ok, _ := path.Match(pattern, s)
+	return ok
+}
+
+func contains(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -12,18 +12,28 @@ import (
 	"sync"
 	"time"
 
+	"github.com/quic-go/quic-go/http3"
 	"golang.org/x/net/http2"
 
 	"github.com/mmatczuk/go-http-tunnel/id"
 )
 
+// clientConn sends requests to a client over control connection, it's
+// *http2.ClientConn or *quicClientConn.
+type clientConn interface {
+	RoundTrip(req *http.Request) (*http.Response, error)
+	CanTakeNewRequest() bool
+	Ping(ctx context.Context) error
+}
+
 type connPair struct {
 	conn       net.Conn
-	clientConn *http2.ClientConn
+	clientConn clientConn
 }
 
 type connPool struct {
 	t     *http2.Transport
+	h3    *http3.Transport
 	conns map[string]connPair // key is host:port
 	free  func(identifier id.ID)
 	mu    sync.RWMutex
@@ -32,6 +42,7 @@ type connPool struct {
 func newConnPool(t *http2.Transport, f func(identifier id.ID)) *connPool {
 	return &connPool{
 		t:     t,
+		h3:    &http3.Transport{},
 		free:  f,
 		conns: make(map[string]connPair),
 	}
@@ -41,7 +52,29 @@ func (p *connPool) URL(identifier id.ID) string {
 	return fmt.Sprint("https://", identifier)
 }
 
+// RoundTrip sends request over control connection of a client, it handles
+// both HTTP/2 and QUIC connections.
+func (p *connPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	c, err := p.getClientConn(req.URL.Host + ":443")
+	if err != nil {
+		return nil, err
+	}
+	return c.RoundTrip(req)
+}
+
 func (p *connPool) GetClientConn(req *http.Request, addr string) (*http2.ClientConn, error) {
+	c, err := p.getClientConn(addr)
+	if err != nil {
+		return nil, err
+	}
+	h2, ok := c.(*http2.ClientConn)
+	if !ok {
+		return nil, errClientNotConnected
+	}
+	return h2, nil
+}
+
+func (p *connPool) getClientConn(addr string) (clientConn, error) {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 
@@ -53,6 +86,10 @@ func (p *connPool) GetClientConn(req *http.Request, addr string) (*http2.ClientC
 }
 
 func (p *connPool) MarkDead(c *http2.ClientConn) {
+	p.markDead(c)
+}
+
+func (p *connPool) markDead(c clientConn) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
@@ -78,9 +115,20 @@ func (p *connPool) AddConn(conn net.Conn, identifier id.ID) error {
 		}
 	}
 
-	c, err := p.t.NewClientConn(conn)
-	if err != nil {
-		return err
+	var c clientConn
+	if qc, ok := conn.(*quicConn); ok {
+		q := newQUICClientConn(p.h3, qc)
+		go func() {
+			<-q.done()
+			p.markDead(q)
+		}()
+		c = q
+	} else {
+		h2, err := p.t.NewClientConn(conn)
+		if err != nil {
+			return err
+		}
+		c = h2
 	}
 	p.conns[addr] = connPair{
 		conn:       conn,
@@ -101,6 +149,55 @@ func (p *connPool) DeleteConn(identifier id.ID) {
 	}
 }
 
+// Rekey moves connection to a new identifier, if there is a live connection
+// with that identifier errClientAlreadyConnected is returned.
+func (p *connPool) Rekey(from, to id.ID) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fromAddr, toAddr := p.addr(from), p.addr(to)
+
+	cp, ok := p.conns[fromAddr]
+	if !ok {
+		return errClientNotConnected
+	}
+
+	if old, ok := p.conns[toAddr]; ok {
+		if err := p.ping(old); err != nil {
+			p.close(old, toAddr)
+		} else {
+			return errClientAlreadyConnected
+		}
+	}
+
+	delete(p.conns, fromAddr)
+	p.conns[toAddr] = cp
+
+	return nil
+}
+
+// DeleteConnFunc closes connections of clients for which f returns true.
+func (p *connPool) DeleteConnFunc(f func(identifier id.ID, conn net.Conn) bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for addr, cp := range p.conns {
+		if f(p.identifier(addr), cp.conn) {
+			p.close(cp, addr)
+		}
+	}
+}
+
+// EachConn calls f for connections of all clients.
+func (p *connPool) EachConn(f func(identifier id.ID, conn net.Conn)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for addr, cp := range p.conns {
+		f(p.identifier(addr), cp.conn)
+	}
+}
+
 func (p *connPool) Ping(identifier id.ID) (time.Duration, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -110,6 +207,9 @@ func (p *connPool) Ping(identifier id.ID) (time.Duration, error) {
 	if cp, ok := p.conns[addr]; ok {
 		start := time.Now()
 		err := p.ping(cp)
+		if q, ok := cp.clientConn.(*quicClientConn); ok && err == nil {
+			return q.rtt(), nil
+		}
 		return time.Since(start), err
 	}
 
@@ -131,6 +231,17 @@ func (p *connPool) close(cp connPair, addr string) {
 	}
 }
 
+// Close closes connections of all clients and releases transports.
+func (p *connPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for addr, cp := range p.conns {
+		p.close(cp, addr)
+	}
+	p.h3.Close()
+}
+
 func (p *connPool) addr(identifier id.ID) string {
 	return fmt.Sprint(identifier.String(), ":443")
 }
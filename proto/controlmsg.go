@@ -12,10 +12,50 @@ import (
 // Protocol HTTP headers.
 const (
 	HeaderError = "X-Error"
+	HeaderToken = "X-Token"
+	// HeaderWarning is set by server in a notification about a problem that
+	// does not end the connection, i.e. tunnels it refused to open.
+	HeaderWarning = "X-Warning"
 
 	HeaderAction         = "X-Action"
 	HeaderForwardedHost  = "X-Forwarded-Host"
 	HeaderForwardedProto = "X-Forwarded-Proto"
+	HeaderTraceparent    = "Traceparent"
+	// HeaderRemoteAddr is address of user connected to a TCP listener of
+	// the server.
+	HeaderRemoteAddr = "X-Remote-Addr"
+
+	// HeaderStreamEncoding is set when data stream is compressed, value is
+	// one of Encoding constants.
+	HeaderStreamEncoding = "X-Stream-Encoding"
+	// HeaderAcceptStreamEncoding is set by server when client may compress
+	// response stream.
+	HeaderAcceptStreamEncoding = "X-Accept-Stream-Encoding"
+
+	// HeaderUpgrade is set by client in response when local service
+	// switched protocols, response body is the raw HTTP/1.1 response of
+	// local service followed by the upgraded stream.
+	HeaderUpgrade = "X-Upgrade"
+
+	// HeaderProxyError is set by client in response when it fails to
+	// proxy a request to local service, value is one of ProxyError
+	// constants.
+	HeaderProxyError = "X-Proxy-Error"
+)
+
+// Known proxy errors.
+const (
+	ProxyErrorDialRefused         = "dial_refused"
+	ProxyErrorTimeout             = "timeout"
+	ProxyErrorNoRoute             = "no_route"
+	ProxyErrorUnsupportedProtocol = "unsupported_protocol"
+	ProxyErrorForbidden           = "forbidden"
+	ProxyErrorFailed              = "failed"
+)
+
+// Known stream encodings.
+const (
+	EncodingGzip = "gzip"
 )
 
 // Known actions.
@@ -35,6 +75,11 @@ const (
 	SNI  = "sni"
 
 	HTTPCONNECT = "httpconnect"
+
+	SOCKS5 = "socks5"
+	// SOCKS5UDP is protocol of streams carrying datagrams of SOCKS5 UDP
+	// ASSOCIATE, it's not a tunnel protocol.
+	SOCKS5UDP = "socks5udp"
 )
 
 // ControlMessage is sent from server to client before streaming data. It's
@@ -45,15 +90,31 @@ type ControlMessage struct {
 	ForwardedHost  string
 	ForwardedProto string
 	RemoteAddr     string
+	// Traceparent is optional W3C trace context of the span that sent the
+	// message.
+	Traceparent string
+	// StreamEncoding is encoding of the request stream, if empty the stream
+	// is not compressed.
+	StreamEncoding string
+	// AcceptStreamEncoding is encoding client may use to compress response
+	// stream.
+	AcceptStreamEncoding string
 }
 
 // ReadControlMessage reads ControlMessage from HTTP headers.
 func ReadControlMessage(r *http.Request) (*ControlMessage, error) {
 	msg := ControlMessage{
-		Action:         r.Header.Get(HeaderAction),
-		ForwardedHost:  r.Header.Get(HeaderForwardedHost),
-		ForwardedProto: r.Header.Get(HeaderForwardedProto),
-		RemoteAddr:     r.RemoteAddr,
+		Action:               r.Header.Get(HeaderAction),
+		ForwardedHost:        r.Header.Get(HeaderForwardedHost),
+		ForwardedProto:       r.Header.Get(HeaderForwardedProto),
+		RemoteAddr:           r.Header.Get(HeaderRemoteAddr),
+		Traceparent:          r.Header.Get(HeaderTraceparent),
+		StreamEncoding:       r.Header.Get(HeaderStreamEncoding),
+		AcceptStreamEncoding: r.Header.Get(HeaderAcceptStreamEncoding),
+	}
+
+	if msg.RemoteAddr == "" {
+		msg.RemoteAddr = r.RemoteAddr
 	}
 
 	var missing []string
@@ -75,9 +136,31 @@ func ReadControlMessage(r *http.Request) (*ControlMessage, error) {
 	return &msg, nil
 }
 
+// String returns compact representation of ControlMessage used in logs, i.e.
+// "proxy http://example.com from 1.2.3.4:5678".
+func (c *ControlMessage) String() string {
+	s := fmt.Sprintf("%s %s://%s", c.Action, c.ForwardedProto, c.ForwardedHost)
+	if c.RemoteAddr != "" {
+		s += " from " + c.RemoteAddr
+	}
+	return s
+}
+
 // WriteToHeader writes ControlMessage to HTTP header.
 func (c *ControlMessage) WriteToHeader(h http.Header) {
 	h.Set(HeaderAction, string(c.Action))
 	h.Set(HeaderForwardedHost, c.ForwardedHost)
 	h.Set(HeaderForwardedProto, c.ForwardedProto)
+	if c.RemoteAddr != "" {
+		h.Set(HeaderRemoteAddr, c.RemoteAddr)
+	}
+	if c.Traceparent != "" {
+		h.Set(HeaderTraceparent, c.Traceparent)
+	}
+	if c.StreamEncoding != "" {
+		h.Set(HeaderStreamEncoding, c.StreamEncoding)
+	}
+	if c.AcceptStreamEncoding != "" {
+		h.Set(HeaderAcceptStreamEncoding, c.AcceptStreamEncoding)
+	}
 }
@@ -26,6 +26,34 @@ func TestControlMessageWriteRead(t *testing.T) {
 			},
 			nil,
 		},
+		{
+			&ControlMessage{
+				Action:         "action",
+				ForwardedHost:  "forwarded_host",
+				ForwardedProto: "forwarded_proto",
+				Traceparent:    "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			},
+			nil,
+		},
+		{
+			&ControlMessage{
+				Action:         "action",
+				ForwardedHost:  "forwarded_host",
+				ForwardedProto: "forwarded_proto",
+				RemoteAddr:     "192.0.2.1:5678",
+			},
+			nil,
+		},
+		{
+			&ControlMessage{
+				Action:               "action",
+				ForwardedHost:        "forwarded_host",
+				ForwardedProto:       "forwarded_proto",
+				StreamEncoding:       EncodingGzip,
+				AcceptStreamEncoding: EncodingGzip,
+			},
+			nil,
+		},
 		{
 			&ControlMessage{
 				ForwardedHost:  "forwarded_host",
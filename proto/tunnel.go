@@ -17,7 +17,67 @@ type Tunnel struct {
 	// Auth specifies HTTP basic auth credentials in form "user:password",
 	// if set server would protect HTTP and WS tunnels with basic auth.
 	Auth string
+	// HTTPAuth specifies additional authentication methods for HTTP and WS
+	// tunnels, a request is allowed if it passes any of the methods
+	// including Auth.
+	HTTPAuth *AuthConfig
 	// Addr specifies TCP address server would listen on, it's required
 	// for TCP tunnels.
 	Addr string
+	// AllowCIDRs if not empty limits access to the tunnel to given
+	// networks.
+	AllowCIDRs []string
+	// DenyCIDRs denies access to the tunnel from given networks, it takes
+	// precedence over AllowCIDRs.
+	DenyCIDRs []string
+	// Headers specifies header rewriting rules server applies to requests
+	// and responses of HTTP tunnels.
+	Headers *HeaderRules
+	// Compression lists stream encodings client accepts in order of
+	// preference, server picks the first one it supports and compresses
+	// tunnel streams with it.
+	Compression []string
+}
+
+// HeaderRules specifies rewriting of HTTP request and response headers.
+type HeaderRules struct {
+	Request  *HeaderRule `yaml:"request,omitempty"`
+	Response *HeaderRule `yaml:"response,omitempty"`
+}
+
+// HeaderRule lists header changes, headers are removed first, then set and
+// added. Values are text/template templates, {{.ClientIP}} is replaced with
+// IP address of the user and {{.Tunnel}} with the tunnel name.
+type HeaderRule struct {
+	Set    map[string]string `yaml:"set,omitempty"`
+	Add    map[string]string `yaml:"add,omitempty"`
+	Remove []string          `yaml:"remove,omitempty"`
+}
+
+// AuthConfig specifies authentication methods of public requests to HTTP
+// tunnels.
+type AuthConfig struct {
+	// Users maps user names to password hashes used with basic auth,
+	// bcrypt and argon2id (PHC string format) hashes are supported.
+	Users map[string]string `yaml:"users,omitempty"`
+	// BearerTokens are tokens accepted in "Authorization: Bearer" header.
+	BearerTokens []string `yaml:"bearer_tokens,omitempty"`
+	// APIKeyHeader is name of the header carrying API key.
+	APIKeyHeader string `yaml:"api_key_header,omitempty"`
+	// APIKeys are accepted values of APIKeyHeader.
+	APIKeys []string `yaml:"api_keys,omitempty"`
+	// OIDC enables OpenID Connect login with the issuer configured on the
+	// server.
+	OIDC *OIDCAuth `yaml:"oidc,omitempty"`
+}
+
+// OIDCAuth lists OpenID Connect users allowed to access a tunnel, a user is
+// allowed if matches any of the lists.
+type OIDCAuth struct {
+	// Subjects are allowed "sub" claim values.
+	Subjects []string `yaml:"subjects,omitempty"`
+	// Emails are allowed verified emails.
+	Emails []string `yaml:"emails,omitempty"`
+	// Domains are allowed domains of verified emails.
+	Domains []string `yaml:"domains,omitempty"`
 }
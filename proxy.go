@@ -5,13 +5,19 @@
 package tunnel
 
 import (
+	"context"
+	"errors"
 	"io"
+	"net"
+	"net/http"
 
 	"github.com/mmatczuk/go-http-tunnel/proto"
 )
 
 // ProxyFunc is responsible for forwarding a remote connection to local server
-// and writing the response.
+// and writing the response. If ProxyFunc fails before writing any data it
+// shall report the failure with ReportProxyError, server then responds with
+// a proper HTTP error or resets TCP connection.
 type ProxyFunc func(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage)
 
 // ProxyFuncs is a collection of ProxyFunc.
@@ -22,6 +28,8 @@ type ProxyFuncs struct {
 	TCP ProxyFunc
 	// this enables http tunneling
 	HTTPCONNECT ProxyFunc
+	// SOCKS5 is custom implementation of SOCKS5 server.
+	SOCKS5 ProxyFunc
 }
 
 // Proxy returns a ProxyFunc that uses custom function if provided.
@@ -35,12 +43,47 @@ func Proxy(p ProxyFuncs) ProxyFunc {
 			f = p.TCP
 		case proto.HTTPCONNECT:
 			f = p.HTTPCONNECT
+		case proto.SOCKS5, proto.SOCKS5UDP:
+			f = p.SOCKS5
 		}
 
 		if f == nil {
+			ReportProxyError(w, proto.ProxyErrorUnsupportedProtocol)
 			return
 		}
 
 		f(w, r, msg)
 	}
 }
+
+// ReportProxyError sends failure, one of proto.ProxyError constants, to
+// server. It must be called before anything is written to w.
+func ReportProxyError(w io.Writer, code string) {
+	rw, ok := w.(http.ResponseWriter)
+	if !ok {
+		return
+	}
+
+	status := http.StatusBadGateway
+	switch code {
+	case proto.ProxyErrorTimeout:
+		status = http.StatusGatewayTimeout
+	case proto.ProxyErrorForbidden:
+		status = http.StatusForbidden
+	}
+	rw.Header().Set(proto.HeaderProxyError, code)
+	rw.WriteHeader(status)
+}
+
+// proxyErrorCode classifies error of connecting local service.
+func proxyErrorCode(err error) string {
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &ne) && ne.Timeout() {
+		return proto.ProxyErrorTimeout
+	}
+	var oe *net.OpError
+	if errors.As(err, &oe) && oe.Op == "dial" {
+		return proto.ProxyErrorDialRefused
+	}
+	return proto.ProxyErrorFailed
+}
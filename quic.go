@@ -0,0 +1,109 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// Control connection transports.
+const (
+	TransportTCP       = "tcp"
+	TransportQUIC      = "quic"
+	TransportWebSocket = "websocket"
+)
+
+// quicALPN is application protocol of QUIC control connections, control
+// messages are exchanged over HTTP/3 with server acting as HTTP client.
+const quicALPN = "tunnel-h3"
+
+var errQUICStreams = errors.New("quic connection data is sent over streams")
+
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		KeepAlivePeriod:    DefaultQUICKeepAlivePeriod,
+		MaxIncomingStreams: 1000,
+	}
+}
+
+func quicTLSConfig(config *tls.Config) *tls.Config {
+	c := config.Clone()
+	c.NextProtos = []string{quicALPN}
+	c.MinVersion = tls.VersionTLS13
+	return c
+}
+
+// quicConn is QUIC control connection, it's net.Conn so that it can be
+// managed like TLS connections, reads and writes are not supported.
+type quicConn struct {
+	conn *quic.Conn
+}
+
+func (c *quicConn) Read(b []byte) (int, error)         { return 0, errQUICStreams }
+func (c *quicConn) Write(b []byte) (int, error)        { return 0, errQUICStreams }
+func (c *quicConn) Close() error                       { return c.conn.CloseWithError(0, "") }
+func (c *quicConn) LocalAddr() net.Addr                { return c.conn.LocalAddr() }
+func (c *quicConn) RemoteAddr() net.Addr               { return c.conn.RemoteAddr() }
+func (c *quicConn) SetDeadline(t time.Time) error      { return nil }
+func (c *quicConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *quicConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// Handshake waits for TLS handshake to complete.
+func (c *quicConn) Handshake() error {
+	select {
+	case <-c.conn.HandshakeComplete():
+		return nil
+	case <-c.conn.Context().Done():
+		return context.Cause(c.conn.Context())
+	}
+}
+
+// ConnectionState returns TLS state of the connection.
+func (c *quicConn) ConnectionState() tls.ConnectionState {
+	return c.conn.ConnectionState().TLS
+}
+
+// quicClientConn sends requests to client over HTTP/3.
+type quicClientConn struct {
+	*http3.ClientConn
+	conn *quic.Conn
+}
+
+// newQUICClientConn creates HTTP/3 client connection with a transport shared
+// by all connections of a pool.
+func newQUICClientConn(t *http3.Transport, c *quicConn) *quicClientConn {
+	return &quicClientConn{
+		ClientConn: t.NewClientConn(c.conn),
+		conn:       c.conn,
+	}
+}
+
+func (c *quicClientConn) CanTakeNewRequest() bool {
+	return c.conn.Context().Err() == nil
+}
+
+// Ping reports if connection is alive, QUIC keeps the connection alive and
+// measures round trip time.
+func (c *quicClientConn) Ping(ctx context.Context) error {
+	if c.conn.Context().Err() != nil {
+		return context.Cause(c.conn.Context())
+	}
+	return nil
+}
+
+func (c *quicClientConn) rtt() time.Duration {
+	return c.conn.ConnectionStats().SmoothedRTT
+}
+
+func (c *quicClientConn) done() <-chan struct{} {
+	return c.conn.Context().Done()
+}
@@ -0,0 +1,347 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Limits specifies rate limits of a client or a tunnel, zero values mean no
+// limit.
+type Limits struct {
+	// RequestsPerSecond limits HTTP requests, over limit requests get
+	// 429 Too Many Requests response.
+	RequestsPerSecond float64 `yaml:"requests_per_second,omitempty" json:"requests_per_second,omitempty"`
+	// RequestsBurst is the number of requests allowed at once, if zero
+	// RequestsPerSecond rounded up is used.
+	RequestsBurst int `yaml:"requests_burst,omitempty" json:"requests_burst,omitempty"`
+	// ConcurrentStreams limits HTTP requests in flight and open TCP
+	// connections.
+	ConcurrentStreams int `yaml:"concurrent_streams,omitempty" json:"concurrent_streams,omitempty"`
+	// ConnectionsPerSecond limits new TCP connections, over limit
+	// connections are closed.
+	ConnectionsPerSecond float64 `yaml:"connections_per_second,omitempty" json:"connections_per_second,omitempty"`
+	// ConnectionsBurst is the number of connections allowed at once, if
+	// zero ConnectionsPerSecond rounded up is used.
+	ConnectionsBurst int `yaml:"connections_burst,omitempty" json:"connections_burst,omitempty"`
+	// BytesPerSecond limits bandwidth in each direction.
+	BytesPerSecond int64 `yaml:"bytes_per_second,omitempty" json:"bytes_per_second,omitempty"`
+}
+
+// rateLimitError is returned by RoundTrip when request is over limit.
+type rateLimitError struct {
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return "too many requests"
+}
+
+// retryAfter returns value of Retry-After header.
+func (e *rateLimitError) retryAfterSeconds() string {
+	return fmt.Sprint(int64(math.Max(1, math.Ceil(e.retryAfter.Seconds()))))
+}
+
+// tokenBucket is a token bucket filled with rate tokens per second up to
+// burst tokens.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mu     sync.Mutex
+}
+
+// newTokenBucket returns nil if rate is not positive.
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// take takes n tokens if available, otherwise it returns time after which
+// they would be available.
+func (b *tokenBucket) take(n float64) (time.Duration, bool) {
+	if b == nil {
+		return 0, true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	if b.tokens >= n {
+		b.tokens -= n
+		return 0, true
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second)), false
+}
+
+// refund returns n tokens taken with take.
+func (b *tokenBucket) refund(n float64) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	b.tokens = math.Min(b.burst, b.tokens+n)
+	b.mu.Unlock()
+}
+
+// wait takes n tokens, if there are not enough tokens it sleeps until the
+// debt is paid off.
+func (b *tokenBucket) wait(n int) {
+	if b == nil || n == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	debt := -b.tokens
+	b.mu.Unlock()
+
+	if debt > 0 {
+		time.Sleep(time.Duration(debt / b.rate * float64(time.Second)))
+	}
+}
+
+// limiter enforces Limits.
+type limiter struct {
+	requests *tokenBucket
+	conns    *tokenBucket
+	in       *tokenBucket
+	out      *tokenBucket
+	streams  chan struct{}
+}
+
+// newLimiter returns nil if l is nil.
+func newLimiter(l *Limits) *limiter {
+	if l == nil {
+		return nil
+	}
+
+	lim := &limiter{
+		requests: newTokenBucket(l.RequestsPerSecond, l.RequestsBurst),
+		conns:    newTokenBucket(l.ConnectionsPerSecond, l.ConnectionsBurst),
+		in:       newTokenBucket(float64(l.BytesPerSecond), int(l.BytesPerSecond)),
+		out:      newTokenBucket(float64(l.BytesPerSecond), int(l.BytesPerSecond)),
+	}
+	if l.ConcurrentStreams > 0 {
+		lim.streams = make(chan struct{}, l.ConcurrentStreams)
+	}
+	return lim
+}
+
+// gate returns limiter sharing request, connection and stream limits of l
+// without bandwidth limits.
+func (l *limiter) gate() *limiter {
+	if l == nil {
+		return nil
+	}
+	return &limiter{
+		requests: l.requests,
+		conns:    l.conns,
+		streams:  l.streams,
+	}
+}
+
+// bandwidth returns bucket of traffic from user to client if in is true,
+// otherwise bucket of traffic from client to user.
+func (l *limiter) bandwidth(in bool) *tokenBucket {
+	if l == nil {
+		return nil
+	}
+	if in {
+		return l.in
+	}
+	return l.out
+}
+
+// limiters is a list of limiters that must all allow an operation.
+type limiters []*limiter
+
+func (ls limiters) take(bucket func(*limiter) *tokenBucket) (time.Duration, bool) {
+	for i, l := range ls {
+		if l == nil {
+			continue
+		}
+		if wait, ok := bucket(l).take(1); !ok {
+			for _, l := range ls[:i] {
+				if l != nil {
+					bucket(l).refund(1)
+				}
+			}
+			return wait, false
+		}
+	}
+	return 0, true
+}
+
+func (ls limiters) allowRequest() (time.Duration, bool) {
+	return ls.take(func(l *limiter) *tokenBucket { return l.requests })
+}
+
+func (ls limiters) allowConn() bool {
+	_, ok := ls.take(func(l *limiter) *tokenBucket { return l.conns })
+	return ok
+}
+
+// acquireStream returns false if any of the limiters has no free stream,
+// otherwise it returns function releasing acquired streams.
+func (ls limiters) acquireStream() (func(), bool) {
+	var acquired []chan struct{}
+	release := func() {
+		for _, c := range acquired {
+			<-c
+		}
+	}
+
+	for _, l := range ls {
+		if l == nil || l.streams == nil {
+			continue
+		}
+		select {
+		case l.streams <- struct{}{}:
+			acquired = append(acquired, l.streams)
+		default:
+			release()
+			return nil, false
+		}
+	}
+
+	var once sync.Once
+	return func() { once.Do(release) }, true
+}
+
+func (ls limiters) reader(r io.Reader, bucket func(*limiter) *tokenBucket) io.Reader {
+	var buckets []*tokenBucket
+	for _, l := range ls {
+		if l != nil && bucket(l) != nil {
+			buckets = append(buckets, bucket(l))
+		}
+	}
+	if len(buckets) == 0 {
+		return r
+	}
+	return &shapedReader{r, buckets}
+}
+
+// inReader shapes traffic from user to client.
+func (ls limiters) inReader(r io.Reader) io.Reader {
+	return ls.reader(r, func(l *limiter) *tokenBucket { return l.in })
+}
+
+// outReader shapes traffic from client to user.
+func (ls limiters) outReader(r io.Reader) io.Reader {
+	return ls.reader(r, func(l *limiter) *tokenBucket { return l.out })
+}
+
+// inWriter shapes traffic written from user to client.
+func (ls limiters) inWriter(w io.Writer) io.Writer {
+	var buckets []*tokenBucket
+	for _, l := range ls {
+		if l != nil && l.in != nil {
+			buckets = append(buckets, l.in)
+		}
+	}
+	if len(buckets) == 0 {
+		return w
+	}
+	return &shapedWriter{w, buckets}
+}
+
+type shapedWriter struct {
+	w       io.Writer
+	buckets []*tokenBucket
+}
+
+func (w *shapedWriter) Write(p []byte) (int, error) {
+	for _, b := range w.buckets {
+		b.wait(len(p))
+	}
+	return w.w.Write(p)
+}
+
+type shapedReader struct {
+	r       io.Reader
+	buckets []*tokenBucket
+}
+
+func (r *shapedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	for _, b := range r.buckets {
+		b.wait(n)
+	}
+	return n, err
+}
+
+// shapedBody is response body with shaped reads that releases stream on
+// close.
+type shapedBody struct {
+	io.Reader
+	body    io.Closer
+	release func()
+}
+
+func (b *shapedBody) Close() error {
+	b.release()
+	return b.body.Close()
+}
+
+// shapedConn is a user connection with shaped reads and writes that releases
+// stream on close.
+type shapedConn struct {
+	net.Conn
+	r       io.Reader
+	ls      limiters
+	release func()
+}
+
+func (c *shapedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *shapedConn) Write(p []byte) (int, error) {
+	for _, l := range c.ls {
+		if l != nil {
+			l.out.wait(len(p))
+		}
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *shapedConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
+
+func (ls limiters) conn(conn net.Conn, release func()) net.Conn {
+	return &shapedConn{
+		Conn:    conn,
+		r:       ls.inReader(conn),
+		ls:      ls,
+		release: release,
+	}
+}
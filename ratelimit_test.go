@@ -0,0 +1,142 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+func TestTokenBucket(t *testing.T) {
+	t.Parallel()
+
+	if newTokenBucket(0, 10) != nil {
+		t.Fatal("expected nil bucket")
+	}
+
+	b := newTokenBucket(10, 2)
+	for i := 0; i < 2; i++ {
+		if _, ok := b.take(1); !ok {
+			t.Fatal("expected token", i)
+		}
+	}
+	wait, ok := b.take(1)
+	if ok {
+		t.Fatal("expected no token")
+	}
+	if wait <= 0 || wait > 100*time.Millisecond {
+		t.Fatal("unexpected wait", wait)
+	}
+	b.refund(1)
+	if _, ok := b.take(1); !ok {
+		t.Fatal("expected refunded token")
+	}
+}
+
+func TestLimiters(t *testing.T) {
+	t.Parallel()
+
+	client := newLimiter(&Limits{RequestsPerSecond: 1, RequestsBurst: 2, ConcurrentStreams: 1})
+	tunnel := newLimiter(&Limits{RequestsPerSecond: 1})
+	other := newLimiter(&Limits{RequestsPerSecond: 1})
+
+	if _, ok := (limiters{tunnel, client}).allowRequest(); !ok {
+		t.Fatal("expected request allowed")
+	}
+	if _, ok := (limiters{tunnel, client}).allowRequest(); ok {
+		t.Fatal("expected tunnel limit")
+	}
+	// tunnel limit must not consume client tokens
+	if _, ok := (limiters{other, client}).allowRequest(); !ok {
+		t.Fatal("expected request allowed")
+	}
+	if _, ok := (limiters{nil, client}).allowRequest(); ok {
+		t.Fatal("expected client limit")
+	}
+
+	release, ok := (limiters{tunnel, client}).acquireStream()
+	if !ok {
+		t.Fatal("expected stream")
+	}
+	if _, ok := (limiters{other, client}).acquireStream(); ok {
+		t.Fatal("expected stream limit")
+	}
+	release()
+	release()
+	if _, ok := (limiters{other, client}).acquireStream(); !ok {
+		t.Fatal("expected stream")
+	}
+}
+
+func TestLimiters_Reader(t *testing.T) {
+	t.Parallel()
+
+	ls := limiters{newLimiter(&Limits{BytesPerSecond: 10000})}
+
+	start := time.Now()
+	b, err := ioutil.ReadAll(ls.inReader(bytes.NewReader(make([]byte, 15000))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 15000 {
+		t.Fatal("unexpected length", len(b))
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Fatal("transfer not shaped", d)
+	}
+}
+
+func TestServer_RateLimit(t *testing.T) {
+	t.Parallel()
+
+	cert, err := tls.LoadX509KeyPair("./testdata/selfsigned.crt", "./testdata/selfsigned.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(&ServerConfig{
+		Addr:         "127.0.0.1:0",
+		TLSConfig:    &tls.Config{Certificates: []tls.Certificate{cert}},
+		TunnelLimits: &Limits{RequestsPerSecond: 0.5},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.listener.Close()
+
+	identifier := id.New([]byte("client"))
+	s.Subscribe(identifier)
+	if err := s.addTunnels(map[string]*proto.Tunnel{
+		"web": {Protocol: proto.HTTP, Host: "app.example.com"},
+	}, identifier); err != nil {
+		t.Fatal(err)
+	}
+
+	// client is not connected
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Fatal("unexpected status", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatal("expected too many requests got", w.Code)
+	}
+	if v := w.Header().Get("Retry-After"); v != "2" {
+		t.Fatal("unexpected Retry-After", v)
+	}
+	if v := s.Metrics().Get(MetricRequestsRateLimited).String(); v != "1" {
+		t.Fatal("unexpected metric value", v)
+	}
+}
@@ -18,17 +18,34 @@ import (
 type RegistryItem struct {
 	Hosts     []*HostAuth
 	Listeners []net.Listener
+
+	tunnels []*tunnelInfo
 }
 
 // HostAuth holds host and authentication info.
 type HostAuth struct {
 	Host string
 	Auth *Auth
+
+	tunnel *tunnelInfo
 }
 
 type hostInfo struct {
 	identifier id.ID
 	auth       *Auth
+	tunnel     *tunnelInfo
+}
+
+// tunnelInfo holds server side state of a tunnel.
+type tunnelInfo struct {
+	name     string
+	protocol string
+	host     string
+	addr     string
+	acl      *ipACL
+	limiters limiters
+	headers  *HeaderRewriter
+	encoding string
 }
 
 type registry struct {
@@ -91,6 +108,19 @@ func (r *registry) Subscriber(hostPort string) (id.ID, *Auth, bool) {
 	return h.identifier, h.auth, ok
 }
 
+// hostTunnel returns tunnel serving a host, if host is not found or tunnel
+// is not set it returns empty tunnel.
+func (r *registry) hostTunnel(hostPort string) *tunnelInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	h, ok := r.hosts[trimPort(hostPort)]
+	if !ok || h.tunnel == nil {
+		return &tunnelInfo{}
+	}
+	return h.tunnel
+}
+
 // Unsubscribe removes client from registry and returns it's RegistryItem.
 func (r *registry) Unsubscribe(identifier id.ID) *RegistryItem {
 	r.mu.Lock()
@@ -138,8 +168,10 @@ func (r *registry) set(i *RegistryItem, identifier id.ID) error {
 
 	if i.Hosts != nil {
 		for _, h := range i.Hosts {
-			if h.Auth != nil && h.Auth.User == "" {
-				return fmt.Errorf("missing auth user")
+			if h.Auth != nil {
+				if err := h.Auth.validate(); err != nil {
+					return err
+				}
 			}
 			if _, ok := r.hosts[trimPort(h.Host)]; ok {
 				return fmt.Errorf("host %q is occupied", h.Host)
@@ -150,6 +182,7 @@ func (r *registry) set(i *RegistryItem, identifier id.ID) error {
 			r.hosts[trimPort(h.Host)] = &hostInfo{
 				identifier: identifier,
 				auth:       h.Auth,
+				tunnel:     h.tunnel,
 			}
 		}
 	}
@@ -159,6 +192,18 @@ func (r *registry) set(i *RegistryItem, identifier id.ID) error {
 	return nil
 }
 
+// tunnels returns tunnels opened by client.
+func (r *registry) tunnels(identifier id.ID) []*tunnelInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	i, ok := r.items[identifier]
+	if !ok {
+		return nil
+	}
+	return i.tunnels
+}
+
 func (r *registry) clear(identifier id.ID) *RegistryItem {
 	r.logger.Log(
 		"level", 2,
@@ -0,0 +1,193 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+)
+
+// revocation holds client certificates and identifiers that are not allowed
+// to connect. It's loaded from a certificate revocation list and a deny list
+// file, the zero value allows everything.
+type revocation struct {
+	crl     *x509.RevocationList
+	revoked map[string]struct{}
+	ids     map[id.ID]struct{}
+	serials map[string]struct{}
+}
+
+// loadRevocation reads CRL and deny list files, empty file name disables
+// given source. CRL must be signed by one of issuers and must not be past
+// its next update.
+func loadRevocation(crlFile, denyFile string, issuers []*x509.Certificate) (*revocation, error) {
+	r := &revocation{
+		revoked: make(map[string]struct{}),
+		ids:     make(map[id.ID]struct{}),
+		serials: make(map[string]struct{}),
+	}
+
+	if crlFile != "" {
+		if err := r.loadCRL(crlFile, issuers); err != nil {
+			return nil, fmt.Errorf("CRL %q: %s", crlFile, err)
+		}
+	}
+	if denyFile != "" {
+		if err := r.loadDenyList(denyFile); err != nil {
+			return nil, fmt.Errorf("deny list %q: %s", denyFile, err)
+		}
+	}
+
+	return r, nil
+}
+
+func (r *revocation) loadCRL(file string, issuers []*x509.Certificate) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if p, _ := pem.Decode(b); p != nil {
+		if p.Type != "X509 CRL" {
+			return fmt.Errorf("unexpected PEM block type %q", p.Type)
+		}
+		b = p.Bytes
+	}
+
+	crl, err := x509.ParseRevocationList(b)
+	if err != nil {
+		return err
+	}
+	if err := checkCRLIssuer(crl, issuers); err != nil {
+		return err
+	}
+	if crlStale(crl) {
+		return fmt.Errorf("stale, next update was due %s", crl.NextUpdate.Format(time.RFC3339))
+	}
+	for _, e := range crl.RevokedCertificateEntries {
+		r.revoked[e.SerialNumber.String()] = struct{}{}
+	}
+	r.crl = crl
+
+	return nil
+}
+
+// checkCRLIssuer verifies that CRL is signed by one of issuers.
+func checkCRLIssuer(crl *x509.RevocationList, issuers []*x509.Certificate) error {
+	if len(issuers) == 0 {
+		return errors.New("no trusted issuer certificates")
+	}
+	for _, c := range issuers {
+		if !bytes.Equal(c.RawSubject, crl.RawIssuer) {
+			continue
+		}
+		if err := crl.CheckSignatureFrom(c); err == nil {
+			return nil
+		}
+	}
+	return errors.New("not signed by a trusted issuer")
+}
+
+// crlStale returns true if CRL is past its next update.
+func crlStale(crl *x509.RevocationList) bool {
+	return !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate)
+}
+
+// loadDenyList reads a file where each line is either "id <client id>" or
+// "serial <hex serial number>", empty lines and lines starting with # are
+// ignored.
+func (r *revocation) loadDenyList(file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			return fmt.Errorf("line %d: expected \"id <id>\" or \"serial <hex>\"", n)
+		}
+
+		switch f[0] {
+		case "id":
+			var identifier id.ID
+			if err := identifier.UnmarshalText([]byte(f[1])); err != nil {
+				return fmt.Errorf("line %d: %s", n, err)
+			}
+			r.ids[identifier] = struct{}{}
+		case "serial":
+			serial, err := parseSerial(f[1])
+			if err != nil {
+				return fmt.Errorf("line %d: %s", n, err)
+			}
+			r.serials[serial.String()] = struct{}{}
+		default:
+			return fmt.Errorf("line %d: unknown entry type %q", n, f[0])
+		}
+	}
+
+	return s.Err()
+}
+
+// parseSerial parses hex serial number, bytes may be separated with colons as
+// printed by openssl.
+func parseSerial(s string) (*big.Int, error) {
+	s = strings.Replace(s, ":", "", -1)
+	if len(s)%2 == 1 {
+		s = "0" + s
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid serial number: %s", err)
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// check returns error if client with a given identifier and certificate is
+// not allowed to connect.
+func (r *revocation) check(identifier id.ID, cert *x509.Certificate) error {
+	if r == nil {
+		return nil
+	}
+	if _, ok := r.ids[identifier]; ok {
+		return fmt.Errorf("client %s is denied", identifier)
+	}
+	if cert == nil {
+		return nil
+	}
+
+	serial := cert.SerialNumber.String()
+	if _, ok := r.serials[serial]; ok {
+		return fmt.Errorf("certificate serial %s is denied", serial)
+	}
+	if r.crl != nil && bytes.Equal(cert.RawIssuer, r.crl.RawIssuer) {
+		if _, ok := r.revoked[serial]; ok {
+			return fmt.Errorf("certificate serial %s is revoked", serial)
+		}
+	}
+
+	return nil
+}
+
+// certExpiresWithin returns true if certificate expires in less than d.
+func certExpiresWithin(cert *x509.Certificate, d time.Duration) bool {
+	return cert != nil && time.Until(cert.NotAfter) < d
+}
@@ -0,0 +1,185 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+)
+
+func TestRevocation_Check(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "revocation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := func(serial int64) *x509.Certificate {
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "client"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	crlDER, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number: big.NewInt(1),
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: big.NewInt(2), RevocationTime: time.Now()},
+		},
+	}, ca, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crlFile := filepath.Join(dir, "ca.crl")
+	if err := ioutil.WriteFile(crlFile, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	denied := cert(4)
+	deniedID := id.New(denied.Raw)
+	denyFile := filepath.Join(dir, "deny.txt")
+	deny := "# denied clients\n\nid " + deniedID.String() + "\nserial 03\n"
+	if err := ioutil.WriteFile(denyFile, []byte(deny), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := loadRevocation(crlFile, denyFile, []*x509.Certificate{ca})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		cert    *x509.Certificate
+		revoked bool
+	}{
+		{cert(1), false},
+		{cert(2), true},
+		{cert(3), true},
+		{denied, true},
+		{cert(5), false},
+	}
+
+	for i, tt := range tests {
+		err := r.check(id.New(tt.cert.Raw), tt.cert)
+		if tt.revoked && err == nil {
+			t.Errorf("[%d] expected error", i)
+		}
+		if !tt.revoked && err != nil {
+			t.Errorf("[%d] unexpected error: %s", i, err)
+		}
+	}
+
+	// CRL must be signed by a trusted issuer and must be fresh
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &otherKey.PublicKey, otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := x509.ParseCertificate(otherDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadRevocation(crlFile, "", nil); err == nil {
+		t.Error("expected error without issuers")
+	}
+	if _, err := loadRevocation(crlFile, "", []*x509.Certificate{other}); err == nil {
+		t.Error("expected error for CRL of other issuer")
+	}
+
+	staleDER, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(2),
+		ThisUpdate: time.Now().Add(-2 * time.Hour),
+		NextUpdate: time.Now().Add(-time.Hour),
+	}, ca, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	staleFile := filepath.Join(dir, "stale.crl")
+	if err := ioutil.WriteFile(staleFile, staleDER, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadRevocation(staleFile, "", []*x509.Certificate{ca}); err == nil {
+		t.Error("expected error for stale CRL")
+	}
+}
+
+func TestParseSerial(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		serial   string
+		expected int64
+	}{
+		{"01", 1},
+		{"1", 1},
+		{"0a:1b", 0x0a1b},
+		{"A1B", 0xa1b},
+	}
+
+	for i, tt := range tests {
+		actual, err := parseSerial(tt.serial)
+		if err != nil {
+			t.Errorf("[%d] unexpected error: %s", i, err)
+			continue
+		}
+		if actual.Int64() != tt.expected {
+			t.Errorf("[%d] expected %d got %s", i, tt.expected, actual)
+		}
+	}
+
+	if _, err := parseSerial("xyz"); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -7,22 +7,28 @@ package tunnel
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
     "github.com/mmatczuk/go-http-tunnel/keepalive"
     "io"
 	"net"
 	"net/http"
+	"path"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/quic-go/quic-go"
 	"golang.org/x/net/http2"
 
 	"github.com/inconshreveable/go-vhost"
 	"github.com/mmatczuk/go-http-tunnel/id"
 	"github.com/mmatczuk/go-http-tunnel/log"
 	"github.com/mmatczuk/go-http-tunnel/proto"
+	"github.com/mmatczuk/go-http-tunnel/trace"
 )
 
 // ServerConfig defines configuration for the Server.
@@ -38,6 +44,9 @@ type ServerConfig struct {
 	// Listener specifies optional listener for client connections. If nil
 	// tls.Listen("tcp", Addr, TLSConfig) is used.
 	Listener net.Listener
+	// QUICAddr is optional UDP address to listen for client connections
+	// over QUIC, it uses TLSConfig. If empty QUIC is disabled.
+	QUICAddr string
 	// Logger is optional logger. If nil logging is disabled.
 	Logger log.Logger
 	// Addr is TCP address to listen for TLS SNI connections
@@ -46,6 +55,61 @@ type ServerConfig struct {
 	KeepAlive *keepalive.KeepAlive
 	// The address to use for the health check listener. If empty no health check listener will be created.
 	HealthCheckAddr string
+	// CRLFile is optional path to a PEM or DER encoded certificate
+	// revocation list, clients presenting revoked certificates are rejected.
+	CRLFile string
+	// CRLIssuers are certificates of authorities trusted to sign CRLFile,
+	// usually client root CA certificates. CRL signed by other issuer or
+	// past its next update is rejected.
+	CRLIssuers []*x509.Certificate
+	// DenyListFile is optional path to a file listing denied client ids
+	// and certificate serial numbers, see ReloadRevocation.
+	DenyListFile string
+	// CertExpiryWarning specifies how long before client certificate
+	// expiry server starts logging warnings. If zero
+	// DefaultCertExpiryWarning is used.
+	CertExpiryWarning time.Duration
+	// Authorizer is optional authorizer deciding which tunnels a client may
+	// open. If nil all tunnels are allowed.
+	Authorizer Authorizer
+	// TokenAuth enables authenticating clients that do not present a
+	// certificate with a token sent in handshake response. TLSConfig
+	// ClientAuth must allow connections without client certificate.
+	TokenAuth *TokenAuth
+	// AuthOverrides maps host patterns to authentication of HTTP tunnels,
+	// matching tunnels use it instead of auth requested by the client.
+	// Patterns are matched with path.Match, the longest matching pattern
+	// wins.
+	AuthOverrides map[string]*proto.AuthConfig
+	// OIDC enables OpenID Connect login for HTTP tunnels with oidc auth.
+	OIDC *OIDCConfig
+	// AllowCIDRs and DenyCIDRs are server wide CIDR lists, they override
+	// tunnel lists. Addresses in DenyCIDRs are denied access to all
+	// tunnels, addresses in AllowCIDRs are allowed access to all tunnels,
+	// other addresses are checked against tunnel lists.
+	AllowCIDRs []string
+	DenyCIDRs  []string
+	// ClientLimits are rate limits applied to all tunnels of a client
+	// together. If nil client traffic is not limited.
+	ClientLimits *Limits
+	// TunnelLimits are rate limits applied to every tunnel separately. If
+	// nil tunnel traffic is not limited.
+	TunnelLimits *Limits
+	// Ledger if not nil accounts usage of clients and enforces monthly
+	// quotas.
+	Ledger *Ledger
+	// AccessLog if not nil records proxied HTTP requests and TCP
+	// connections.
+	AccessLog AccessLogger
+	// Tracer if not nil traces proxied HTTP requests, trace context is
+	// passed to the client in control message.
+	Tracer *trace.Tracer
+	// ErrorPages if not nil renders error pages sent to users instead of
+	// plain text errors.
+	ErrorPages *ErrorPages
+	// Maintenance is a list of host patterns put in maintenance, requests
+	// to matching hosts get 503 Service Unavailable, see SetMaintenance.
+	Maintenance []string
 }
 
 // Server is responsible for proxying public connections to the client over a
@@ -55,12 +119,27 @@ type Server struct {
 	config *ServerConfig
 
 	listener   net.Listener
+	quic       *quic.Listener
 	hlthChk    net.Listener
 	connPool   *connPool
 	httpClient *http.Client
 	logger     log.Logger
 	vhostMuxer *vhost.TLSMuxer
 	shutdown   chan struct{}
+	metrics    *expvar.Map
+
+	revocation   *revocation
+	revocationMu sync.RWMutex
+
+	oidc   *oidcProvider
+	acl    *ipACL
+	events eventBus
+
+	maintenance   []string
+	maintenanceMu sync.RWMutex
+
+	done     chan struct{}
+	stopOnce sync.Once
 }
 
 // NewServer creates a new Server.
@@ -75,12 +154,48 @@ func NewServer(config *ServerConfig) (*Server, error) {
 		logger = log.NewNopLogger()
 	}
 
+	r, err := loadRevocation(config.CRLFile, config.DenyListFile, config.CRLIssuers)
+	if err != nil {
+		return nil, err
+	}
+
 	s := &Server{
-		registry: newRegistry(logger),
-		config:   config,
-		listener: listener,
-		logger:   logger,
-		shutdown: make(chan struct{}, 1),
+		registry:   newRegistry(logger),
+		config:     config,
+		listener:   listener,
+		logger:     logger,
+		shutdown:   make(chan struct{}, 1),
+		metrics:    newMetrics(),
+		revocation: r,
+		done:       make(chan struct{}),
+	}
+
+	if config.OIDC != nil {
+		if s.oidc, err = newOIDCProvider(config.OIDC); err != nil {
+			return nil, err
+		}
+	}
+	s.metrics.Set(MetricRateLimits, expvar.Func(func() interface{} {
+		return map[string]*Limits{
+			"client": config.ClientLimits,
+			"tunnel": config.TunnelLimits,
+		}
+	}))
+
+	if s.acl, err = newIPACL(config.AllowCIDRs, config.DenyCIDRs); err != nil {
+		return nil, err
+	}
+	for pattern, c := range config.AuthOverrides {
+		a := NewHTTPAuth("", c)
+		if err := a.validate(); err != nil {
+			return nil, fmt.Errorf("auth override %q: %s", pattern, err)
+		}
+		if a.OIDC != nil && s.oidc == nil {
+			return nil, fmt.Errorf("auth override %q: oidc is not configured", pattern)
+		}
+	}
+	if err := s.SetMaintenance(config.Maintenance); err != nil {
+		return nil, err
 	}
 
 	t := &http2.Transport{}
@@ -88,12 +203,22 @@ func NewServer(config *ServerConfig) (*Server, error) {
 	t.ConnPool = pool
 	s.connPool = pool
 	s.httpClient = &http.Client{
-		Transport: t,
+		Transport: pool,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
 	}
 
+	if config.QUICAddr != "" {
+		if config.TLSConfig == nil {
+			return nil, errors.New("missing TLSConfig")
+		}
+		s.quic, err = quic.ListenAddr(config.QUICAddr, quicTLSConfig(config.TLSConfig), quicConfig())
+		if err != nil {
+			return nil, fmt.Errorf("QUIC listener failed: %s", err)
+		}
+	}
+
 	if config.SNIAddr != "" {
 		l, err := net.Listen("tcp", config.SNIAddr)
 		if err != nil {
@@ -169,10 +294,18 @@ func (s *Server) disconnected(identifier id.ID) {
 		"identifier", identifier,
 	)
 
+	s.deleteCertExpiry(identifier)
+
 	i := s.registry.clear(identifier)
 	if i == nil {
 		return
 	}
+
+	s.publish(&Event{Type: EventClientDisconnected, Identifier: identifier})
+	for _, t := range i.tunnels {
+		s.publishTunnel(EventTunnelClosed, identifier, t)
+	}
+
 	for _, l := range i.Listeners {
 		s.logger.Log(
 			"level", 2,
@@ -207,6 +340,11 @@ func (s *Server) Start() {
 		}
 	}
 
+	if s.quic != nil {
+		go s.serveQUIC()
+	}
+	go s.watchExpiry()
+
 	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
@@ -217,7 +355,9 @@ func (s *Server) Start() {
 					"addr", addr,
 				)
 				s.shutdown <- struct{}{}
-				s.hlthChk.Close()
+				if s.hlthChk != nil {
+					s.hlthChk.Close()
+				}
 				return
 			}
 
@@ -248,6 +388,40 @@ func (s *Server) Start() {
 	}
 }
 
+func (s *Server) serveQUIC() {
+	addr := s.quic.Addr().String()
+
+	s.logger.Log(
+		"level", 1,
+		"action", "start quic",
+		"addr", addr,
+	)
+
+	for {
+		conn, err := s.quic.Accept(context.Background())
+		if err != nil {
+			if err == quic.ErrServerClosed {
+				s.logger.Log(
+					"level", 1,
+					"action", "quic control connection listener closed",
+					"addr", addr,
+				)
+				return
+			}
+
+			s.logger.Log(
+				"level", 0,
+				"msg", "accept of quic control connection failed",
+				"addr", addr,
+				"err", err,
+			)
+			continue
+		}
+
+		go s.handleClient(&quicConn{conn})
+	}
+}
+
 func (s *Server) startHeathCheckListener() error  {
 
 	err := s.createHealthCheckListener()
@@ -321,13 +495,17 @@ func (s *Server) handleClient(conn net.Conn) {
 		req        *http.Request
 		resp       *http.Response
 		tunnels    map[string]*proto.Tunnel
+		cert       *x509.Certificate
+		claims     *TokenClaims
+		denied     []string
 		err        error
 		ok         bool
+		tokenAuth  bool
 
 		inConnPool bool
 	)
 
-	tlsConn, ok := conn.(*tls.Conn)
+	tlsConn, ok := conn.(id.TLSConn)
 	if !ok {
 		logger.Log(
 			"level", 0,
@@ -338,6 +516,12 @@ func (s *Server) handleClient(conn net.Conn) {
 	}
 
 	identifier, err = id.PeerID(tlsConn)
+	if err != nil && s.config.TokenAuth != nil && peerCertificate(tlsConn) == nil && tlsConn.ConnectionState().HandshakeComplete {
+		// client without certificate gets a temporary identifier until
+		// it presents a token in handshake
+		identifier, err = tempIdentifier()
+		tokenAuth = true
+	}
 	if err != nil {
 		logger.Log(
 			"level", 2,
@@ -347,16 +531,29 @@ func (s *Server) handleClient(conn net.Conn) {
 		goto reject
 	}
 
-	logger = logger.With("identifier", identifier)
+	if !tokenAuth {
+		logger = logger.With("identifier", identifier)
 
-	if s.config.AutoSubscribe {
-		s.Subscribe(identifier)
-	} else if !s.IsSubscribed(identifier) {
-		logger.Log(
-			"level", 2,
-			"msg", "unknown client",
-		)
-		goto reject
+		cert = peerCertificate(tlsConn)
+		if err = s.checkRevocation(identifier, cert); err != nil {
+			s.metrics.Add(MetricClientsRevoked, 1)
+			logger.Log(
+				"level", 2,
+				"msg", "certificate revoked",
+				"err", err,
+			)
+			goto reject
+		}
+
+		if s.config.AutoSubscribe {
+			s.Subscribe(identifier)
+		} else if !s.IsSubscribed(identifier) {
+			logger.Log(
+				"level", 2,
+				"msg", "unknown client",
+			)
+			goto reject
+		}
 	}
 
 	if err = conn.SetDeadline(time.Time{}); err != nil {
@@ -414,6 +611,45 @@ func (s *Server) handleClient(conn net.Conn) {
 		goto reject
 	}
 
+	if tokenAuth {
+		claims, err = s.config.TokenAuth.Verify(resp.Header.Get(proto.HeaderToken))
+		if err != nil {
+			logger.Log(
+				"level", 2,
+				"msg", "token error",
+				"err", err,
+			)
+			goto reject
+		}
+
+		tokenID := claims.Identifier()
+		logger = logger.With("identifier", tokenID, "subject", claims.Subject)
+
+		if err = s.checkRevocation(tokenID, nil); err != nil {
+			s.metrics.Add(MetricClientsRevoked, 1)
+			logger.Log(
+				"level", 2,
+				"msg", "token revoked",
+				"err", err,
+			)
+			goto reject
+		}
+
+		if err = s.connPool.Rekey(identifier, tokenID); err != nil {
+			logger.Log(
+				"level", 2,
+				"msg", "adding connection failed",
+				"err", err,
+			)
+			goto reject
+		}
+		identifier = tokenID
+
+		// token is signed by trusted issuer, no need for explicit
+		// subscription
+		s.Subscribe(identifier)
+	}
+
 	if resp.ContentLength == 0 {
 		err = fmt.Errorf("Tunnels Content-Legth: 0")
 		logger.Log(
@@ -443,6 +679,44 @@ func (s *Server) handleClient(conn net.Conn) {
 		goto reject
 	}
 
+	if claims != nil {
+		if err = claims.authorize(tunnels); err != nil {
+			logger.Log(
+				"level", 2,
+				"msg", "handshake failed",
+				"err", err,
+			)
+			goto reject
+		}
+	}
+
+	if s.config.Authorizer != nil {
+		tunnels, denied, err = authorize(s.config.Authorizer, &AuthorizationRequest{
+			Certificate: cert,
+			Identifier:  identifier,
+			RemoteAddr:  conn.RemoteAddr().String(),
+			Tunnels:     tunnels,
+		})
+		if err == nil && len(tunnels) == 0 {
+			err = fmt.Errorf("tunnels not authorized: %s", strings.Join(denied, ", "))
+		}
+		if err != nil {
+			logger.Log(
+				"level", 2,
+				"msg", "handshake failed",
+				"err", err,
+			)
+			goto reject
+		}
+		if len(denied) != 0 {
+			logger.Log(
+				"level", 1,
+				"action", "tunnels not authorized",
+				"denied", strings.Join(denied, ", "),
+			)
+		}
+	}
+
 	if err = s.addTunnels(tunnels, identifier); err != nil {
 		logger.Log(
 			"level", 2,
@@ -457,6 +731,21 @@ func (s *Server) handleClient(conn net.Conn) {
 		"action", "connected",
 	)
 
+	s.publish(&Event{
+		Type:       EventClientConnected,
+		Identifier: identifier,
+		RemoteAddr: conn.RemoteAddr().String(),
+	})
+	for _, t := range s.registry.tunnels(identifier) {
+		s.publishTunnel(EventTunnelOpened, identifier, t)
+	}
+
+	s.checkCertExpiry(identifier, cert, logger)
+
+	if len(denied) != 0 {
+		s.notify(identifier, proto.HeaderWarning, "tunnels not authorized: "+strings.Join(denied, ", "))
+	}
+
 	return
 
 reject:
@@ -465,6 +754,20 @@ reject:
 		"action", "rejected",
 	)
 
+	{
+		e := &Event{
+			Type:       EventClientRejected,
+			RemoteAddr: conn.RemoteAddr().String(),
+		}
+		if !tokenAuth || claims != nil {
+			e.Identifier = identifier
+		}
+		if err != nil {
+			e.Reason = err.Error()
+		}
+		s.publish(e)
+	}
+
 	if inConnPool {
 		s.notifyError(err, identifier)
 		s.connPool.DeleteConn(identifier)
@@ -478,39 +781,86 @@ func (s *Server) notifyError(serverError error, identifier id.ID) {
 	if serverError == nil {
 		return
 	}
+	s.notify(identifier, proto.HeaderError, serverError.Error())
+}
 
+// notify tries to send a notification with header set to value to client.
+func (s *Server) notify(identifier id.ID, header, value string) {
 	req, err := http.NewRequest(http.MethodConnect, s.connPool.URL(identifier), nil)
 	if err != nil {
 		s.logger.Log(
 			"level", 2,
-			"action", "client error notification failed",
+			"action", "client notification failed",
 			"identifier", identifier,
 			"err", err,
 		)
 		return
 	}
 
-	req.Header.Set(proto.HeaderError, serverError.Error())
+	req.Header.Set(header, value)
 
 	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
 	defer cancel()
 
-	s.httpClient.Do(req.WithContext(ctx))
+	resp, err := s.httpClient.Do(req.WithContext(ctx))
+	if err == nil {
+		resp.Body.Close()
+	}
 }
 
 // addTunnels invokes addHost or addListener based on data from proto.Tunnel. If
 // a tunnel cannot be added whole batch is reverted.
 func (s *Server) addTunnels(tunnels map[string]*proto.Tunnel, identifier id.ID) error {
+	if s.config.Ledger.exceeded(identifier) {
+		s.metrics.Add(MetricQuotaExceeded, 1)
+		return errQuotaExceeded
+	}
+
 	i := &RegistryItem{
 		Hosts:     []*HostAuth{},
 		Listeners: []net.Listener{},
 	}
 	f := make(map[net.Listener]string)
+	ti := make(map[net.Listener]*tunnelInfo)
+	client := newLimiter(s.config.ClientLimits)
 	var err error
 	for name, t := range tunnels {
+		info := &tunnelInfo{
+			name:     name,
+			protocol: t.Protocol,
+			limiters: limiters{newLimiter(s.config.TunnelLimits), client},
+		}
+		i.tunnels = append(i.tunnels, info)
+		info.acl, err = newIPACL(t.AllowCIDRs, t.DenyCIDRs)
+		if err != nil {
+			err = fmt.Errorf("tunnel %s: %s", name, err)
+			goto rollback
+		}
+		info.encoding = negotiateEncoding(t.Compression)
+		if info.encoding == "" && len(t.Compression) > 0 {
+			s.logger.Log(
+				"level", 1,
+				"msg", "unsupported compression, tunnel will not be compressed",
+				"identifier", identifier,
+				"tunnel", name,
+				"compression", t.Compression,
+			)
+		}
+
 		switch t.Protocol {
 		case proto.HTTP:
-			i.Hosts = append(i.Hosts, &HostAuth{t.Host, NewAuth(t.Auth)})
+			auth := s.httpAuth(t)
+			if auth != nil && auth.OIDC != nil && s.oidc == nil {
+				err = fmt.Errorf("host %q: oidc auth is not configured on server", t.Host)
+				goto rollback
+			}
+			info.headers, err = NewHeaderRewriter(name, t.Headers)
+			if err != nil {
+				err = fmt.Errorf("tunnel %s: %s", name, err)
+				goto rollback
+			}
+			info.host = t.Host
+			i.Hosts = append(i.Hosts, &HostAuth{Host: t.Host, Auth: auth, tunnel: info})
 		case proto.HTTPCONNECT:
 			var l net.Listener
 
@@ -526,8 +876,39 @@ func (s *Server) addTunnels(tunnels map[string]*proto.Tunnel, identifier id.ID)
 				"addr", l.Addr(),
 			)
 
+			info.addr = l.Addr().String()
 			i.Listeners = append(i.Listeners, l)
 			f[l] = proto.HTTPCONNECT
+			ti[l] = info
+		case proto.SOCKS5:
+			var (
+				l  net.Listener
+				pc net.PacketConn
+			)
+
+			l, err = net.Listen(proto.TCP, t.Addr)
+			if err != nil {
+				goto rollback
+			}
+			// UDP ASSOCIATE relay listens on the same port
+			pc, err = net.ListenPacket("udp", l.Addr().String())
+			if err != nil {
+				l.Close()
+				goto rollback
+			}
+
+			s.logger.Log(
+				"level", 2,
+				"action", "open listener",
+				"identifier", identifier,
+				"addr", l.Addr(),
+			)
+
+			sl := newSocksListener(l, pc)
+			info.addr = l.Addr().String()
+			i.Listeners = append(i.Listeners, sl)
+			f[sl] = proto.SOCKS5
+			ti[sl] = info
 		case proto.TCP, proto.TCP4, proto.TCP6, proto.UNIX:
 			var l net.Listener
 
@@ -543,7 +924,9 @@ func (s *Server) addTunnels(tunnels map[string]*proto.Tunnel, identifier id.ID)
 				"addr", l.Addr(),
 			)
 
+			info.addr = l.Addr().String()
 			i.Listeners = append(i.Listeners, l)
+			ti[l] = info
 
 		case proto.SNI:
 			if s.vhostMuxer == nil {
@@ -563,7 +946,9 @@ func (s *Server) addTunnels(tunnels map[string]*proto.Tunnel, identifier id.ID)
 				"host", t.Host,
 			)
 
+			info.host = t.Host
 			i.Listeners = append(i.Listeners, l)
+			ti[l] = info
 
 		default:
 			err = fmt.Errorf("unsupported protocol for tunnel %s: %s", name, t.Protocol)
@@ -578,12 +963,13 @@ func (s *Server) addTunnels(tunnels map[string]*proto.Tunnel, identifier id.ID)
 
 	for _, l := range i.Listeners {
 		p, ok := f[l]
-		if ok {
-			go s.listenExt(l, identifier, p)
-		} else {
-			go s.listen(l, identifier)
+		if !ok {
+			p = l.Addr().Network()
+		}
+		go s.listenExt(l, identifier, p, ti[l])
+		if sl, ok := l.(*socksListener); ok {
+			go s.relayUDP(identifier, sl, ti[l])
 		}
-
 	}
 	return nil
 
@@ -595,6 +981,110 @@ rollback:
 	return err
 }
 
+// ReloadRevocation reloads CRL and deny list files and disconnects connected
+// clients that are no longer allowed. The deny list file contains one entry
+// per line, either "id <client id>" or "serial <hex serial number>", empty
+// lines and lines starting with # are ignored.
+func (s *Server) ReloadRevocation() error {
+	r, err := loadRevocation(s.config.CRLFile, s.config.DenyListFile, s.config.CRLIssuers)
+	if err != nil {
+		return err
+	}
+
+	s.revocationMu.Lock()
+	s.revocation = r
+	s.revocationMu.Unlock()
+
+	s.logger.Log(
+		"level", 1,
+		"action", "revocation reloaded",
+	)
+
+	s.connPool.DeleteConnFunc(func(identifier id.ID, conn net.Conn) bool {
+		err := r.check(identifier, peerCertificate(conn))
+		if err == nil {
+			return false
+		}
+
+		s.metrics.Add(MetricClientsRevokedDisconnected, 1)
+		s.logger.Log(
+			"level", 1,
+			"action", "disconnect revoked",
+			"identifier", identifier,
+			"err", err,
+		)
+		return true
+	})
+
+	return nil
+}
+
+func (s *Server) checkRevocation(identifier id.ID, cert *x509.Certificate) error {
+	s.revocationMu.RLock()
+	defer s.revocationMu.RUnlock()
+	return s.revocation.check(identifier, cert)
+}
+
+// checkCertExpiry logs a warning if client certificate is close to expiry and
+// exposes time to expiry in metrics.
+func (s *Server) checkCertExpiry(identifier id.ID, cert *x509.Certificate, logger log.Logger) {
+	if cert == nil {
+		return
+	}
+
+	s.setCertExpiry(identifier, cert.NotAfter)
+
+	d := s.config.CertExpiryWarning
+	if d == 0 {
+		d = DefaultCertExpiryWarning
+	}
+	if certExpiresWithin(cert, d) {
+		s.metrics.Add(MetricCertExpiryWarnings, 1)
+		logger.Log(
+			"level", 0,
+			"msg", "client certificate close to expiry",
+			"notAfter", cert.NotAfter,
+		)
+	}
+}
+
+// watchExpiry periodically repeats expiry checks done when client connects,
+// so that long lived connections are warned about as well.
+func (s *Server) watchExpiry() {
+	ticker := time.NewTicker(DefaultExpiryCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.checkExpiry()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// checkExpiry logs errors if CRL is past its next update and warnings for
+// connected clients with certificates close to expiry.
+func (s *Server) checkExpiry() {
+	s.revocationMu.RLock()
+	crl := s.revocation.crl
+	s.revocationMu.RUnlock()
+
+	if crl != nil && crlStale(crl) {
+		s.logger.Log(
+			"level", 0,
+			"msg", "CRL is past next update",
+			"nextUpdate", crl.NextUpdate,
+		)
+	}
+
+	s.connPool.EachConn(func(identifier id.ID, conn net.Conn) {
+		logger := log.NewContext(s.logger).With("identifier", identifier)
+		s.checkCertExpiry(identifier, peerCertificate(conn), logger)
+	})
+}
+
 // Unsubscribe removes client from registry, disconnects client if already
 // connected and returns it's RegistryItem.
 func (s *Server) Unsubscribe(identifier id.ID) *RegistryItem {
@@ -607,11 +1097,7 @@ func (s *Server) Ping(identifier id.ID) (time.Duration, error) {
 	return s.connPool.Ping(identifier)
 }
 
-func (s *Server) listen(l net.Listener, identifier id.ID) {
-	s.listenExt(l, identifier, l.Addr().Network())
-}
-
-func (s *Server) listenExt(l net.Listener, identifier id.ID, fp string) {
+func (s *Server) listenExt(l net.Listener, identifier id.ID, fp string, t *tunnelInfo) {
 	addr := l.Addr().String()
 
 	for {
@@ -638,9 +1124,58 @@ func (s *Server) listenExt(l net.Listener, identifier id.ID, fp string) {
 			continue
 		}
 
+		if !s.allowIP(remoteIP(conn.RemoteAddr().String()), t.acl) {
+			s.metrics.Add(MetricConnectionsDenied, 1)
+			s.logger.Log(
+				"level", 1,
+				"action", "connection denied",
+				"identifier", identifier,
+				"addr", addr,
+				"remoteAddr", conn.RemoteAddr(),
+			)
+			reset(conn)
+			continue
+		}
+
+		ls, reject := s.throttle(identifier, t)
+		if reject {
+			s.metrics.Add(MetricQuotaExceeded, 1)
+			conn.Close()
+			continue
+		}
+
+		if !ls.allowConn() {
+			s.metrics.Add(MetricConnectionsRateLimited, 1)
+			s.logger.Log(
+				"level", 2,
+				"action", "connection rate limited",
+				"identifier", identifier,
+				"addr", addr,
+				"remoteAddr", conn.RemoteAddr(),
+			)
+			conn.Close()
+			continue
+		}
+		release, ok := ls.acquireStream()
+		if !ok {
+			s.metrics.Add(MetricStreamsLimited, 1)
+			s.logger.Log(
+				"level", 2,
+				"action", "too many connections",
+				"identifier", identifier,
+				"addr", addr,
+				"remoteAddr", conn.RemoteAddr(),
+			)
+			conn.Close()
+			continue
+		}
+
 		msg := &proto.ControlMessage{
-			Action:         proto.ActionProxy,
-			ForwardedProto: fp, //,
+			Action:               proto.ActionProxy,
+			ForwardedProto:       fp,
+			RemoteAddr:           conn.RemoteAddr().String(),
+			StreamEncoding:       t.encoding,
+			AcceptStreamEncoding: t.encoding,
 		}
 
 		tlsConn, ok := conn.(*vhost.TLSConn)
@@ -669,6 +1204,15 @@ func (s *Server) listenExt(l net.Listener, identifier id.ID, fp string) {
 			)
 		}
 
+		if sl, ok := l.(*socksListener); ok {
+			conn = sl.track(conn)
+		}
+		conn = s.config.Ledger.conn(ls.conn(conn, release), identifier, t.name)
+		conn = s.logConn(conn, identifier, t, &ConnectionLogEntry{
+			Protocol: fp,
+			Addr:     msg.ForwardedHost,
+		})
+
 		go func() {
 			if err := s.proxyConn(identifier, conn, msg); err != nil {
 				s.logger.Log(
@@ -683,46 +1227,199 @@ func (s *Server) listenExt(l net.Listener, identifier id.ID, fp string) {
 	}
 }
 
+// throttle returns limiters of a tunnel including limits of a client over
+// quota, it returns true if client traffic should be rejected. Bandwidth of
+// a client over quota is shaped by the ledger, so that it applies to streams
+// opened before quota was exceeded too.
+func (s *Server) throttle(identifier id.ID, t *tunnelInfo) (limiters, bool) {
+	l, reject := s.config.Ledger.throttle(identifier)
+	if l == nil {
+		return t.limiters, reject
+	}
+	return append(t.limiters[:len(t.limiters):len(t.limiters)], l.gate()), false
+}
+
+// httpAuth returns authentication of HTTP tunnel, server side overrides take
+// precedence over the tunnel configuration.
+func (s *Server) httpAuth(t *proto.Tunnel) *Auth {
+	var (
+		override *proto.AuthConfig
+		n        = -1
+	)
+	for pattern, c := range s.config.AuthOverrides {
+		if len(pattern) > n && globMatch(pattern, trimPort(t.Host)) {
+			override, n = c, len(pattern)
+		}
+	}
+	if override != nil {
+		return NewHTTPAuth("", override)
+	}
+
+	return NewHTTPAuth(t.Auth, t.HTTPAuth)
+}
+
+// SetMaintenance replaces list of host patterns put in maintenance, patterns
+// are matched with path.Match.
+func (s *Server) SetMaintenance(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("maintenance pattern %q: %s", p, err)
+		}
+	}
+
+	s.maintenanceMu.Lock()
+	s.maintenance = patterns
+	s.maintenanceMu.Unlock()
+
+	return nil
+}
+
+func (s *Server) inMaintenance(host string) bool {
+	s.maintenanceMu.RLock()
+	defer s.maintenanceMu.RUnlock()
+
+	host = trimPort(host)
+	for _, p := range s.maintenance {
+		if globMatch(p, host) {
+			return true
+		}
+	}
+	return false
+}
+
 // ServeHTTP proxies http connection to the client.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.config.AccessLog != nil {
+		lw := &accessLogWriter{ResponseWriter: w}
+		defer s.logRequest(r, lw, time.Now())
+		w = lw
+	}
+
+	if s.oidc != nil && r.URL.Path == OIDCCallbackPath {
+		if _, auth, ok := s.Subscriber(r.Host); ok && auth != nil && auth.OIDC != nil {
+			s.oidcCallback(w, r, auth.OIDC)
+			return
+		}
+	}
+
 	resp, err := s.RoundTrip(r)
 	if err == errUnauthorised {
-		w.Header().Set("WWW-Authenticate", "Basic realm=\"User Visible Realm\"")
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		s.unauthorised(w, r)
 		return
 	}
+	if e, ok := err.(*rateLimitError); ok {
+		w.Header().Set("Retry-After", e.retryAfterSeconds())
+	}
 	if err != nil {
-		s.logger.Log(
-			"level", 0,
-			"action", "round trip failed",
-			"addr", r.RemoteAddr,
-			"host", r.Host,
-			"url", r.URL,
-			"err", err,
-		)
+		status, message := errorStatus(err)
+		if status == http.StatusBadGateway || status == http.StatusGatewayTimeout {
+			s.logger.Log(
+				"level", 0,
+				"action", "round trip failed",
+				"addr", r.RemoteAddr,
+				"host", r.Host,
+				"url", r.URL,
+				"err", err,
+			)
+		}
 
-		http.Error(w, err.Error(), http.StatusBadGateway)
+		s.writeError(w, r, status, message)
 		return
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		s.switchProtocols(w, r, resp)
+		return
+	}
+
 	copyHeader(w.Header(), resp.Header)
+	for k := range resp.Trailer {
+		w.Header().Add("Trailer", k)
+	}
 	w.WriteHeader(resp.StatusCode)
 
-	transfer(w, resp.Body, log.NewContext(s.logger).With(
+	transfer(flushWriter{w}, resp.Body, log.NewContext(s.logger).With(
 		"dir", "client to user",
 		"dst", r.RemoteAddr,
 		"src", r.Host,
 	))
+
+	// trailers are known after body is read, they may be not announced
+	// i.e. grpc-status
+	for k, vv := range resp.Trailer {
+		for _, v := range vv {
+			w.Header().Add(http.TrailerPrefix+k, v)
+		}
+	}
 }
 
 // RoundTrip is http.RoundTriper implementation.
 func (s *Server) RoundTrip(r *http.Request) (*http.Response, error) {
+	ctx, span := s.config.Tracer.Start(
+		trace.ContextWithRemote(r.Context(), trace.Extract(r.Header)),
+		"Server.RoundTrip", trace.KindServer,
+		trace.Attribute{Key: "http.method", Value: r.Method},
+		trace.Attribute{Key: "http.host", Value: r.Host},
+		trace.Attribute{Key: "http.target", Value: r.URL.RequestURI()},
+	)
+
+	resp, err := s.roundTrip(r.WithContext(ctx))
+	if err != nil {
+		span.SetError(err)
+		span.End()
+		return nil, err
+	}
+	span.SetHTTPStatus(resp.StatusCode)
+	if w, ok := resp.Body.(io.Writer); ok {
+		resp.Body = &upgradedBody{resp.Body, w, &tracedBody{resp.Body, span}}
+	} else {
+		resp.Body = &tracedBody{resp.Body, span}
+	}
+
+	return resp, nil
+}
+
+func (s *Server) roundTrip(r *http.Request) (*http.Response, error) {
+	if s.inMaintenance(r.Host) {
+		return nil, errMaintenance
+	}
+
 	identifier, auth, ok := s.Subscriber(r.Host)
 	if !ok {
 		return nil, errClientNotSubscribed
 	}
 
+	t := s.hostTunnel(r.Host)
+
+	if !s.allowIP(remoteIP(r.RemoteAddr), t.acl) {
+		s.metrics.Add(MetricRequestsDenied, 1)
+		s.logger.Log(
+			"level", 1,
+			"action", "request denied",
+			"identifier", identifier,
+			"host", r.Host,
+			"addr", r.RemoteAddr,
+		)
+		return nil, errForbidden
+	}
+
+	ls, reject := s.throttle(identifier, t)
+	if reject {
+		s.metrics.Add(MetricQuotaExceeded, 1)
+		return nil, errQuotaExceeded
+	}
+
+	if wait, ok := ls.allowRequest(); !ok {
+		s.metrics.Add(MetricRequestsRateLimited, 1)
+		return nil, &rateLimitError{wait}
+	}
+	release, ok := ls.acquireStream()
+	if !ok {
+		s.metrics.Add(MetricStreamsLimited, 1)
+		return nil, &rateLimitError{time.Second}
+	}
+
 	outr := r.WithContext(r.Context())
 	if r.ContentLength == 0 {
 		outr.Body = nil // Issue 16036: nil Body for http.Transport retries
@@ -730,13 +1427,18 @@ func (s *Server) RoundTrip(r *http.Request) (*http.Response, error) {
 	outr.Header = cloneHeader(r.Header)
 
 	if auth != nil {
-		user, password, _ := r.BasicAuth()
-		if auth.User != user || auth.Password != password {
+		if !auth.authenticate(r) && !s.oidcAuthenticate(r, auth) {
+			release()
 			return nil, errUnauthorised
 		}
-		outr.Header.Del("Authorization")
+		auth.stripCredentials(outr.Header)
+		if auth.OIDC != nil {
+			stripOIDCCookies(r, outr.Header)
+		}
 	}
 
+	s.config.Ledger.add(identifier, t.name, &Usage{Requests: 1})
+
 	setXForwardedFor(outr.Header, r.RemoteAddr)
 
 	scheme := r.URL.Scheme
@@ -752,13 +1454,85 @@ func (s *Server) RoundTrip(r *http.Request) (*http.Response, error) {
 		outr.Header.Set("X-Forwarded-Proto", scheme)
 	}
 
+	clientIP := remoteIPString(r.RemoteAddr)
+	t.headers.RewriteRequest(outr, clientIP)
+
 	msg := &proto.ControlMessage{
-		Action:         proto.ActionProxy,
-		ForwardedHost:  r.Host,
-		ForwardedProto: scheme,
+		Action:               proto.ActionProxy,
+		ForwardedHost:        r.Host,
+		ForwardedProto:       scheme,
+		AcceptStreamEncoding: t.encoding,
+	}
+	if outr.Body != nil && !compressedContent(outr.Header) && !grpcContent(outr.Header) {
+		msg.StreamEncoding = t.encoding
+	}
+	if upgradeType(r.Header) != "" {
+		msg.StreamEncoding, msg.AcceptStreamEncoding = "", ""
+	}
+
+	if outr.Body != nil {
+		outr.Body = struct {
+			io.Reader
+			io.Closer
+		}{s.config.Ledger.reader(ls.inReader(outr.Body), identifier, t.name, true), outr.Body}
 	}
 
-	return s.proxyHTTP(identifier, outr, msg)
+	resp, err := s.proxyHTTP(identifier, outr, msg)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	t.headers.RewriteResponse(resp.Header, clientIP)
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		body, ok := resp.Body.(io.ReadWriteCloser)
+		if !ok {
+			resp.Body.Close()
+			release()
+			return nil, errors.New("upgraded response body is not writable")
+		}
+		resp.Body = &upgradedBody{
+			Reader: s.config.Ledger.reader(ls.outReader(body), identifier, t.name, false),
+			Writer: s.config.Ledger.writer(ls.inWriter(body), identifier, t.name, true),
+			Closer: &shapedBody{body: body, release: release},
+		}
+		return resp, nil
+	}
+	resp.Body = &shapedBody{s.config.Ledger.reader(ls.outReader(resp.Body), identifier, t.name, false), resp.Body, release}
+
+	return resp, nil
+}
+
+func (s *Server) oidcAuthenticate(r *http.Request, auth *Auth) bool {
+	return auth.OIDC != nil && s.oidc != nil && s.oidc.authenticate(r, auth.OIDC)
+}
+
+func (s *Server) oidcCallback(w http.ResponseWriter, r *http.Request, rule *proto.OIDCAuth) {
+	if err := s.oidc.callback(w, r, rule); err != nil {
+		s.logger.Log(
+			"level", 1,
+			"action", "oidc login failed",
+			"addr", r.RemoteAddr,
+			"host", r.Host,
+			"err", err,
+		)
+		s.writeError(w, r, http.StatusUnauthorized, "unauthorised")
+	}
+}
+
+// unauthorised redirects browsers to OIDC login or asks for credentials.
+func (s *Server) unauthorised(w http.ResponseWriter, r *http.Request) {
+	_, auth, _ := s.Subscriber(r.Host)
+	if auth == nil {
+		auth = &Auth{}
+	}
+
+	if auth.OIDC != nil && s.oidc != nil && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		s.oidc.login(w, r)
+		return
+	}
+
+	w.Header().Set("WWW-Authenticate", auth.challenge())
+	s.writeError(w, r, http.StatusUnauthorized, "unauthorised")
 }
 
 func (s *Server) proxyConn(identifier id.ID, conn net.Conn, msg *proto.ControlMessage) error {
@@ -780,16 +1554,30 @@ func (s *Server) proxyConn(identifier id.ID, conn net.Conn, msg *proto.ControlMe
 		return err
 	}
 
+	var (
+		w   io.Writer = pw
+		enc streamEncoder
+	)
+	if msg.StreamEncoding != "" {
+		if enc, err = newStreamEncoder(msg.StreamEncoding, pw); err != nil {
+			return err
+		}
+		w = syncEncoder{enc}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	req = req.WithContext(ctx)
 
 	done := make(chan struct{})
 	go func() {
-		transfer(pw, conn, log.NewContext(s.logger).With(
+		transfer(w, conn, log.NewContext(s.logger).With(
 			"dir", "user to client",
 			"dst", identifier,
 			"src", conn.RemoteAddr(),
 		))
+		if enc != nil {
+			enc.Close()
+		}
 		cancel()
 		close(done)
 	}()
@@ -800,6 +1588,20 @@ func (s *Server) proxyConn(identifier id.ID, conn net.Conn, msg *proto.ControlMe
 	}
 	defer resp.Body.Close()
 
+	if err := s.checkProxyError(resp); err != nil {
+		if msg.ForwardedProto == proto.HTTPCONNECT {
+			status, message := errorStatus(err)
+			fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s\n",
+				status, http.StatusText(status), len(message)+1, message)
+		} else {
+			reset(conn)
+		}
+		return err
+	}
+	if err := decodeResponse(resp); err != nil {
+		return err
+	}
+
 	transfer(conn, resp.Body, log.NewContext(s.logger).With(
 		"dir", "client to user",
 		"dst", conn.RemoteAddr(),
@@ -829,18 +1631,53 @@ func (s *Server) proxyHTTP(identifier id.ID, r *http.Request, msg *proto.Control
 		"ctrlMsg", msg,
 	)
 
+	_, span := s.config.Tracer.Start(r.Context(), "Server.proxyHTTP", trace.KindClient,
+		trace.Attribute{Key: "tunnel.client_id", Value: identifier.String()},
+	)
+	defer span.End()
+	if span != nil {
+		msg.Traceparent = trace.Traceparent(span.Context())
+		trace.Inject(r.Header, span.Context())
+	}
+
 	pr, pw := io.Pipe()
-	defer pr.Close()
-	defer pw.Close()
+	upgrade := upgradeType(r.Header) != ""
+	ok := false
+	defer func() {
+		// on success stream is closed with response body
+		if !ok {
+			pr.Close()
+			pw.Close()
+		}
+	}()
 
 	req, err := s.connectRequest(identifier, msg, pr)
 	if err != nil {
+		span.SetError(err)
 		return nil, fmt.Errorf("proxy request error: %s", err)
 	}
 
+	var (
+		w   io.Writer = pw
+		enc streamEncoder
+	)
+	if msg.StreamEncoding != "" {
+		if enc, err = newStreamEncoder(msg.StreamEncoding, pw); err != nil {
+			span.SetError(err)
+			return nil, err
+		}
+		w = enc
+	}
+
+	written := make(chan struct{})
 	go func() {
-		cw := &countWriter{pw, 0}
+		defer close(written)
+
+		cw := &countWriter{w, 0}
 		err := r.Write(cw)
+		if err == nil && enc != nil {
+			err = enc.Close()
+		}
 		if err != nil {
 			s.logger.Log(
 				"level", 0,
@@ -864,12 +1701,46 @@ func (s *Server) proxyHTTP(identifier id.ID, r *http.Request, msg *proto.Control
 		if r.Body != nil {
 			r.Body.Close()
 		}
+		// upgraded stream is written after request
+		if !upgrade {
+			pw.CloseWithError(err)
+		}
 	}()
 
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
+		span.SetError(err)
+		if errors.Is(err, errClientNotConnected) {
+			return nil, errClientNotConnected
+		}
 		return nil, fmt.Errorf("io error: %s", err)
 	}
+	span.SetHTTPStatus(resp.StatusCode)
+
+	if err := s.checkProxyError(resp); err != nil {
+		resp.Body.Close()
+		span.SetError(err)
+		return nil, err
+	}
+	if err := decodeResponse(resp); err != nil {
+		resp.Body.Close()
+		span.SetError(err)
+		return nil, err
+	}
+	if resp.Header.Get(proto.HeaderUpgrade) != "" {
+		res, err := readUpgradeResponse(resp, r, pw, written)
+		if err != nil {
+			resp.Body.Close()
+			span.SetError(err)
+			return nil, err
+		}
+		resp = res
+	} else {
+		// request body may be still streamed i.e. gRPC, stop it when user
+		// is done with response
+		resp.Body = &pipedBody{resp.Body, pr}
+	}
+	ok = true
 
 	s.logger.Log(
 		"level", 2,
@@ -882,6 +1753,31 @@ func (s *Server) proxyHTTP(identifier id.ID, r *http.Request, msg *proto.Control
 	return resp, nil
 }
 
+// pipedBody is response body that closes request body pipe on close.
+type pipedBody struct {
+	io.ReadCloser
+	pipe io.Closer
+}
+
+func (b *pipedBody) Close() error {
+	b.pipe.Close()
+	return b.ReadCloser.Close()
+}
+
+// peerCertificate returns client certificate of a TLS connection that
+// completed handshake, or nil.
+func peerCertificate(conn interface{}) *x509.Certificate {
+	tlsConn, ok := conn.(id.TLSConn)
+	if !ok {
+		return nil
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	return certs[0]
+}
+
 // connectRequest creates HTTP request to client with a given identifier having
 // control message and data input stream, output data stream results from
 // response the created request.
@@ -903,6 +1799,14 @@ func (s *Server) Addr() string {
 	return s.listener.Addr().String()
 }
 
+// QUICAddr returns UDP address clients connect to over QUIC.
+func (s *Server) QUICAddr() string {
+	if s.quic == nil {
+		return ""
+	}
+	return s.quic.Addr().String()
+}
+
 // Stop closes the server.
 func (s *Server) Stop() {
 	s.logger.Log(
@@ -913,4 +1817,11 @@ func (s *Server) Stop() {
 	if s.listener != nil {
 		s.listener.Close()
 	}
+	if s.quic != nil {
+		s.quic.Close()
+	}
+	s.connPool.Close()
+	s.stopOnce.Do(func() {
+		close(s.done)
+	})
 }
@@ -0,0 +1,313 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// maxDatagramSize is maximal size of UDP datagram relayed by socks5 tunnels.
+const maxDatagramSize = 65535
+
+// writeDatagram writes datagram prefixed with its length to w in a single
+// write.
+func writeDatagram(w io.Writer, d []byte) error {
+	b := make([]byte, 2+len(d))
+	binary.BigEndian.PutUint16(b, uint16(len(d)))
+	copy(b[2:], d)
+	_, err := w.Write(b)
+	return err
+}
+
+// readDatagram reads datagram written by writeDatagram to buf.
+func readDatagram(r io.Reader, buf []byte) ([]byte, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(h[:]))
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// socksListener is listener of socks5 tunnel, it holds relay of UDP
+// ASSOCIATE datagrams listening on the same port. Datagrams are relayed only
+// from IPs of users with an open connection, UDP ASSOCIATE is held by a
+// connection so other datagrams can not be valid and may have spoofed source.
+type socksListener struct {
+	net.Listener
+	udp net.PacketConn
+
+	users   map[string]int
+	usersMu sync.Mutex
+}
+
+func newSocksListener(l net.Listener, udp net.PacketConn) *socksListener {
+	return &socksListener{
+		Listener: l,
+		udp:      udp,
+		users:    make(map[string]int),
+	}
+}
+
+func (l *socksListener) Close() error {
+	l.udp.Close()
+	return l.Listener.Close()
+}
+
+// track counts conn as connection of user IP until it's closed.
+func (l *socksListener) track(conn net.Conn) net.Conn {
+	key := remoteIPString(conn.RemoteAddr().String())
+
+	l.usersMu.Lock()
+	l.users[key]++
+	l.usersMu.Unlock()
+
+	return &trackedConn{
+		Conn: conn,
+		release: func() {
+			l.usersMu.Lock()
+			if l.users[key]--; l.users[key] == 0 {
+				delete(l.users, key)
+			}
+			l.usersMu.Unlock()
+		},
+	}
+}
+
+// connected returns true if user with address addr has an open connection.
+func (l *socksListener) connected(addr net.Addr) bool {
+	key := remoteIPString(addr.String())
+
+	l.usersMu.Lock()
+	defer l.usersMu.Unlock()
+	return l.users[key] > 0
+}
+
+// trackedConn calls release when closed.
+type trackedConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// udpStream queues datagrams of a user sent to client.
+type udpStream struct {
+	ch chan []byte
+}
+
+func (st *udpStream) send(d []byte) {
+	b := make([]byte, len(d))
+	copy(b, d)
+	select {
+	case st.ch <- b:
+	default:
+		// drop like a congested network would
+	}
+}
+
+// relayUDP forwards datagrams sent by users to UDP relay of socks5 tunnel to
+// client, datagrams of a user address are sent over a single stream limited
+// and accounted like a TCP connection. Client accepts datagrams only from
+// users having an association.
+func (s *Server) relayUDP(identifier id.ID, l *socksListener, t *tunnelInfo) {
+	var (
+		streams   = make(map[string]*udpStream)
+		streamsMu sync.Mutex
+		buf       = make([]byte, maxDatagramSize)
+	)
+
+	for {
+		n, addr, err := l.udp.ReadFrom(buf)
+		if err != nil {
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				s.logger.Log(
+					"level", 2,
+					"action", "udp relay closed",
+					"identifier", identifier,
+					"addr", l.udp.LocalAddr(),
+				)
+				return
+			}
+			continue
+		}
+
+		if !s.allowIP(remoteIP(addr.String()), t.acl) {
+			s.metrics.Add(MetricConnectionsDenied, 1)
+			continue
+		}
+		if !l.connected(addr) {
+			continue
+		}
+
+		key := addr.String()
+		streamsMu.Lock()
+		st, ok := streams[key]
+		if !ok {
+			ls, release, ok := s.acquireUDPStream(identifier, t, addr)
+			if !ok {
+				streamsMu.Unlock()
+				continue
+			}
+			st = &udpStream{ch: make(chan []byte, 64)}
+			streams[key] = st
+			go func() {
+				s.proxyUDP(identifier, l, t, addr, st, ls)
+				release()
+				streamsMu.Lock()
+				delete(streams, key)
+				streamsMu.Unlock()
+			}()
+		}
+		streamsMu.Unlock()
+
+		st.send(buf[:n])
+	}
+}
+
+// acquireUDPStream checks quota and rate limits of a new UDP stream of user
+// addr, it returns limiters shaping the stream and function releasing it.
+func (s *Server) acquireUDPStream(identifier id.ID, t *tunnelInfo, addr net.Addr) (limiters, func(), bool) {
+	ls, reject := s.throttle(identifier, t)
+	if reject {
+		s.metrics.Add(MetricQuotaExceeded, 1)
+		return nil, nil, false
+	}
+
+	if !ls.allowConn() {
+		s.metrics.Add(MetricConnectionsRateLimited, 1)
+		s.logger.Log(
+			"level", 2,
+			"action", "udp stream rate limited",
+			"identifier", identifier,
+			"remoteAddr", addr,
+		)
+		return nil, nil, false
+	}
+	release, ok := ls.acquireStream()
+	if !ok {
+		s.metrics.Add(MetricStreamsLimited, 1)
+		s.logger.Log(
+			"level", 2,
+			"action", "too many connections",
+			"identifier", identifier,
+			"remoteAddr", addr,
+		)
+		return nil, nil, false
+	}
+
+	return ls, release, true
+}
+
+// proxyUDP relays datagrams of user addr over a stream to client until the
+// stream is closed or idle for DefaultUDPIdleTimeout.
+func (s *Server) proxyUDP(identifier id.ID, l *socksListener, t *tunnelInfo, addr net.Addr, st *udpStream, ls limiters) {
+	msg := &proto.ControlMessage{
+		Action:         proto.ActionProxy,
+		ForwardedProto: proto.SOCKS5UDP,
+		ForwardedHost:  l.Addr().String(),
+		RemoteAddr:     addr.String(),
+	}
+
+	s.logger.Log(
+		"level", 2,
+		"action", "proxy udp",
+		"identifier", identifier,
+		"ctrlMsg", msg,
+	)
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	req, err := s.connectRequest(identifier, msg, pr)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	idle := time.AfterFunc(DefaultUDPIdleTimeout, cancel)
+	defer idle.Stop()
+
+	ss := s.config.Ledger.open(identifier, t.name)
+	defer s.config.Ledger.close(identifier, ss)
+
+	// datagrams queued while stream is shaped are dropped by udpStream
+	w := s.config.Ledger.writer(ls.inWriter(pw), identifier, t.name, true)
+	go func() {
+		defer pw.Close()
+		for {
+			select {
+			case d := <-st.ch:
+				idle.Reset(DefaultUDPIdleTimeout)
+				if err := writeDatagram(w, d); err != nil {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		s.logger.Log(
+			"level", 0,
+			"msg", "proxy udp error",
+			"identifier", identifier,
+			"ctrlMsg", msg,
+			"err", err,
+		)
+		return
+	}
+	defer resp.Body.Close()
+
+	if err := s.checkProxyError(resp); err != nil {
+		s.logger.Log(
+			"level", 1,
+			"msg", "proxy udp error",
+			"identifier", identifier,
+			"ctrlMsg", msg,
+			"err", err,
+		)
+		return
+	}
+
+	r := s.config.Ledger.reader(ls.outReader(resp.Body), identifier, t.name, false)
+	buf := make([]byte, maxDatagramSize)
+	for {
+		d, err := readDatagram(r, buf)
+		if err != nil {
+			break
+		}
+		idle.Reset(DefaultUDPIdleTimeout)
+		l.udp.WriteTo(d, addr)
+	}
+
+	s.logger.Log(
+		"level", 2,
+		"action", "proxy udp done",
+		"identifier", identifier,
+		"ctrlMsg", msg,
+	)
+}
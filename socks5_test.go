@@ -0,0 +1,102 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+func TestSOCKS5Proxy_DeniesLocalDestinations(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	allowLocal, err := NewDestinationACL([]string{"127.0.0.0/8"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		acl  *DestinationACL
+		ip   net.IP
+		code byte
+	}{
+		{nil, net.IPv4(127, 0, 0, 1), socks5NotAllowed},
+		{nil, net.IPv4(169, 254, 169, 254), socks5NotAllowed},
+		{allowLocal, net.IPv4(127, 0, 0, 1), socks5Succeeded},
+	}
+	for _, tt := range tests {
+		p := NewSOCKS5Proxy(&SOCKS5Config{ACL: tt.acl}, nil)
+
+		req := []byte{socks5Version, 1, socks5AuthNone, socks5Version, socks5CmdConnect, 0}
+		req = appendSOCKS5Addr(req, tt.ip, port)
+		w := &bytes.Buffer{}
+		p.Proxy(w, ioutil.NopCloser(bytes.NewReader(req)), &proto.ControlMessage{
+			Action:         proto.ActionProxy,
+			ForwardedProto: proto.SOCKS5,
+			ForwardedHost:  "127.0.0.1:1080",
+		})
+
+		b := w.Bytes()
+		if len(b) < 4 || b[3] != tt.code {
+			t.Errorf("%s: expected reply %d got %v", tt.ip, tt.code, b)
+		}
+	}
+}
+
+func TestSocksListener_Track(t *testing.T) {
+	t.Parallel()
+
+	l := newSocksListener(nil, nil)
+	user := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5000}
+	if l.connected(user) {
+		t.Fatal("unexpected connected user")
+	}
+
+	a, b := net.Pipe()
+	defer b.Close()
+	conn := l.track(&addrConn{a, &net.TCPAddr{IP: user.IP, Port: 4000}})
+	if !l.connected(user) {
+		t.Fatal("expected connected user")
+	}
+	if l.connected(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 5000}) {
+		t.Fatal("unexpected connected user")
+	}
+
+	conn.Close()
+	conn.Close()
+	if l.connected(user) {
+		t.Fatal("expected user disconnected")
+	}
+}
+
+// addrConn overrides remote address of a connection.
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
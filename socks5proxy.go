@@ -0,0 +1,629 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/mmatczuk/go-http-tunnel/keepalive"
+	"github.com/mmatczuk/go-http-tunnel/log"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// SOCKS5 protocol constants, see RFC 1928 and RFC 1929.
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthNoAcceptable = 0xff
+
+	socks5CmdConnect      = 0x01
+	socks5CmdUDPAssociate = 0x03
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5Succeeded         = 0x00
+	socks5Failure           = 0x01
+	socks5NotAllowed        = 0x02
+	socks5HostUnreachable   = 0x04
+	socks5ConnectionRefused = 0x05
+	socks5CmdNotSupported   = 0x07
+	socks5AddrNotSupported  = 0x08
+)
+
+// maxUDPDestinations is maximal number of destinations of a UDP stream,
+// datagrams to other destinations are dropped.
+const maxUDPDestinations = 1024
+
+// SOCKS5Config specifies SOCKS5 server of a socks5 tunnel.
+type SOCKS5Config struct {
+	// Users maps user names to bcrypt or argon2id password hashes, if
+	// empty authentication is not required.
+	Users map[string]string
+	// ACL specifies allowed destinations of CONNECT and UDP ASSOCIATE
+	// commands, if nil all destinations are allowed. Loopback and
+	// link-local destinations are denied unless allowed by an IP or CIDR
+	// rule.
+	ACL *DestinationACL
+}
+
+// SOCKS5Proxy is SOCKS5 server of socks5 tunnels, it connects to
+// destinations from the client network. UDP datagrams are relayed by server
+// from the port of the tunnel and accepted only from users with an active
+// UDP ASSOCIATE.
+type SOCKS5Proxy struct {
+	// config specifies default SOCKS5 server configuration.
+	config *SOCKS5Config
+	// configMap specifies mapping from ControlMessage.ForwardedHost to
+	// SOCKS5 server configuration, keys may contain host and port, only
+	// host or only port. The order of precedence is the same as in
+	// TCPProxy.
+	configMap map[string]*SOCKS5Config
+	// logger is the proxy logger.
+	logger log.Logger
+
+	assocs   map[string]*udpAssoc
+	assocsMu sync.Mutex
+}
+
+// udpAssoc is UDP ASSOCIATE of a user IP, done is closed when the last TCP
+// connection holding the association is closed.
+type udpAssoc struct {
+	refs int
+	done chan struct{}
+}
+
+// NewSOCKS5Proxy creates new SOCKS5Proxy, all tunnels share config.
+func NewSOCKS5Proxy(config *SOCKS5Config, logger log.Logger) *SOCKS5Proxy {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	return &SOCKS5Proxy{
+		config: config,
+		logger: logger,
+		assocs: make(map[string]*udpAssoc),
+	}
+}
+
+// NewMultiSOCKS5Proxy creates new SOCKS5Proxy, tunnels may have different
+// configuration based on configMap.
+func NewMultiSOCKS5Proxy(configMap map[string]*SOCKS5Config, logger log.Logger) *SOCKS5Proxy {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	return &SOCKS5Proxy{
+		configMap: configMap,
+		logger:    logger,
+		assocs:    make(map[string]*udpAssoc),
+	}
+}
+
+// Proxy is a ProxyFunc.
+func (p *SOCKS5Proxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage) {
+	switch msg.ForwardedProto {
+	case proto.SOCKS5, proto.SOCKS5UDP:
+		// ok
+	default:
+		p.logger.Log(
+			"level", 0,
+			"msg", "unsupported protocol",
+			"ctrlMsg", msg,
+		)
+		ReportProxyError(w, proto.ProxyErrorUnsupportedProtocol)
+		return
+	}
+
+	config := p.configFor(msg.ForwardedHost)
+	if config == nil {
+		p.logger.Log(
+			"level", 1,
+			"msg", "no target",
+			"ctrlMsg", msg,
+		)
+		ReportProxyError(w, proto.ProxyErrorNoRoute)
+		return
+	}
+
+	if msg.ForwardedProto == proto.SOCKS5UDP {
+		p.serveUDP(w, r, msg, config)
+	} else {
+		p.serveConn(w, r, msg, config)
+	}
+}
+
+func (p *SOCKS5Proxy) configFor(hostPort string) *SOCKS5Config {
+	if len(p.configMap) == 0 {
+		return p.config
+	}
+
+	for _, k := range forwardedHostKeys(hostPort) {
+		if c := p.configMap[k]; c != nil {
+			return c
+		}
+	}
+
+	return p.config
+}
+
+func (p *SOCKS5Proxy) serveConn(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage, config *SOCKS5Config) {
+	w = flushWriter{w}
+
+	user, err := p.negotiate(w, r, config)
+	if err != nil {
+		p.logger.Log(
+			"level", 1,
+			"msg", "socks5 handshake failed",
+			"ctrlMsg", msg,
+			"user", user,
+			"err", err,
+		)
+		return
+	}
+
+	var h [3]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return
+	}
+	if h[0] != socks5Version {
+		return
+	}
+	dst, err := readSOCKS5Addr(r)
+	if err != nil {
+		writeSOCKS5Reply(w, socks5AddrNotSupported, nil)
+		return
+	}
+
+	switch h[1] {
+	case socks5CmdConnect:
+		p.connect(w, r, msg, config, user, dst)
+	case socks5CmdUDPAssociate:
+		p.associate(w, r, msg, user)
+	default:
+		writeSOCKS5Reply(w, socks5CmdNotSupported, nil)
+	}
+}
+
+// negotiate selects authentication method and authenticates user.
+func (p *SOCKS5Proxy) negotiate(w io.Writer, r io.Reader, config *SOCKS5Config) (string, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return "", err
+	}
+	if h[0] != socks5Version {
+		return "", fmt.Errorf("unsupported version %d", h[0])
+	}
+	methods := make([]byte, h[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(socks5AuthNone)
+	if len(config.Users) > 0 {
+		method = socks5AuthPassword
+	}
+	if bytes.IndexByte(methods, method) < 0 {
+		w.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+		return "", errors.New("no acceptable authentication method")
+	}
+	if _, err := w.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+	if method == socks5AuthNone {
+		return "", nil
+	}
+
+	// RFC 1929 username/password authentication
+	if _, err := io.ReadFull(r, h[:1]); err != nil {
+		return "", err
+	}
+	user, err := readSOCKS5String(r)
+	if err != nil {
+		return "", err
+	}
+	password, err := readSOCKS5String(r)
+	if err != nil {
+		return user, err
+	}
+	hash, ok := config.Users[user]
+	if !ok || !checkPassword(hash, password) {
+		w.Write([]byte{0x01, 0x01})
+		return user, errors.New("invalid credentials")
+	}
+	_, err = w.Write([]byte{0x01, 0x00})
+	return user, err
+}
+
+func (p *SOCKS5Proxy) connect(w io.Writer, r io.Reader, msg *proto.ControlMessage, config *SOCKS5Config, user, dst string) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+
+	target, err := config.ACL.resolve(ctx, dst, true)
+	if err != nil {
+		code := byte(socks5HostUnreachable)
+		if errors.Is(err, ErrDestinationDenied) {
+			code = socks5NotAllowed
+		}
+		p.logger.Log(
+			"level", 1,
+			"msg", "socks5 destination denied",
+			"ctrlMsg", msg,
+			"user", user,
+			"dst", dst,
+			"err", err,
+		)
+		writeSOCKS5Reply(w, code, nil)
+		return
+	}
+
+	local, err := (&net.Dialer{}).DialContext(ctx, "tcp", target)
+	if err != nil {
+		p.logger.Log(
+			"level", 0,
+			"msg", "dial failed",
+			"target", target,
+			"ctrlMsg", msg,
+			"err", err,
+		)
+		code := byte(socks5Failure)
+		switch proxyErrorCode(err) {
+		case proto.ProxyErrorDialRefused:
+			code = socks5ConnectionRefused
+		case proto.ProxyErrorTimeout:
+			code = socks5HostUnreachable
+		}
+		writeSOCKS5Reply(w, code, nil)
+		return
+	}
+	defer local.Close()
+
+	if err := keepalive.SetDefaultKeepAlive(local); err != nil {
+		p.logger.Log(
+			"level", 1,
+			"msg", "TCP keepalive for tunneled connection failed",
+			"target", target,
+			"ctrlMsg", msg,
+			"err", err,
+		)
+	}
+
+	p.logger.Log(
+		"level", 2,
+		"action", "socks5 connect",
+		"ctrlMsg", msg,
+		"user", user,
+		"dst", dst,
+		"target", target,
+	)
+
+	if err := writeSOCKS5Reply(w, socks5Succeeded, local.LocalAddr()); err != nil {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		transfer(w, local, log.NewContext(p.logger).With(
+			"dst", msg.ForwardedHost,
+			"src", target,
+		))
+		close(done)
+	}()
+
+	transfer(local, r, log.NewContext(p.logger).With(
+		"dst", target,
+		"src", msg.ForwardedHost,
+	))
+
+	<-done
+}
+
+// associate holds UDP ASSOCIATE of user IP until the connection is closed.
+func (p *SOCKS5Proxy) associate(w io.Writer, r io.Reader, msg *proto.ControlMessage, user string) {
+	ip := remoteIP(msg.RemoteAddr)
+	if ip == nil {
+		writeSOCKS5Reply(w, socks5Failure, nil)
+		return
+	}
+
+	// datagrams are relayed by server from the tunnel port, the address is
+	// unspecified so that user sends datagrams to the server address
+	_, port, _ := net.SplitHostPort(msg.ForwardedHost)
+	bnd, err := net.ResolveUDPAddr("udp", net.JoinHostPort("0.0.0.0", port))
+	if err != nil {
+		writeSOCKS5Reply(w, socks5Failure, nil)
+		return
+	}
+
+	key := ip.String()
+	p.assocsMu.Lock()
+	a := p.assocs[key]
+	if a == nil {
+		a = &udpAssoc{done: make(chan struct{})}
+		p.assocs[key] = a
+	}
+	a.refs++
+	p.assocsMu.Unlock()
+
+	defer func() {
+		p.assocsMu.Lock()
+		a.refs--
+		if a.refs == 0 {
+			delete(p.assocs, key)
+			close(a.done)
+		}
+		p.assocsMu.Unlock()
+	}()
+
+	p.logger.Log(
+		"level", 2,
+		"action", "socks5 udp associate",
+		"ctrlMsg", msg,
+		"user", user,
+	)
+
+	if err := writeSOCKS5Reply(w, socks5Succeeded, bnd); err != nil {
+		return
+	}
+
+	io.Copy(io.Discard, r)
+}
+
+func (p *SOCKS5Proxy) association(ip net.IP) *udpAssoc {
+	if ip == nil {
+		return nil
+	}
+
+	p.assocsMu.Lock()
+	defer p.assocsMu.Unlock()
+	return p.assocs[ip.String()]
+}
+
+// serveUDP relays datagrams of user with UDP ASSOCIATE, datagrams carry
+// SOCKS5 UDP request header.
+func (p *SOCKS5Proxy) serveUDP(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage, config *SOCKS5Config) {
+	a := p.association(remoteIP(msg.RemoteAddr))
+	if a == nil {
+		p.logger.Log(
+			"level", 1,
+			"msg", "socks5 udp without association",
+			"ctrlMsg", msg,
+		)
+		ReportProxyError(w, proto.ProxyErrorNoRoute)
+		return
+	}
+
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		p.logger.Log(
+			"level", 0,
+			"msg", "listen udp failed",
+			"ctrlMsg", msg,
+			"err", err,
+		)
+		ReportProxyError(w, proto.ProxyErrorFailed)
+		return
+	}
+
+	if rw, ok := w.(http.ResponseWriter); ok {
+		rw.WriteHeader(http.StatusOK)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-a.done:
+		case <-stop:
+		}
+		pc.Close()
+		r.Close()
+	}()
+
+	// replies are accepted only from destinations user sent datagrams to
+	var (
+		sent   = make(map[string]bool)
+		sentMu sync.Mutex
+	)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		fw := flushWriter{w}
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := pc.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			sentMu.Lock()
+			ok := sent[addr.String()]
+			sentMu.Unlock()
+			if !ok {
+				continue
+			}
+
+			b := appendSOCKS5Addr([]byte{0, 0, 0}, addr.IP, addr.Port)
+			if len(b)+n > maxDatagramSize {
+				continue
+			}
+			if err := writeDatagram(fw, append(b, buf[:n]...)); err != nil {
+				return
+			}
+		}
+	}()
+
+	var (
+		resolved = make(map[string]*net.UDPAddr)
+		limited  bool
+	)
+	buf := make([]byte, maxDatagramSize)
+	for {
+		d, err := readDatagram(r, buf)
+		if err != nil {
+			break
+		}
+		// fragmentation is not supported
+		if len(d) < 4 || d[2] != 0 {
+			continue
+		}
+		br := bytes.NewReader(d[3:])
+		dst, err := readSOCKS5Addr(br)
+		if err != nil {
+			continue
+		}
+		data := d[len(d)-br.Len():]
+
+		addr, ok := resolved[dst]
+		if !ok {
+			// every sent address is resolved, capping resolved caps sent
+			if len(resolved) >= maxUDPDestinations {
+				if !limited {
+					p.logger.Log(
+						"level", 1,
+						"msg", "socks5 udp destinations limit reached",
+						"ctrlMsg", msg,
+						"dst", dst,
+					)
+					limited = true
+				}
+				continue
+			}
+			addr = p.resolveUDP(msg, config, dst)
+			resolved[dst] = addr
+		}
+		if addr == nil {
+			continue
+		}
+
+		sentMu.Lock()
+		sent[addr.String()] = true
+		sentMu.Unlock()
+		pc.WriteToUDP(data, addr)
+	}
+
+	close(stop)
+	<-done
+}
+
+// resolveUDP checks datagram destination against ACL, it returns nil if the
+// destination is denied.
+func (p *SOCKS5Proxy) resolveUDP(msg *proto.ControlMessage, config *SOCKS5Config, dst string) *net.UDPAddr {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+
+	target, err := config.ACL.resolve(ctx, dst, true)
+	if err == nil {
+		var addr *net.UDPAddr
+		if addr, err = net.ResolveUDPAddr("udp", target); err == nil {
+			return addr
+		}
+	}
+
+	p.logger.Log(
+		"level", 1,
+		"msg", "socks5 destination denied",
+		"ctrlMsg", msg,
+		"dst", dst,
+		"err", err,
+	)
+	return nil
+}
+
+func readSOCKS5String(r io.Reader) (string, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", err
+	}
+	b := make([]byte, n[0])
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// readSOCKS5Addr reads ATYP, DST.ADDR and DST.PORT fields and returns
+// address in host:port form.
+func readSOCKS5Addr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == socks5AddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		s, err := readSOCKS5String(r)
+		if err != nil {
+			return "", err
+		}
+		host = s
+	default:
+		return "", fmt.Errorf("unsupported address type %d", atyp[0])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// appendSOCKS5Addr appends ATYP, ADDR and PORT fields to b.
+func appendSOCKS5Addr(b []byte, ip net.IP, port int) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socks5AddrIPv4)
+		b = append(b, ip4...)
+	} else if ip16 := ip.To16(); ip16 != nil {
+		b = append(b, socks5AddrIPv6)
+		b = append(b, ip16...)
+	} else {
+		b = append(b, socks5AddrIPv4, 0, 0, 0, 0)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+// writeSOCKS5Reply writes reply to request, addr is the bound address, if
+// nil zero IPv4 address is sent.
+func writeSOCKS5Reply(w io.Writer, code byte, addr net.Addr) error {
+	var (
+		ip   net.IP
+		port int
+	)
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	_, err := w.Write(appendSOCKS5Addr([]byte{socks5Version, code, 0}, ip, port))
+	return err
+}
@@ -66,6 +66,7 @@ func (p *TCPProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage
 			"msg", "unsupported protocol",
 			"ctrlMsg", msg,
 		)
+		ReportProxyError(w, proto.ProxyErrorUnsupportedProtocol)
 		return
 	}
 
@@ -76,6 +77,7 @@ func (p *TCPProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage
 			"msg", "no target",
 			"ctrlMsg", msg,
 		)
+		ReportProxyError(w, proto.ProxyErrorNoRoute)
 		return
 	}
 
@@ -88,6 +90,7 @@ func (p *TCPProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage
 			"ctrlMsg", msg,
 			"err", err,
 		)
+		ReportProxyError(w, proxyErrorCode(err))
 		return
 	}
 	defer local.Close()
@@ -124,26 +127,18 @@ func (p *TCPProxy) localAddrFor(hostPort string) string {
 		return p.localAddr
 	}
 
-	// try hostPort
-	if addr := p.localAddrMap[hostPort]; addr != "" {
-		return addr
-	}
-
-	// try port
-	host, port, _ := net.SplitHostPort(hostPort)
-	if addr := p.localAddrMap[port]; addr != "" {
-		return addr
-	}
-
-	// try 0.0.0.0:port
-	if addr := p.localAddrMap[fmt.Sprintf("0.0.0.0:%s", port)]; addr != "" {
-		return addr
-	}
-
-	// try host
-	if addr := p.localAddrMap[host]; addr != "" {
-		return addr
+	for _, k := range forwardedHostKeys(hostPort) {
+		if addr := p.localAddrMap[k]; addr != "" {
+			return addr
+		}
 	}
 
 	return p.localAddr
 }
+
+// forwardedHostKeys returns keys of ControlMessage.ForwardedHost in order of
+// precedence, that is hostPort, port, 0.0.0.0:port and host.
+func forwardedHostKeys(hostPort string) []string {
+	host, port, _ := net.SplitHostPort(hostPort)
+	return []string{hostPort, port, fmt.Sprintf("0.0.0.0:%s", port), host}
+}
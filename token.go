@@ -0,0 +1,152 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/jwt"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// TokenAuth authenticates clients with bearer tokens as an alternative to
+// client certificates. Tokens are JWTs verified against a JSON Web Key Set,
+// HMAC keys in the set allow using pre-shared secrets.
+//
+// The "sub" claim is the client identity, "hosts", "ports" and "protocols"
+// claims list tunnels the client may open in the same way as PolicyRule does,
+// tunnels not listed are denied.
+type TokenAuth struct {
+	// KeySetFile is path to a JSON Web Key Set file.
+	KeySetFile string
+	// Issuer if not empty must match the "iss" claim.
+	Issuer string
+	// Audience if not empty must be in the "aud" claim.
+	Audience string
+	// MaxLifetime is the longest validity of a token from its "iat" claim,
+	// tokens must have "exp" claim. If zero DefaultTokenMaxLifetime is
+	// used.
+	MaxLifetime time.Duration
+
+	keySet *jwt.KeySet
+	mu     sync.RWMutex
+}
+
+// TokenClaims are claims of a client token.
+type TokenClaims struct {
+	jwt.Claims
+	Hosts     []string `json:"hosts,omitempty"`
+	Ports     []string `json:"ports,omitempty"`
+	Protocols []string `json:"protocols,omitempty"`
+}
+
+// NewTokenAuth creates TokenAuth and loads the key set.
+func NewTokenAuth(keySetFile, issuer, audience string) (*TokenAuth, error) {
+	a := &TokenAuth{
+		KeySetFile: keySetFile,
+		Issuer:     issuer,
+		Audience:   audience,
+	}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload reads the key set file again.
+func (a *TokenAuth) Reload() error {
+	ks, err := jwt.LoadKeySet(a.KeySetFile)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.keySet = ks
+	a.mu.Unlock()
+
+	return nil
+}
+
+// Verify checks token and returns its claims.
+func (a *TokenAuth) Verify(token string) (*TokenClaims, error) {
+	if token == "" {
+		return nil, errors.New("missing token")
+	}
+
+	a.mu.RLock()
+	ks := a.keySet
+	a.mu.RUnlock()
+
+	var c TokenClaims
+	if err := ks.Verify(token, &c); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if err := c.Validate(a.Issuer, a.Audience, now); err != nil {
+		return nil, err
+	}
+	max := a.MaxLifetime
+	if max == 0 {
+		max = DefaultTokenMaxLifetime
+	}
+	if err := c.ValidateLifetime(max, now); err != nil {
+		return nil, err
+	}
+	if c.Subject == "" {
+		return nil, errors.New("missing sub claim")
+	}
+
+	return &c, nil
+}
+
+// Identifier returns client identifier derived from the token subject.
+func (c *TokenClaims) Identifier() id.ID {
+	return id.New([]byte("token:" + c.Subject))
+}
+
+// tempIdentifier returns a random identifier for a client that has not
+// authenticated yet.
+func tempIdentifier() (id.ID, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return id.ID{}, err
+	}
+	return id.New(b), nil
+}
+
+// authorize returns error if the claims do not allow opening all tunnels.
+func (c *TokenClaims) authorize(tunnels map[string]*proto.Tunnel) error {
+	r := &PolicyRule{
+		Protocols: c.Protocols,
+		Hosts:     c.Hosts,
+	}
+	for _, p := range c.Ports {
+		lo, hi, err := parsePortRange(p)
+		if err != nil {
+			return fmt.Errorf("token ports: %s", err)
+		}
+		r.ports = append(r.ports, [2]int{lo, hi})
+	}
+
+	var denied []string
+	for name, t := range tunnels {
+		if !r.allowTunnel(t) {
+			denied = append(denied, name)
+		}
+	}
+	if len(denied) != 0 {
+		sort.Strings(denied)
+		return fmt.Errorf("tunnels not allowed by token: %s", strings.Join(denied, ", "))
+	}
+
+	return nil
+}
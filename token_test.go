@@ -0,0 +1,206 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/keepalive"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+var tokenSecret = []byte("token secret")
+
+func signToken(claims interface{}) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	c, _ := json.Marshal(claims)
+	signed := enc([]byte(`{"alg":"HS256"}`)) + "." + enc(c)
+	m := hmac.New(sha256.New, tokenSecret)
+	m.Write([]byte(signed))
+	return signed + "." + enc(m.Sum(nil))
+}
+
+func newTestTokenAuth(t *testing.T) *TokenAuth {
+	dir, err := ioutil.TempDir("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "jwks.json")
+	jwks := `{"keys":[{"kty":"oct","k":"` + base64.RawURLEncoding.EncodeToString(tokenSecret) + `"}]}`
+	if err := ioutil.WriteFile(file, []byte(jwks), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewTokenAuth(file, "ci", "tunneld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestTokenAuth_Verify(t *testing.T) {
+	t.Parallel()
+
+	a := newTestTokenAuth(t)
+	exp := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		claims map[string]interface{}
+		error  string
+	}{
+		{map[string]interface{}{"sub": "job", "iss": "ci", "aud": "tunneld", "exp": exp}, ""},
+		{map[string]interface{}{"iss": "ci", "aud": "tunneld", "exp": exp}, "missing sub"},
+		{map[string]interface{}{"sub": "job", "iss": "ci", "aud": "tunneld"}, "missing exp"},
+		{map[string]interface{}{"sub": "job", "iss": "ci", "aud": "tunneld", "exp": time.Now().Add(48 * time.Hour).Unix()}, "lifetime"},
+		{map[string]interface{}{"sub": "job", "iss": "other", "aud": "tunneld", "exp": exp}, "issuer"},
+		{map[string]interface{}{"sub": "job", "iss": "ci", "aud": "other", "exp": exp}, "audience"},
+		{map[string]interface{}{"sub": "job", "iss": "ci", "aud": "tunneld", "exp": time.Now().Add(-time.Hour).Unix()}, "expired"},
+	}
+
+	for i, tt := range tests {
+		c, err := a.Verify(signToken(tt.claims))
+		if tt.error == "" {
+			if err != nil {
+				t.Errorf("[%d] unexpected error %s", i, err)
+			} else if c.Identifier() != id.New([]byte("token:job")) {
+				t.Errorf("[%d] unexpected identifier", i)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.error) {
+			t.Errorf("[%d] expected error contains %q, got %v", i, tt.error, err)
+		}
+	}
+
+	if _, err := a.Verify(""); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestTokenClaims_Authorize(t *testing.T) {
+	t.Parallel()
+
+	c := &TokenClaims{
+		Hosts: []string{"*.ci.example.com"},
+		Ports: []string{"8000-8100"},
+	}
+
+	if err := c.authorize(map[string]*proto.Tunnel{
+		"web": {Protocol: proto.HTTP, Host: "job.ci.example.com"},
+		"tcp": {Protocol: proto.TCP, Addr: "0.0.0.0:8080"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := c.authorize(map[string]*proto.Tunnel{
+		"web": {Protocol: proto.HTTP, Host: "example.com"},
+		"ssh": {Protocol: proto.TCP, Addr: "0.0.0.0:22"},
+	})
+	if err == nil || err.Error() != "tunnels not allowed by token: ssh, web" {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+func TestTokenAuth_Handshake(t *testing.T) {
+	t.Parallel()
+
+	cert, err := tls.LoadX509KeyPair("./testdata/selfsigned.crt", "./testdata/selfsigned.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewServer(&ServerConfig{
+		Addr: "127.0.0.1:0",
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequestClientCert,
+			NextProtos:   []string{"h2"},
+		},
+		TokenAuth: newTestTokenAuth(t),
+		KeepAlive: &keepalive.KeepAlive{
+			KeepAliveIdleTime: keepalive.DefaultKeepAliveIdleTime,
+			KeepAliveCount:    keepalive.DefaultKeepAliveCount,
+			KeepAliveInterval: keepalive.DefaultKeepAliveInterval,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	defer s.Stop()
+
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer local.Close()
+	u, _ := url.Parse(local.URL)
+
+	client := func(host string) *Client {
+		c, err := NewClient(&ClientConfig{
+			ServerAddr:      s.Addr(),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			Tunnels: map[string]*proto.Tunnel{
+				"web": {Protocol: proto.HTTP, Host: host},
+			},
+			Proxy: Proxy(ProxyFuncs{
+				HTTP: NewHTTPProxy(u, nil).Proxy,
+			}),
+			KeepAlive: &keepalive.KeepAlive{
+				KeepAliveIdleTime: keepalive.DefaultKeepAliveIdleTime,
+				KeepAliveCount:    keepalive.DefaultKeepAliveCount,
+				KeepAliveInterval: keepalive.DefaultKeepAliveInterval,
+			},
+			Token: signToken(map[string]interface{}{
+				"sub":   host,
+				"iss":   "ci",
+				"aud":   "tunneld",
+				"exp":   time.Now().Add(time.Hour).Unix(),
+				"hosts": []string{"*.ci.example.com"},
+			}),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	c := client("job.ci.example.com")
+	go c.Start()
+	defer c.Stop()
+
+	denied := client("example.com")
+	if err := denied.Start(); err == nil || !strings.Contains(err.Error(), "not allowed by token") {
+		t.Fatal("expected token error", err)
+	}
+
+	var resp *httptest.ResponseRecorder
+	for i := 0; i < 50; i++ {
+		resp = httptest.NewRecorder()
+		s.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "http://job.ci.example.com/", nil))
+		if resp.Code == http.StatusOK {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if resp.Code != http.StatusOK || resp.Body.String() != "ok" {
+		t.Fatal("unexpected response", resp.Code, resp.Body.String())
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package trace
+
+import (
+	"context"
+	"net/url"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+)
+
+// NewOTLPTracer returns tracer exporting spans to OpenTelemetry collector
+// using OTLP over HTTP, if endpoint has no path "/v1/traces" is used. Other
+// exporter settings are taken from OTEL_EXPORTER_OTLP_* environment variables.
+func NewOTLPTracer(endpoint, serviceName string) (*Tracer, error) {
+	if u, err := url.Parse(endpoint); err == nil && (u.Path == "" || u.Path == "/") {
+		u.Path = "/v1/traces"
+		endpoint = u.String()
+	}
+
+	e, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	return NewTracer(e, serviceName), nil
+}
+
+// SetErrorFunc sets function called when export fails.
+func SetErrorFunc(f func(err error)) {
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(f))
+}
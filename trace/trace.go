@@ -0,0 +1,214 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+// Package trace is a thin wrapper of OpenTelemetry SDK with W3C Trace Context
+// propagation and OTLP export.
+package trace
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// Header is W3C Trace Context HTTP header.
+const Header = "traceparent"
+
+var propagator = propagation.TraceContext{}
+
+// SpanContext is the part of a span propagated to other processes.
+type SpanContext = oteltrace.SpanContext
+
+// Traceparent returns value of traceparent header, i.e.
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func Traceparent(sc SpanContext) string {
+	c := propagation.MapCarrier{}
+	propagator.Inject(oteltrace.ContextWithSpanContext(context.Background(), sc), c)
+	return c.Get(Header)
+}
+
+// ParseTraceparent parses value of traceparent header.
+func ParseTraceparent(s string) (SpanContext, error) {
+	ctx := propagator.Extract(context.Background(), propagation.MapCarrier{Header: s})
+	sc := oteltrace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return sc, fmt.Errorf("invalid traceparent %q", s)
+	}
+	return sc, nil
+}
+
+// Extract returns span context from HTTP header, if header is missing or
+// invalid returned context is not valid.
+func Extract(h http.Header) SpanContext {
+	ctx := propagator.Extract(context.Background(), propagation.HeaderCarrier(h))
+	return oteltrace.SpanContextFromContext(ctx)
+}
+
+// Inject sets traceparent header if span context is valid.
+func Inject(h http.Header, sc SpanContext) {
+	if sc.IsValid() {
+		propagator.Inject(oteltrace.ContextWithSpanContext(context.Background(), sc), propagation.HeaderCarrier(h))
+	}
+}
+
+// SpanKind describes relationship of a span to its parent and children.
+type SpanKind = oteltrace.SpanKind
+
+// Span kinds.
+const (
+	KindInternal = oteltrace.SpanKindInternal
+	KindServer   = oteltrace.SpanKindServer
+	KindClient   = oteltrace.SpanKindClient
+)
+
+// Attribute is a span attribute, value may be string, bool, int, int64 or
+// float64, other values are formatted as strings.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+func (a Attribute) keyValue() attribute.KeyValue {
+	switch v := a.Value.(type) {
+	case string:
+		return attribute.String(a.Key, v)
+	case bool:
+		return attribute.Bool(a.Key, v)
+	case int:
+		return attribute.Int(a.Key, v)
+	case int64:
+		return attribute.Int64(a.Key, v)
+	case float64:
+		return attribute.Float64(a.Key, v)
+	default:
+		return attribute.String(a.Key, fmt.Sprint(v))
+	}
+}
+
+func keyValues(attrs []Attribute) []attribute.KeyValue {
+	kvs := make([]attribute.KeyValue, len(attrs))
+	for i, a := range attrs {
+		kvs[i] = a.keyValue()
+	}
+	return kvs
+}
+
+const scopeName = "github.com/mmatczuk/go-http-tunnel"
+
+// Tracer creates spans and exports them in batches when they end. All Tracer
+// and Span methods are safe to call on nil values, that makes disabled
+// tracing free of checks.
+type Tracer struct {
+	provider *sdktrace.TracerProvider
+	tracer   oteltrace.Tracer
+}
+
+// NewTracer returns tracer exporting spans of a service with a given
+// exporter. Spans with a not sampled parent are not exported.
+func NewTracer(e sdktrace.SpanExporter, serviceName string) *Tracer {
+	p := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(e),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+	return &Tracer{
+		provider: p,
+		tracer:   p.Tracer(scopeName),
+	}
+}
+
+// Flush exports ended spans and waits until they are sent.
+func (t *Tracer) Flush() error {
+	if t == nil {
+		return nil
+	}
+	return t.provider.ForceFlush(context.Background())
+}
+
+// Close exports ended spans and stops tracer.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	return t.provider.Shutdown(context.Background())
+}
+
+// ContextWithRemote returns context carrying span context received from
+// other process, it becomes parent of spans started with that context unless
+// context carries a local span.
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	if !sc.IsValid() {
+		return ctx
+	}
+	return oteltrace.ContextWithRemoteSpanContext(ctx, sc)
+}
+
+// Start starts a span being a child of span carried by ctx, if there is no
+// parent a new trace is started. Returned context carries the new span. If
+// tracer is nil span is nil.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind, attrs ...Attribute) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	ctx, s := t.tracer.Start(ctx, name,
+		oteltrace.WithSpanKind(kind),
+		oteltrace.WithAttributes(keyValues(attrs)...),
+	)
+	return ctx, &Span{s}
+}
+
+// Span is an operation being traced.
+type Span struct {
+	span oteltrace.Span
+}
+
+// Context returns span context to be propagated.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.span.SpanContext()
+}
+
+// SetAttributes adds attributes to span.
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.span.SetAttributes(keyValues(attrs)...)
+}
+
+// SetError marks span as failed if err is not nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+// SetHTTPStatus records HTTP status code, server errors mark span as failed.
+func (s *Span) SetHTTPStatus(code int) {
+	if s == nil {
+		return
+	}
+	s.span.SetAttributes(attribute.Int("http.status_code", code))
+	if code >= 500 {
+		s.span.SetStatus(codes.Error, http.StatusText(code))
+	}
+}
+
+// End finishes span, subsequent calls are ignored.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.span.End()
+}
@@ -0,0 +1,167 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package trace
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	t.Parallel()
+
+	const tp = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(tp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID().String() != "00f067aa0ba902b7" || !sc.IsSampled() {
+		t.Errorf("unexpected span context %+v", sc)
+	}
+	if Traceparent(sc) != tp {
+		t.Errorf("expected %s got %s", tp, Traceparent(sc))
+	}
+
+	for _, s := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		if _, err := ParseTraceparent(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+func TestTracer_Start(t *testing.T) {
+	t.Parallel()
+
+	rec := tracetest.NewInMemoryExporter()
+	tracer := NewTracer(rec, "test")
+
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, parent := tracer.Start(ContextWithRemote(context.Background(), remote), "parent", KindServer)
+	_, child := tracer.Start(ctx, "child", KindClient)
+	child.SetError(errors.New("failed"))
+	child.End()
+	parent.SetHTTPStatus(http.StatusOK)
+	parent.End()
+	parent.End()
+
+	// not sampled remote parent
+	notSampled := remote.WithTraceFlags(0)
+	_, s := tracer.Start(ContextWithRemote(context.Background(), notSampled), "x", KindServer)
+	s.End()
+	if s.Context().TraceID() != remote.TraceID() || s.Context().IsSampled() {
+		t.Error("expected not sampled span", s.Context())
+	}
+
+	if err := tracer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	spans := rec.GetSpans()
+	if len(spans) != 2 {
+		t.Fatal("expected 2 spans, got", len(spans))
+	}
+	c, p := spans[0], spans[1]
+	if p.SpanContext.TraceID() != remote.TraceID() || p.Parent.SpanID() != remote.SpanID() {
+		t.Error("parent not linked to remote span", p)
+	}
+	if c.SpanContext.TraceID() != remote.TraceID() || c.Parent.SpanID() != p.SpanContext.SpanID() {
+		t.Error("child not linked to parent span", c)
+	}
+	if c.Status.Code != codes.Error || c.Status.Description != "failed" || p.Status.Code != codes.Unset {
+		t.Error("unexpected status", c.Status, p.Status)
+	}
+
+	// nil tracer
+	var nilTracer *Tracer
+	_, s = nilTracer.Start(context.Background(), "x", KindServer)
+	s.SetAttributes(Attribute{"k", "v"})
+	s.End()
+	if s.Context().IsValid() {
+		t.Error("expected invalid span context")
+	}
+}
+
+func attr(kvs []*commonpb.KeyValue, key string) *commonpb.AnyValue {
+	for _, kv := range kvs {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return nil
+}
+
+func TestOTLPTracer(t *testing.T) {
+	t.Parallel()
+
+	var req coltracepb.ExportTraceServiceRequest
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Error("unexpected request", r.URL, r.Header)
+		}
+		b, err := io.ReadAll(r.Body)
+		if err == nil {
+			err = proto.Unmarshal(b, &req)
+		}
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+	defer collector.Close()
+
+	tracer, err := NewOTLPTracer(collector.URL, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, parent := tracer.Start(context.Background(), "parent", KindServer, Attribute{"http.method", "GET"})
+	_, child := tracer.Start(ctx, "child", KindClient)
+	child.SetHTTPStatus(http.StatusBadGateway)
+	child.End()
+	parent.End()
+	if err := tracer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected request %+v", &req)
+	}
+	if v := attr(req.ResourceSpans[0].Resource.Attributes, "service.name"); v.GetStringValue() != "test" {
+		t.Errorf("unexpected service name %+v", v)
+	}
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatal("expected 2 spans, got", len(spans))
+	}
+	c, p := spans[0], spans[1]
+	if c.Name != "child" || c.Kind != tracepb.Span_SPAN_KIND_CLIENT || !bytes.Equal(c.TraceId, p.TraceId) ||
+		!bytes.Equal(c.ParentSpanId, p.SpanId) || len(p.ParentSpanId) != 0 {
+		t.Errorf("unexpected spans %+v %+v", c, p)
+	}
+	if c.Status.Code != tracepb.Status_STATUS_CODE_ERROR || attr(c.Attributes, "http.status_code").GetIntValue() != 502 {
+		t.Errorf("unexpected child %+v", c)
+	}
+	if attr(p.Attributes, "http.method").GetStringValue() != "GET" || p.StartTimeUnixNano == 0 {
+		t.Errorf("unexpected parent %+v", p)
+	}
+}
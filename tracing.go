@@ -0,0 +1,32 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"io"
+
+	"github.com/mmatczuk/go-http-tunnel/trace"
+)
+
+// tracedBody ends span when response body is closed.
+type tracedBody struct {
+	io.ReadCloser
+	span *trace.Span
+}
+
+func (b *tracedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.span.End()
+	return err
+}
+
+// parentSpan returns span context sent in control message.
+func parentSpan(traceparent string) trace.SpanContext {
+	if traceparent == "" {
+		return trace.SpanContext{}
+	}
+	sc, _ := trace.ParseTraceparent(traceparent)
+	return sc
+}
@@ -0,0 +1,211 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel_test
+
+import (
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel"
+	"github.com/mmatczuk/go-http-tunnel/keepalive"
+	"github.com/mmatczuk/go-http-tunnel/log"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+	"github.com/mmatczuk/go-http-tunnel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+type collectedSpan struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Name         string
+}
+
+// collector is in-process OTLP/HTTP collector.
+type collector struct {
+	spans map[string]collectedSpan
+	mu    sync.Mutex
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req coltracepb.ExportTraceServiceRequest
+	b, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = protobuf.Unmarshal(b, &req)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, s := range ss.Spans {
+				c.spans[s.Name] = collectedSpan{
+					TraceID:      hex.EncodeToString(s.TraceId),
+					SpanID:       hex.EncodeToString(s.SpanId),
+					ParentSpanID: hex.EncodeToString(s.ParentSpanId),
+					Name:         s.Name,
+				}
+			}
+		}
+	}
+}
+
+func (c *collector) get(name string) (collectedSpan, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.spans[name]
+	return s, ok
+}
+
+func TestIntegration_Tracing(t *testing.T) {
+	col := &collector{spans: make(map[string]collectedSpan)}
+	colServer := httptest.NewServer(col)
+	defer colServer.Close()
+
+	// local service
+	traceparent := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent <- r.Header.Get(trace.Header)
+	}))
+	defer backend.Close()
+
+	// server
+	serverTracer, err := trace.NewOTLPTracer(colServer.URL, "tunneld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverTracer.Close()
+	s, err := tunnel.NewServer(&tunnel.ServerConfig{
+		Addr:          ":0",
+		AutoSubscribe: true,
+		TLSConfig:     tlsConfig(),
+		Logger:        log.NewNopLogger(),
+		Tracer:        serverTracer,
+		KeepAlive: &keepalive.KeepAlive{
+			KeepAliveIdleTime: keepalive.DefaultKeepAliveIdleTime,
+			KeepAliveCount:    keepalive.DefaultKeepAliveCount,
+			KeepAliveInterval: keepalive.DefaultKeepAliveInterval,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	defer s.Stop()
+	h := httptest.NewServer(s)
+	defer h.Close()
+
+	// client
+	clientTracer, err := trace.NewOTLPTracer(colServer.URL, "tunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientTracer.Close()
+
+	backendURL, _ := url.Parse(backend.URL)
+	httpProxy := tunnel.NewMultiHTTPProxy(map[string]*url.URL{
+		"localhost:" + port(h.Listener.Addr()): backendURL,
+	}, log.NewNopLogger())
+	httpProxy.Tracer = clientTracer
+
+	c, err := tunnel.NewClient(&tunnel.ClientConfig{
+		ServerAddr:      s.Addr(),
+		TLSClientConfig: tlsConfig(),
+		Tunnels: map[string]*proto.Tunnel{
+			proto.HTTP: {
+				Protocol: proto.HTTP,
+				Host:     "localhost",
+			},
+		},
+		Proxy:  tunnel.Proxy(tunnel.ProxyFuncs{HTTP: httpProxy.Proxy}),
+		Logger: log.NewNopLogger(),
+		Tracer: clientTracer,
+		KeepAlive: &keepalive.KeepAlive{
+			KeepAliveIdleTime: keepalive.DefaultKeepAliveIdleTime,
+			KeepAliveCount:    keepalive.DefaultKeepAliveCount,
+			KeepAliveInterval: keepalive.DefaultKeepAliveInterval,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Start()
+	defer c.Stop()
+	time.Sleep(500 * time.Millisecond)
+
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		userTP  = "00-" + traceID + "-00f067aa0ba902b7-01"
+	)
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:"+port(h.Listener.Addr())+"/path", nil)
+	req.Header.Set(trace.Header, userTP)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("unexpected status", resp.Status)
+	}
+
+	// parent name for every expected span
+	chain := []struct{ name, parent string }{
+		{"Server.RoundTrip", ""},
+		{"Server.proxyHTTP", "Server.RoundTrip"},
+		{"Client.serveHTTP", "Server.proxyHTTP"},
+		{"HTTPProxy.Proxy", "Client.serveHTTP"},
+		{"HTTP GET", "HTTPProxy.Proxy"},
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		serverTracer.Flush()
+		clientTracer.Flush()
+		missing := false
+		for _, l := range chain {
+			if _, ok := col.get(l.name); !ok {
+				missing = true
+			}
+		}
+		if !missing {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("missing spans, got %v", col.spans)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	for _, l := range chain {
+		span, _ := col.get(l.name)
+		if span.TraceID != traceID {
+			t.Errorf("%s: unexpected trace id %s", l.name, span.TraceID)
+		}
+		parentID := "00f067aa0ba902b7"
+		if l.parent != "" {
+			p, _ := col.get(l.parent)
+			parentID = p.SpanID
+		}
+		if span.ParentSpanID != parentID {
+			t.Errorf("%s: expected parent %s got %s", l.name, parentID, span.ParentSpanID)
+		}
+	}
+
+	upstream, _ := col.get("HTTP GET")
+	if tp := <-traceparent; tp != "00-"+traceID+"-"+upstream.SpanID+"-01" {
+		t.Errorf("unexpected backend traceparent %s", tp)
+	}
+}
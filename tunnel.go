@@ -11,4 +11,27 @@ var (
 	DefaultTimeout = 10 * time.Second
 	// DefaultPingTimeout specifies a ping timeout.
 	DefaultPingTimeout = 500 * time.Millisecond
+	// DefaultCertExpiryWarning specifies how long before client certificate
+	// expiry server starts warning about it.
+	DefaultCertExpiryWarning = 14 * 24 * time.Hour
+	// DefaultExpiryCheckInterval specifies how often server checks
+	// certificates of connected clients and CRL for expiry.
+	DefaultExpiryCheckInterval = time.Hour
+	// DefaultTokenMaxLifetime specifies the longest validity of a client
+	// token.
+	DefaultTokenMaxLifetime = 24 * time.Hour
+	// DefaultOIDCSessionTTL specifies how long OIDC login session is valid.
+	DefaultOIDCSessionTTL = 12 * time.Hour
+	// DefaultQUICKeepAlivePeriod specifies how often QUIC control
+	// connection is pinged to keep NAT bindings.
+	DefaultQUICKeepAlivePeriod = 15 * time.Second
+	// DefaultWebSocketPath specifies path of HTTPS listener accepting
+	// control connections upgraded to WebSocket.
+	DefaultWebSocketPath = "/_tunnel"
+	// DefaultUDPIdleTimeout specifies how long UDP relay of socks5 tunnel
+	// keeps stream of a user without datagrams.
+	DefaultUDPIdleTimeout = 2 * time.Minute
+	// DefaultProxyIdleTimeout specifies how long CONNECT tunnel of
+	// httpconnect tunnel may have no traffic before it's closed.
+	DefaultProxyIdleTimeout = 5 * time.Minute
 )
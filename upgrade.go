@@ -0,0 +1,197 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/log"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// upgradeType returns protocol requested in Upgrade header if Connection
+// header contains upgrade token, otherwise empty string.
+func upgradeType(h http.Header) string {
+	for _, v := range h["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// upgradedBody is body of 101 Switching Protocols response, reads return
+// data from local service and writes send data to local service.
+type upgradedBody struct {
+	io.Reader
+	io.Writer
+	io.Closer
+}
+
+// readUpgradeResponse reads 101 Switching Protocols response of local
+// service sent by client in resp body. Writes to returned response body are
+// sent to client after request is written.
+func readUpgradeResponse(resp *http.Response, r *http.Request, pw *io.PipeWriter, written <-chan struct{}) (*http.Response, error) {
+	br := bufio.NewReader(resp.Body)
+	res, err := http.ReadResponse(br, r)
+	if err != nil {
+		return nil, fmt.Errorf("upgrade response: %s", err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("upgrade response: unexpected status %s", res.Status)
+	}
+
+	c := &upgradeConn{
+		br:      br,
+		body:    resp.Body,
+		pw:      pw,
+		written: written,
+	}
+	res.Body = &upgradedBody{c, c, c}
+
+	return res, nil
+}
+
+// upgradeConn is server side of upgraded stream.
+type upgradeConn struct {
+	br      *bufio.Reader
+	body    io.Closer
+	pw      *io.PipeWriter
+	written <-chan struct{}
+	once    sync.Once
+}
+
+func (c *upgradeConn) Read(p []byte) (int, error) {
+	return c.br.Read(p)
+}
+
+func (c *upgradeConn) Write(p []byte) (int, error) {
+	<-c.written
+	return c.pw.Write(p)
+}
+
+func (c *upgradeConn) Close() error {
+	c.once.Do(func() {
+		c.pw.Close()
+		c.body.Close()
+	})
+	return nil
+}
+
+// switchProtocols hijacks user connection and splices it with upgraded
+// stream.
+func (s *Server) switchProtocols(w http.ResponseWriter, r *http.Request, resp *http.Response) {
+	body, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		s.writeError(w, r, http.StatusBadGateway, "bad gateway")
+		return
+	}
+	h, ok := w.(http.Hijacker)
+	if !ok {
+		s.writeError(w, r, http.StatusInternalServerError, "upgrade not supported")
+		return
+	}
+	conn, brw, err := h.Hijack()
+	if err != nil {
+		s.logger.Log(
+			"level", 0,
+			"msg", "hijack failed",
+			"host", r.Host,
+			"err", err,
+		)
+		return
+	}
+	defer conn.Close()
+	if lw, ok := w.(*accessLogWriter); ok {
+		lw.status = http.StatusSwitchingProtocols
+	}
+
+	res := &http.Response{
+		Status:     resp.Status,
+		StatusCode: resp.StatusCode,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     resp.Header,
+	}
+	if err := res.Write(brw); err != nil {
+		return
+	}
+	if err := brw.Flush(); err != nil {
+		return
+	}
+
+	logger := log.NewContext(s.logger).With("host", r.Host, "addr", r.RemoteAddr)
+	done := make(chan struct{}, 2)
+	go func() {
+		transfer(body, brw, log.NewContext(logger).With("dir", "user to client"))
+		done <- struct{}{}
+	}()
+	go func() {
+		transfer(conn, body, log.NewContext(logger).With("dir", "client to user"))
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// upgradeWriter allows HTTPProxy to hijack the stream to server when local
+// service switches protocols. Server is informed with proto.HeaderUpgrade
+// and receives raw local service response followed by upgraded stream.
+type upgradeWriter struct {
+	http.ResponseWriter
+	br   *bufio.Reader
+	body io.Closer
+}
+
+func (w *upgradeWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	f, ok := w.ResponseWriter.(http.Flusher)
+	if !ok {
+		return nil, nil, errors.New("flush not supported")
+	}
+
+	h := w.Header()
+	h.Set(proto.HeaderUpgrade, "1")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+	// headers are sent, clear them for hijacker
+	for k := range h {
+		delete(h, k)
+	}
+
+	c := &streamConn{
+		Reader: w.br,
+		Writer: flushWriter{w.ResponseWriter},
+		body:   w.body,
+	}
+	return c, bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c)), nil
+}
+
+// streamConn is net.Conn over HTTP/2 stream.
+type streamConn struct {
+	io.Reader
+	io.Writer
+	body io.Closer
+}
+
+func (c *streamConn) Close() error                       { return c.body.Close() }
+func (c *streamConn) LocalAddr() net.Addr                { return streamAddr{} }
+func (c *streamConn) RemoteAddr() net.Addr               { return streamAddr{} }
+func (c *streamConn) SetDeadline(t time.Time) error      { return nil }
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type streamAddr struct{}
+
+func (streamAddr) Network() string { return "http2" }
+func (streamAddr) String() string  { return "tunnel" }
@@ -0,0 +1,30 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestUpgradeType(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		header   http.Header
+		expected string
+	}{
+		{http.Header{}, ""},
+		{http.Header{"Upgrade": {"websocket"}}, ""},
+		{http.Header{"Connection": {"close"}, "Upgrade": {"websocket"}}, ""},
+		{http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}}, "websocket"},
+		{http.Header{"Connection": {"keep-alive, upgrade"}, "Upgrade": {"h2c"}}, "h2c"},
+	}
+	for _, tt := range tests {
+		if u := upgradeType(tt.header); u != tt.expected {
+			t.Errorf("%v: expected %q got %q", tt.header, tt.expected, u)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/keepalive"
+)
+
+// Upstream is proxy forward proxies connect to destinations through.
+//
+// Rules are PAC-like, "DIRECT pattern" connects to destinations matching
+// pattern directly and "PROXY pattern" connects through the proxy, pattern
+// has DestinationACL rule syntax. The first matching rule decides,
+// destinations not matching any rule are connected through the proxy. Rules
+// are checked before name resolution, network rules match only IP
+// addresses.
+type Upstream struct {
+	url   *url.URL
+	rules []upstreamRule
+}
+
+type upstreamRule struct {
+	direct bool
+	dest   destRule
+}
+
+// NewUpstream creates Upstream for proxy URL with scheme http, https, socks5
+// or socks5h, credentials from URL user info are used for basic or SOCKS5
+// authentication.
+func NewUpstream(proxy string, rules []string) (*Upstream, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing proxy host")
+	}
+
+	up := &Upstream{url: u}
+	for _, s := range rules {
+		action, pattern, _ := strings.Cut(strings.TrimSpace(s), " ")
+		var r upstreamRule
+		switch strings.ToUpper(action) {
+		case "DIRECT":
+			r.direct = true
+		case "PROXY":
+		default:
+			return nil, fmt.Errorf("rule %q: expected DIRECT or PROXY", s)
+		}
+		if r.dest, err = parseDestRule(strings.TrimSpace(pattern)); err != nil {
+			return nil, err
+		}
+		up.rules = append(up.rules, r)
+	}
+
+	return up, nil
+}
+
+// String returns proxy URL with password redacted.
+func (u *Upstream) String() string {
+	return u.url.Redacted()
+}
+
+// direct checks if addr shall be connected directly. If u is nil all
+// destinations are connected directly.
+func (u *Upstream) direct(addr string) bool {
+	if u == nil {
+		return true
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	var (
+		name string
+		ip   = net.ParseIP(host)
+	)
+	if ip == nil {
+		name = strings.ToLower(strings.TrimSuffix(host, "."))
+	}
+
+	for _, r := range u.rules {
+		if r.dest.match(name, ip, port) {
+			return r.direct
+		}
+	}
+	return false
+}
+
+// dial connects to addr through the proxy.
+func (u *Upstream) dial(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error) {
+	d := &net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "tcp", proxyAddr(u.url))
+	if err != nil {
+		return nil, err
+	}
+	keepalive.SetDefaultKeepAlive(conn)
+
+	pconn, err := proxyConnect(conn, u.url, addr)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %s", u, err)
+	}
+	return pconn, nil
+}
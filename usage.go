@@ -0,0 +1,589 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+)
+
+var errQuotaExceeded = errors.New("monthly quota exceeded")
+
+// Usage is traffic accounted to a client or a tunnel.
+type Usage struct {
+	BytesIn           int64   `json:"bytes_in"`
+	BytesOut          int64   `json:"bytes_out"`
+	Requests          int64   `json:"requests"`
+	Connections       int64   `json:"connections"`
+	ConnectionSeconds float64 `json:"connection_seconds"`
+}
+
+func (u *Usage) add(v *Usage) {
+	u.BytesIn += v.BytesIn
+	u.BytesOut += v.BytesOut
+	u.Requests += v.Requests
+	u.Connections += v.Connections
+	u.ConnectionSeconds += v.ConnectionSeconds
+}
+
+// ClientUsage is traffic accounted to a client and its tunnels.
+type ClientUsage struct {
+	Usage
+	Tunnels map[string]*Usage `json:"tunnels"`
+}
+
+// Quota specifies monthly usage limits, zero values mean no limit.
+type Quota struct {
+	// Bytes limits bytes transferred in both directions.
+	Bytes             int64   `yaml:"bytes,omitempty" json:"bytes,omitempty"`
+	Requests          int64   `yaml:"requests,omitempty" json:"requests,omitempty"`
+	ConnectionSeconds float64 `yaml:"connection_seconds,omitempty" json:"connection_seconds,omitempty"`
+	// Throttle are limits applied to connected clients over quota, if nil
+	// their traffic is rejected.
+	Throttle *Limits `yaml:"throttle,omitempty" json:"throttle,omitempty"`
+}
+
+func (q *Quota) exceeded(u *Usage) bool {
+	if q == nil {
+		return false
+	}
+	return (q.Bytes > 0 && u.BytesIn+u.BytesOut >= q.Bytes) ||
+		(q.Requests > 0 && u.Requests >= q.Requests) ||
+		(q.ConnectionSeconds > 0 && u.ConnectionSeconds >= q.ConnectionSeconds)
+}
+
+// Ledger accounts usage of clients and tunnels in calendar months (UTC). It
+// is persisted to a JSON file with Save, when month changes usage of the
+// previous month is saved to the file with the month appended to the name,
+// i.e. usage.json.2017-01, and counters are reset. Bytes of streams are
+// counted by meters without taking the lock and folded into usage when it is
+// read, time of open connections is accrued at the same time.
+type Ledger struct {
+	// File is path to the ledger file, if empty ledger is not persisted.
+	File string
+	// Quota is the default monthly quota of a client.
+	Quota *Quota
+	// Quotas are monthly quotas of specific clients, overriding Quota.
+	Quotas map[id.ID]*Quota
+
+	month     string
+	clients   map[string]*ClientUsage
+	throttles map[id.ID]*limiter
+	meters    map[string]map[string]*meter
+	sessions  map[string]map[*session]struct{}
+	mu        sync.Mutex
+
+	now func() time.Time
+}
+
+type ledgerFile struct {
+	Month   string                  `json:"month"`
+	Clients map[string]*ClientUsage `json:"clients"`
+}
+
+// NewLedger creates ledger and loads usage of the current month from file.
+func NewLedger(file string, quota *Quota, quotas map[id.ID]*Quota) (*Ledger, error) {
+	l := &Ledger{
+		File:      file,
+		Quota:     quota,
+		Quotas:    quotas,
+		clients:   make(map[string]*ClientUsage),
+		throttles: make(map[id.ID]*limiter),
+		meters:    make(map[string]map[string]*meter),
+		sessions:  make(map[string]map[*session]struct{}),
+		now:       time.Now,
+	}
+	l.month = l.currentMonth()
+
+	if file == "" {
+		return l, nil
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var f ledgerFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+	if f.Clients != nil {
+		l.month = f.Month
+		l.clients = f.Clients
+	}
+
+	return l, nil
+}
+
+func (l *Ledger) currentMonth() string {
+	return l.now().UTC().Format("2006-01")
+}
+
+// Save writes ledger to file.
+func (l *Ledger) Save() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rotate()
+	l.flushAll()
+	return l.save(l.File)
+}
+
+// save must be called with lock held.
+func (l *Ledger) save(file string) error {
+	if file == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(&ledgerFile{
+		Month:   l.month,
+		Clients: l.clients,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// rotate archives and resets usage if month changed, it must be called with
+// lock held.
+func (l *Ledger) rotate() {
+	m := l.currentMonth()
+	if m == l.month {
+		return
+	}
+
+	// time of open connections until the month started belongs to the
+	// previous month
+	now := l.now().UTC()
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	for client := range l.meters {
+		l.flushUntil(client, start)
+	}
+	for client := range l.sessions {
+		l.flushUntil(client, start)
+	}
+	if l.File != "" {
+		l.save(l.File + "." + l.month)
+	}
+	l.month = m
+	l.clients = make(map[string]*ClientUsage)
+	l.throttles = make(map[id.ID]*limiter)
+}
+
+// Usage returns usage of a client in the current month.
+func (l *Ledger) Usage(identifier id.ID) *ClientUsage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rotate()
+	l.flush(identifier.String())
+	c, ok := l.clients[identifier.String()]
+	if !ok {
+		return nil
+	}
+	return c.copy()
+}
+
+func (c *ClientUsage) copy() *ClientUsage {
+	v := &ClientUsage{
+		Usage:   c.Usage,
+		Tunnels: make(map[string]*Usage, len(c.Tunnels)),
+	}
+	for name, u := range c.Tunnels {
+		t := *u
+		v.Tunnels[name] = &t
+	}
+	return v
+}
+
+func (l *Ledger) add(identifier id.ID, tunnel string, u *Usage) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rotate()
+	l.addLocked(identifier.String(), tunnel, u)
+}
+
+// addLocked must be called with lock held.
+func (l *Ledger) addLocked(client, tunnel string, u *Usage) {
+	c, ok := l.clients[client]
+	if !ok {
+		c = &ClientUsage{Tunnels: make(map[string]*Usage)}
+		l.clients[client] = c
+	}
+	c.add(u)
+
+	t, ok := c.Tunnels[tunnel]
+	if !ok {
+		t = &Usage{}
+		c.Tunnels[tunnel] = t
+	}
+	t.add(u)
+}
+
+func (l *Ledger) quota(identifier id.ID) *Quota {
+	if q, ok := l.Quotas[identifier]; ok {
+		return q
+	}
+	return l.Quota
+}
+
+// exceeded returns true if client is over quota.
+func (l *Ledger) exceeded(identifier id.ID) bool {
+	if l == nil {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rotate()
+	l.flush(identifier.String())
+	c, ok := l.clients[identifier.String()]
+	return ok && l.quota(identifier).exceeded(&c.Usage)
+}
+
+// throttle returns limiter of a client over quota and true if traffic
+// should be rejected.
+func (l *Ledger) throttle(identifier id.ID) (*limiter, bool) {
+	if !l.exceeded(identifier) {
+		return nil, false
+	}
+
+	q := l.quota(identifier)
+	if q.Throttle == nil {
+		return nil, true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	t, ok := l.throttles[identifier]
+	if !ok {
+		t = newLimiter(q.Throttle)
+		l.throttles[identifier] = t
+	}
+	return t, false
+}
+
+// ServeHTTP serves usage of the current month as JSON, the optional "id"
+// query parameter selects a single client.
+func (l *Ledger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.mu.Lock()
+	l.rotate()
+	l.flushAll()
+	v := ledgerFile{
+		Month:   l.month,
+		Clients: make(map[string]*ClientUsage, len(l.clients)),
+	}
+	for k, c := range l.clients {
+		v.Clients[k] = c.copy()
+	}
+	l.mu.Unlock()
+
+	if s := r.URL.Query().Get("id"); s != "" {
+		var identifier id.ID
+		if err := identifier.UnmarshalText([]byte(s)); err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		c, ok := v.Clients[identifier.String()]
+		if !ok {
+			http.Error(w, "no usage", http.StatusNotFound)
+			return
+		}
+		v.Clients = map[string]*ClientUsage{identifier.String(): c}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// throttleInterval is how often streams check if a client is over quota.
+const throttleInterval = time.Second
+
+// meter counts bytes of a client tunnel and shapes them when the client is
+// over quota.
+type meter struct {
+	in      int64
+	out     int64
+	checked int64
+	state   atomic.Value
+
+	l          *Ledger
+	identifier id.ID
+}
+
+type throttleState struct {
+	limiter *limiter
+	reject  bool
+}
+
+func (m *meter) add(n int, in bool) {
+	if in {
+		atomic.AddInt64(&m.in, int64(n))
+	} else {
+		atomic.AddInt64(&m.out, int64(n))
+	}
+}
+
+// limit returns limiter of a client over quota, or errQuotaExceeded if
+// traffic should be rejected. The quota is checked at most once per
+// throttleInterval so that streams do not contend for the lock.
+func (m *meter) limit() (*limiter, error) {
+	now := m.l.now().UnixNano()
+	if c := atomic.LoadInt64(&m.checked); now-c >= int64(throttleInterval) && atomic.CompareAndSwapInt64(&m.checked, c, now) {
+		l, reject := m.l.throttle(m.identifier)
+		m.state.Store(&throttleState{l, reject})
+	}
+
+	s, _ := m.state.Load().(*throttleState)
+	if s == nil {
+		return nil, nil
+	}
+	if s.reject {
+		return nil, errQuotaExceeded
+	}
+	return s.limiter, nil
+}
+
+// meter returns meter of a client tunnel, meters are kept across months.
+func (l *Ledger) meter(identifier id.ID, tunnel string) *meter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rotate()
+	client := identifier.String()
+	t, ok := l.meters[client]
+	if !ok {
+		t = make(map[string]*meter)
+		l.meters[client] = t
+	}
+	m, ok := t[tunnel]
+	if !ok {
+		m = &meter{l: l, identifier: identifier}
+		t[tunnel] = m
+	}
+	return m
+}
+
+// flush moves bytes counted by meters of a client to usage and accrues time
+// of open connections, it must be called with lock held.
+func (l *Ledger) flush(client string) {
+	l.flushUntil(client, l.now())
+}
+
+// flushUntil is flush accruing time of open connections until t, it must be
+// called with lock held.
+func (l *Ledger) flushUntil(client string, t time.Time) {
+	for s := range l.sessions[client] {
+		if t.After(s.last) {
+			l.addLocked(client, s.tunnel, &Usage{ConnectionSeconds: t.Sub(s.last).Seconds()})
+			s.last = t
+		}
+	}
+	for tunnel, m := range l.meters[client] {
+		u := Usage{
+			BytesIn:  atomic.SwapInt64(&m.in, 0),
+			BytesOut: atomic.SwapInt64(&m.out, 0),
+		}
+		if u.BytesIn != 0 || u.BytesOut != 0 {
+			l.addLocked(client, tunnel, &u)
+		}
+	}
+}
+
+// flushAll must be called with lock held.
+func (l *Ledger) flushAll() {
+	for client := range l.meters {
+		l.flush(client)
+	}
+	for client := range l.sessions {
+		l.flush(client)
+	}
+}
+
+// session is an open connection, its time is accrued when ledger is flushed.
+type session struct {
+	tunnel string
+	// last is time until which the session was accrued, it is guarded by
+	// the ledger lock.
+	last time.Time
+}
+
+// open accounts a new connection of a client tunnel, the returned session
+// must be closed with close.
+func (l *Ledger) open(identifier id.ID, tunnel string) *session {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rotate()
+	client := identifier.String()
+	l.addLocked(client, tunnel, &Usage{Connections: 1})
+
+	s := &session{tunnel: tunnel, last: l.now()}
+	t, ok := l.sessions[client]
+	if !ok {
+		t = make(map[*session]struct{})
+		l.sessions[client] = t
+	}
+	t[s] = struct{}{}
+	return s
+}
+
+// close accrues remaining time of a session.
+func (l *Ledger) close(identifier id.ID, s *session) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rotate()
+	client := identifier.String()
+	if now := l.now(); now.After(s.last) {
+		l.addLocked(client, s.tunnel, &Usage{ConnectionSeconds: now.Sub(s.last).Seconds()})
+		s.last = now
+	}
+	delete(l.sessions[client], s)
+	if len(l.sessions[client]) == 0 {
+		delete(l.sessions, client)
+	}
+}
+
+// meteredReader accounts bytes read.
+type meteredReader struct {
+	r  io.Reader
+	m  *meter
+	in bool
+}
+
+func (r *meteredReader) Read(p []byte) (int, error) {
+	l, err := r.m.limit()
+	if err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.m.add(n, r.in)
+		l.bandwidth(r.in).wait(n)
+	}
+	return n, err
+}
+
+func (l *Ledger) reader(r io.Reader, identifier id.ID, tunnel string, in bool) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &meteredReader{r, l.meter(identifier, tunnel), in}
+}
+
+// meteredWriter accounts bytes written.
+type meteredWriter struct {
+	w  io.Writer
+	m  *meter
+	in bool
+}
+
+func (w *meteredWriter) Write(p []byte) (int, error) {
+	l, err := w.m.limit()
+	if err != nil {
+		return 0, err
+	}
+	l.bandwidth(w.in).wait(len(p))
+	n, err := w.w.Write(p)
+	if n > 0 {
+		w.m.add(n, w.in)
+	}
+	return n, err
+}
+
+func (l *Ledger) writer(w io.Writer, identifier id.ID, tunnel string, in bool) io.Writer {
+	if l == nil {
+		return w
+	}
+	return &meteredWriter{w, l.meter(identifier, tunnel), in}
+}
+
+// meteredConn accounts and shapes bytes transferred and accounts connection
+// time.
+type meteredConn struct {
+	net.Conn
+	r          io.Reader
+	w          io.Writer
+	l          *Ledger
+	identifier id.ID
+	s          *session
+	once       sync.Once
+}
+
+func (c *meteredConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func (c *meteredConn) Close() error {
+	c.once.Do(func() {
+		c.l.close(c.identifier, c.s)
+	})
+	return c.Conn.Close()
+}
+
+func (l *Ledger) conn(conn net.Conn, identifier id.ID, tunnel string) net.Conn {
+	if l == nil {
+		return conn
+	}
+	m := l.meter(identifier, tunnel)
+	return &meteredConn{
+		Conn:       conn,
+		r:          &meteredReader{conn, m, true},
+		w:          &meteredWriter{conn, m, false},
+		l:          l,
+		identifier: identifier,
+		s:          l.open(identifier, tunnel),
+	}
+}
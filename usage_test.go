@@ -0,0 +1,272 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+func TestLedger(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "usage.json")
+
+	a := id.New([]byte("a"))
+	b := id.New([]byte("b"))
+
+	l, err := NewLedger(file, &Quota{Requests: 2}, map[id.ID]*Quota{
+		b: {Bytes: 100, Throttle: &Limits{BytesPerSecond: 10}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2017, 1, 31, 23, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+
+	l.add(a, "web", &Usage{Requests: 1})
+	if l.exceeded(a) {
+		t.Fatal("unexpected quota exceeded")
+	}
+	l.add(a, "web", &Usage{Requests: 1})
+	if _, reject := l.throttle(a); !reject {
+		t.Fatal("expected reject")
+	}
+
+	r := l.reader(bytes.NewReader(make([]byte, 60)), b, "ssh", true)
+	ioutil.ReadAll(r)
+	l.add(b, "web", &Usage{BytesOut: 40})
+	throttle, reject := l.throttle(b)
+	if reject || throttle == nil || throttle.in == nil {
+		t.Fatal("expected throttle")
+	}
+
+	u := l.Usage(b)
+	if u.BytesIn != 60 || u.BytesOut != 40 || u.Tunnels["ssh"].BytesIn != 60 || u.Tunnels["web"].BytesOut != 40 {
+		t.Fatalf("unexpected usage %+v", u)
+	}
+
+	if err := l.Save(); err != nil {
+		t.Fatal(err)
+	}
+	l, err = NewLedger(file, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.now = func() time.Time { return now }
+	if u := l.Usage(a); u == nil || u.Requests != 2 {
+		t.Fatalf("unexpected usage after reload %+v", u)
+	}
+
+	w := httptest.NewRecorder()
+	l.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/usage?id="+a.String(), nil))
+	var v ledgerFile
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Month != "2017-01" || len(v.Clients) != 1 || v.Clients[a.String()].Requests != 2 {
+		t.Fatalf("unexpected response %s", w.Body)
+	}
+
+	// new month
+	now = now.Add(2 * time.Hour)
+	if l.Usage(a) != nil {
+		t.Fatal("expected usage reset")
+	}
+	if _, err := os.Stat(file + ".2017-01"); err != nil {
+		t.Fatal("expected archived usage", err)
+	}
+}
+
+func TestLedger_Meter(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "usage.json")
+
+	a := id.New([]byte("a"))
+	l, err := NewLedger(file, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2017, 1, 31, 23, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := l.writer(ioutil.Discard, a, "web", false)
+			for j := 0; j < 100; j++ {
+				w.Write(make([]byte, 10))
+			}
+		}()
+	}
+	wg.Wait()
+
+	// bytes counted before month changed belong to the previous month
+	now = now.Add(2 * time.Hour)
+	ioutil.ReadAll(l.reader(bytes.NewReader(make([]byte, 5)), a, "web", true))
+	if u := l.Usage(a); u == nil || u.BytesIn != 5 || u.BytesOut != 0 {
+		t.Fatalf("unexpected usage %+v", u)
+	}
+
+	b, err := ioutil.ReadFile(file + ".2017-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v ledgerFile
+	if err := json.Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	if c := v.Clients[a.String()]; c == nil || c.BytesOut != 10000 || c.Tunnels["web"].BytesOut != 10000 {
+		t.Fatalf("unexpected archived usage %s", b)
+	}
+}
+
+func TestServer_Quota(t *testing.T) {
+	t.Parallel()
+
+	identifier := id.New([]byte("client"))
+	l, err := NewLedger("", &Quota{Requests: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.add(identifier, "web", &Usage{Requests: 1})
+
+	s := &Server{
+		registry: newRegistry(nil),
+		config:   &ServerConfig{Ledger: l},
+		metrics:  newMetrics(),
+	}
+	s.Subscribe(identifier)
+
+	err = s.addTunnels(map[string]*proto.Tunnel{
+		"web": {Protocol: proto.HTTP, Host: "app.example.com"},
+	}, identifier)
+	if err != errQuotaExceeded {
+		t.Fatal("expected quota exceeded got", err)
+	}
+}
+
+func TestLedger_OpenConn(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "usage.json")
+
+	a := id.New([]byte("a"))
+	b := id.New([]byte("b"))
+	l, err := NewLedger(file, &Quota{Bytes: 100}, map[id.ID]*Quota{
+		b: {Bytes: 100, Throttle: &Limits{BytesPerSecond: 1000}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	now := time.Date(2017, 1, 31, 23, 59, 0, 0, time.UTC)
+	l.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		mu.Lock()
+		now = now.Add(d)
+		mu.Unlock()
+	}
+
+	c0, c1 := net.Pipe()
+	defer c1.Close()
+	go io.Copy(ioutil.Discard, c1)
+	conn := l.conn(c0, a, "ssh")
+
+	// time of open connection is accrued on flush
+	advance(30 * time.Second)
+	if u := l.Usage(a); u == nil || u.Connections != 1 || u.ConnectionSeconds != 30 {
+		t.Fatalf("unexpected usage %+v", u)
+	}
+
+	// and split between months
+	advance(40 * time.Second)
+	if u := l.Usage(a); u == nil || u.ConnectionSeconds != 10 {
+		t.Fatalf("unexpected usage %+v", u)
+	}
+	if err := l.Save(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.ReadFile(file + ".2017-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v ledgerFile
+	if err := json.Unmarshal(f, &v); err != nil {
+		t.Fatal(err)
+	}
+	if c := v.Clients[a.String()]; c == nil || c.ConnectionSeconds != 60 {
+		t.Fatalf("unexpected archived usage %s", f)
+	}
+
+	// traffic of open connection is rejected when quota is exceeded
+	if _, err := conn.Write(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	advance(throttleInterval)
+	if _, err := conn.Write(make([]byte, 1)); err != errQuotaExceeded {
+		t.Fatal("expected quota exceeded got", err)
+	}
+
+	advance(5 * time.Second)
+	conn.Close()
+	if u := l.Usage(a); u == nil || u.ConnectionSeconds != 16 {
+		t.Fatalf("unexpected usage %+v", u)
+	}
+
+	// or throttled
+	d0, d1 := net.Pipe()
+	defer d1.Close()
+	go io.Copy(ioutil.Discard, d1)
+	conn = l.conn(d0, b, "ssh")
+	defer conn.Close()
+
+	if _, err := conn.Write(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	advance(throttleInterval)
+	start := time.Now()
+	if _, err := conn.Write(make([]byte, 1500)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Fatal("expected throttled write, took", d)
+	}
+}
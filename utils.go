@@ -10,9 +10,39 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/inconshreveable/go-vhost"
+
 	"github.com/mmatczuk/go-http-tunnel/log"
 )
 
+// reset closes TCP connection with RST instead of FIN.
+func reset(conn net.Conn) {
+	c := unwrapConn(conn)
+	if tcpConn, ok := c.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// unwrapConn returns connection underlying TLS, logging, metering and
+// shaping wrappers.
+func unwrapConn(conn net.Conn) net.Conn {
+	for {
+		switch v := conn.(type) {
+		case *vhost.TLSConn:
+			conn = v.Conn
+		case *shapedConn:
+			conn = v.Conn
+		case *loggedConn:
+			conn = v.Conn
+		case *meteredConn:
+			conn = v.Conn
+		default:
+			return conn
+		}
+	}
+}
+
 func transfer(dst io.Writer, src io.Reader, logger log.Logger) {
 	n, err := io.Copy(dst, src)
 	if err != nil {
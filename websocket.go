@@ -0,0 +1,131 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// ServeWebSocket accepts control connection upgraded to WebSocket, it
+// carries the same HTTP/2 control protocol as TCP connections. The client is
+// identified by certificate it presented to the HTTPS listener, so the
+// listener must request client certificates, or by a token if TokenAuth is
+// enabled. Requests without TLS are rejected.
+func (s *Server) ServeWebSocket(w http.ResponseWriter, r *http.Request) {
+	ws := websocket.Server{
+		// control connections are not made by browsers, origin is not
+		// checked
+		Handshake: func(*websocket.Config, *http.Request) error {
+			return nil
+		},
+		Handler: func(conn *websocket.Conn) {
+			conn.PayloadType = websocket.BinaryFrame
+
+			c := &wsConn{
+				Conn:   conn,
+				closed: make(chan struct{}),
+			}
+			if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+				c.remote = addr
+			}
+			if r.TLS != nil {
+				c.state = *r.TLS
+			}
+
+			s.handleClient(c)
+
+			// connection is hijacked until handler returns
+			<-c.closed
+		},
+	}
+	ws.ServeHTTP(w, r)
+}
+
+// wsConn is control connection upgraded to WebSocket, it exposes address and
+// TLS state of the underlying HTTPS connection.
+type wsConn struct {
+	*websocket.Conn
+	remote net.Addr
+	state  tls.ConnectionState
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	if c.remote == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remote
+}
+
+// Handshake is a no-op, TLS handshake is done by HTTPS server.
+func (c *wsConn) Handshake() error {
+	return nil
+}
+
+// ConnectionState returns TLS state of the HTTPS connection.
+func (c *wsConn) ConnectionState() tls.ConnectionState {
+	return c.state
+}
+
+func (c *wsConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return c.Conn.Close()
+}
+
+// dialWebSocket connects to HTTPS listener of the server and upgrades
+// connection to WebSocket.
+func (c *Client) dialWebSocket(addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	conn, err := c.dialTCP("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// WebSocket upgrade requires HTTP/1.1
+	conf := tlsConfig.Clone()
+	conf.NextProtos = []string{"http/1.1"}
+	// server asks for client certificate only when its host name is sent
+	if conf.ServerName == "" {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			conf.ServerName = host
+		}
+	}
+	tlsConn := tls.Client(conn, conf)
+	tlsConn.SetDeadline(time.Now().Add(DefaultTimeout))
+
+	path := c.config.WebSocketPath
+	if path == "" {
+		path = DefaultWebSocketPath
+	}
+	u := &url.URL{Scheme: "wss", Host: addr, Path: path}
+	config, err := websocket.NewConfig(u.String(), "https://"+addr)
+	if err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	ws, err := websocket.NewClient(config, tlsConn)
+	if err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+
+	wc := &wsConn{
+		Conn:   ws,
+		remote: conn.RemoteAddr(),
+		state:  tlsConn.ConnectionState(),
+		closed: make(chan struct{}),
+	}
+	return wc, tlsConn.SetDeadline(time.Time{})
+}